@@ -3,37 +3,30 @@ package main
 // This file implements a matchmaking server.
 
 import (
+	"crypto/rand"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"net"
 	"net/rpc"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 /////////// Debugging Helper
 
-// Level for printing
-// 0 - only errors
-// 1 - general connection info, key info
-// 2 - message aggreagtion
-// 3 - Messages being sent
-// 4 - Everything
-const DebugLevel int = 4
-
-func DebugPrint(level int, str string) {
-	if level <= DebugLevel {
-		fmt.Println(str)
-	}
-}
-
 // The program should exit if this gives error
 func FatalError(e error) {
 	if e != nil {
-		fmt.Println(e)
+		if opsLog == nil { // logging isn't set up yet
+			fmt.Println(e)
+		} else {
+			opsLog.Error("Fatal error", "err", e)
+		}
 		os.Exit(-10)
 	}
 }
@@ -41,7 +34,7 @@ func FatalError(e error) {
 // Help debug the location
 func CheckError(err error, n int) {
 	if err != nil {
-		fmt.Println(n, ": ", err)
+		opsLog.Error("Error", "line", n, "err", err)
 	}
 }
 
@@ -49,20 +42,40 @@ func CheckError(err error, n int) {
 
 // Object to be sent back to the client
 type Node struct {
-	Id string // [p1 to p6]
-	Ip string // ip to send to each player
+	Id      string  // [p1 to p6]
+	Ip      string  // ip to send to each player
+	Team    int     // [1 to Teams], 0 when playing free for all
+	Profile Profile // the player's id, name and colour
 }
 
 // Object received from the clients at the start
 type NodeJoin struct {
-	RpcIp string // The one MS has to dial at start Game
-	Ip    string // ip to send to each player
-	Log   []byte
+	RpcIp   string // The one MS has to dial at start Game
+	Ip      string // ip to send to each player
+	Profile Profile
+	Log     []byte
+}
+
+// Rules shared by every node in a game room
+type GameOptions struct {
+	WrapAround    bool // leaving one edge of the board re-enters from the opposite edge
+	Teams         int  // number of teams, 0 for free for all
+	FriendlyFire  bool // colliding with a teammate's trail is lethal
+	TrailLength   int  // maximum number of cells in a trail, 0 for no limit
+	TrailLifetime int  // number of ticks before a trail cell fades, 0 to never fade
+
+	SuddenDeathTick int // tick at which the board starts to shrink, 0 for never
+	ShrinkInterval  int // number of ticks between two rings of the board closing
+	MaxTicks        int // number of ticks after which the game is a draw, 0 for no limit
 }
 
 type GameArgs struct {
-	NodeList []*Node // List of peer a node should talk to
-	Log      []byte
+	NodeList   []*Node // List of peer a node should talk to
+	Options    GameOptions
+	SessionKey []byte // key the room's nodes sign their messages to each other with
+	PeerKey    []byte // key the room's nodes encrypt their packets with, empty when they don't
+	RoomId     int    // id of the game, for the nodes to tag their logs with
+	Log        []byte
 }
 
 // Reply from client
@@ -71,10 +84,28 @@ type ValReply struct {
 	Log []byte
 }
 
+// A game that has been started, listed for spectators
+type Room struct {
+	Id      int
+	Players []*Node
+	Started time.Time
+
+	rpcIps map[string]string // player id to the rpc ip of its node
+}
+
+// Reply to a spectator asking for the rooms being played
+type RoomList struct {
+	Rooms []*Room
+	Log   []byte
+}
+
 // MS node
 type MsNode struct {
-	Node *Node
-	Id   int // the order of node
+	Node  *Node
+	Id    int  // the order of node
+	Ready bool // does the player want to start without waiting for the timer
+
+	Joined time.Time // when the player joined the queue
 }
 
 type MsNodeList []*MsNode
@@ -94,11 +125,35 @@ type Context struct {
 	clientNum   int                    // the order of incoming clients
 	roomLimit   int
 	gameTimer   *time.Timer // timer until game start
+	options     GameOptions // rules sent to every room at start game
+	rpcAddr     string      // ip clients join at
+
+	botConfig    BotConfig
+	bots         map[string]bool // rpcIP of every bot launched
+	botsLaunched bool            // have bots been launched for the waiting room
+
+	roomLock   sync.Mutex
+	rooms      []*Room // games started, for spectators to watch
+	nextRoomId int
+
+	timerLock     sync.Mutex
+	timerDeadline time.Time // when gameTimer fires, for lobby countdowns
+
+	cheatLock    sync.Mutex
+	cheatReports map[string]int // player id to the number of games they were reported cheating in
+
+	encryptPeers bool // do nodes encrypt the packets they send each other
+
+	limits    Limits
+	guardLock sync.Mutex
+	conns     map[string]int         // ip to its open connections
+	joins     map[string]*joinBucket // ip to the joins it has left
+	bans      *BanList
 }
 
 // Construct a game room from nodeList
 func (this *Context) makeGameRoom() {
-	fmt.Println("Making a Game room")
+	lobbyLog.Debug("Making a Game room")
 
 	// Sort the MsNodeList based on id
 	ml := make(MsNodeList, len(this.nodeList))
@@ -116,35 +171,99 @@ func (this *Context) makeGameRoom() {
 	}
 }
 
-// Assign id to each client
+// Assign id to each client, and a team when playing in teams
 func (this *Context) assignID() {
-	fmt.Println("Assigning IDs")
+	lobbyLog.Debug("Assigning IDs")
 	for index, client := range this.gameRoom {
 		client.Id = "p" + strconv.Itoa(index+1)
+		if this.options.Teams > 0 {
+			client.Team = index%this.options.Teams + 1
+		}
 	}
+	this.settleProfiles()
 }
 
-// Notify all cients in current session about other players in the same room
-func (this *Context) startGame() {
-	fmt.Println("Connection Number:", len(this.connections))
-	for key, msNodeVal := range this.nodeList {
-		var reply *ValReply = &ValReply{Val: ""}
-		log := logSend("Rpc Call " + RPC_START_GAME + " to " + msNodeVal.Node.Ip)
-		e := this.connections[key].Call(RPC_START_GAME,
-			&GameArgs{NodeList: this.gameRoom, Log: log}, reply)
-		if e != nil {
-			fmt.Println("Failed to start", key)
-		}
+// Check if a room with this many players can start.
+// Team games need at least 2 players on every team, and the same number on each.
+// Rooms with nothing but bots never start.
+func (this *Context) canStartGame(players int) bool {
+	if players == this.countBots() {
+		return false
 	}
+	if this.options.Teams > 0 {
+		return players >= 2*this.options.Teams && players%this.options.Teams == 0
+	}
+	return players >= leastPlayers
+}
+
+// Make a new key for a room's nodes to sign their messages with
+func newSessionKey() []byte {
+	key := make([]byte, SESSION_KEY_SIZE)
+	_, e := rand.Read(key)
+	FatalError(e)
+	return key
+}
+
+// A game room taken out of the queue, about to start
+type gameStart struct {
+	gameRoom    []*Node
+	nodeList    map[string]*MsNode
+	connections map[string]*rpc.Client
+}
+
+// Take the game room out of the queue, so nodes joining from now on wait for
+// the next game. Called with NodeLock held
+func (this *Context) takeGameRoom() *gameStart {
+	this.observeTimeToMatch()
+	start := &gameStart{gameRoom: this.gameRoom, nodeList: this.nodeList, connections: this.connections}
 
 	// Clear the game room, nodelist, and connections
 	this.gameRoom = make([]*Node, 0)
 	this.nodeList = make(map[string]*MsNode)
 	this.connections = make(map[string]*rpc.Client)
 	this.clientNum = 0
+	this.botsLaunched = false
+	return start
+}
+
+// Notify all cients in current session about other players in the same room
+func (this *Context) startGame(start *gameStart) {
+	gamesStarted.inc("")
+	sessionKey := newSessionKey()
+	var peerKey []byte
+	if this.encryptPeers {
+		peerKey = newSessionKey()
+	}
+	this.roomLock.Lock()
+	this.nextRoomId++
+	roomId := this.nextRoomId
+	this.roomLock.Unlock()
+	ips := make([]string, len(start.gameRoom))
+	for i, node := range start.gameRoom {
+		ips[i] = node.Ip
+	}
+	lobbyLog.Info("Starting Game", "game", roomId, "players", len(start.gameRoom), "connections", len(start.connections),
+		"nodes", strings.Join(ips, ","))
+	rpcIps := make(map[string]string)
+	for key, msNodeVal := range start.nodeList {
+		rpcIps[msNodeVal.Node.Id] = key
+		var reply *ValReply = &ValReply{Val: ""}
+		log := logSend("Rpc Call " + RPC_START_GAME + " to " + msNodeVal.Node.Ip)
+		e := start.connections[key].Call(RPC_START_GAME, &GameArgs{NodeList: start.gameRoom,
+			Options: this.options, SessionKey: sessionKey, PeerKey: peerKey, RoomId: roomId, Log: log}, reply)
+		if e != nil {
+			lobbyLog.Error("Failed to start", "game", roomId, "node", key, "err", e)
+		}
+	}
+
+	// List the room for spectators
+	this.roomLock.Lock()
+	this.rooms = append(this.rooms,
+		&Room{Id: roomId, Players: start.gameRoom, Started: time.Now(), rpcIps: rpcIps})
+	this.roomLock.Unlock()
 
 	// Reset the timer
-	this.gameTimer.Reset(SESSION_DELAY)
+	this.resetTimer(SESSION_DELAY)
 }
 
 // Update NodeList and Connection based on disconnected clients
@@ -160,25 +279,23 @@ func (this *Context) checkConn() {
 			log := logSend("Rpc Call " + RpcMessage)
 			e := this.connections[ClientIp].Call(RpcMessage, &GameArgs{NodeList: this.gameRoom, Log: log}, reply)
 			if e != nil {
-				fmt.Println(e)
-				fmt.Println("Deleting disconnected node ", ClientIp)
+				rpcLog.Info("Deleting disconnected node", "node", ClientIp, "err", e)
 				delete(this.nodeList, ClientIp)
 				delete(this.connections, ClientIp)
 				continue
 			} else {
 				// Update connection for each client
-				fmt.Println("client: ", ClientIp, " is good.")
+				rpcLog.Debug("Client is good", "node", ClientIp)
 			}
 		} else {
-			c, e := rpc.Dial("tcp", ClientIp)
+			c, e := dialRPC(ClientIp)
 			if e != nil {
-				fmt.Println(e)
-				fmt.Println("Deleting disconnected node ", ClientIp)
+				rpcLog.Info("Deleting disconnected node", "node", ClientIp, "err", e)
 				delete(this.nodeList, ClientIp)
 				continue
 			} else {
 				// Update connection for each client
-				fmt.Println("client: ", ClientIp, " is good.")
+				rpcLog.Debug("Client is good", "node", ClientIp)
 				this.connections[ClientIp] = c
 			}
 		}
@@ -189,62 +306,114 @@ func (this *Context) checkConn() {
 // RPC join called by a client
 func (this *Context) Join(nodeJoin *NodeJoin, reply *ValReply) error {
 	logReceive("AD: new node: IP: "+nodeJoin.Ip+" Log: ", nodeJoin.Log)
-	AddNode(this, nodeJoin)
-	localLog("New node: ", nodeJoin.Ip)
+	if this.isBanned("", nodeJoin.Profile.PlayerId) {
+		lobbyLog.Warn("Rejected banned player", "player", nodeJoin.Profile.PlayerId, "node", nodeJoin.Ip)
+		joins.inc("rejected")
+		return errors.New("you are banned from this server")
+	}
+	if e := AddNode(this, nodeJoin); e != nil {
+		lobbyLog.Warn("Rejected node", "node", nodeJoin.Ip, "err", e)
+		joins.inc("rejected")
+		return e
+	}
+	joins.inc("accepted")
+	lobbyLog.Info("New node", "node", nodeJoin.Ip, "name", nodeJoin.Profile.Name)
 	this.checkConn() // Update NodeList and Connections
 
-	localLog("Join:", len(this.nodeList), "players")
+	lobbyLog.Info("Join", "players", len(this.nodeList))
 
 	// Check if the room is full
 	if len(this.nodeList) >= this.roomLimit {
 		this.NodeLock.Lock()
-		localLog("Join: Starting Game")
+		lobbyLog.Info("Room is full")
 		this.makeGameRoom()
 		this.assignID()
-		go this.startGame()
+		go this.startGame(this.takeGameRoom())
 		this.NodeLock.Unlock()
 	} else {
-		localLog("Join:", len(this.nodeList), "players waiting")
+		lobbyLog.Info("Waiting", "players", len(this.nodeList))
+		go this.pushLobby()
 	}
 	return nil
 }
 
+// RPC called by a spectator to find a game to watch. Rooms are listed until
+// they are older than ROOM_LIFETIME, since games don't report when they end.
+func (this *Context) ListRooms(args *ValReply, reply *RoomList) error {
+	logReceive("LR: spectator listing rooms", args.Log)
+	this.roomLock.Lock()
+	defer this.roomLock.Unlock()
+
+	live := make([]*Room, 0, len(this.rooms))
+	for _, room := range this.rooms {
+		if time.Since(room.Started) < ROOM_LIFETIME {
+			live = append(live, room)
+		}
+	}
+	this.rooms = live
+
+	lobbyLog.Debug("Listing rooms", "rooms", len(live))
+	reply.Rooms = live
+	reply.Log = logSend("Reply to ListRooms")
+	return nil
+}
+
 // Perform certain operation every SESSION_DELAY
 func endSession(this *Context) {
 	defer waitGroup.Done()
 	for _ = range this.gameTimer.C {
 		this.checkConn() // Update NodeList and Connections
 
-		// At are at least 2 players in the room
-		if len(this.nodeList) >= leastPlayers {
+		// Give the room's bots a moment to join before starting
+		if this.needsBots() {
+			this.launchBots()
+			this.resetTimer(BOT_JOIN_DELAY)
+			continue
+		}
+
+		// At are at least 2 players in the room, or enough for balanced teams
+		if this.canStartGame(len(this.nodeList)) {
 			this.NodeLock.Lock()
-			localLog("ES: Starting Game")
+			lobbyLog.Info("Session ended", "players", len(this.nodeList))
 			this.makeGameRoom()
 			this.assignID()
-			go this.startGame()
-			log.Println("ES: Done Start Game")
+			go this.startGame(this.takeGameRoom())
 			this.NodeLock.Unlock()
 		} else {
-			this.gameTimer.Reset(SESSION_DELAY)
-			localLog("ES:", len(this.nodeList), "players waiting")
+			this.resetTimer(SESSION_DELAY)
+			lobbyLog.Info("Waiting", "players", len(this.nodeList))
+			go this.pushLobby()
 		}
 	}
 }
 
 /////////// Helper methods
 
-// this is called when a node joins, it handles adding the node to lists
-func AddNode(ctx *Context, nodeJoin *NodeJoin) {
+// this is called when a node joins, it handles adding the node to lists.
+// Nodes whose profile is malformed or taken in the room are turned away, and
+// so are new nodes once the queue is full
+func AddNode(ctx *Context, nodeJoin *NodeJoin) error {
+	if e := validateProfile(&nodeJoin.Profile); e != nil {
+		return e
+	}
 	ctx.NodeLock.Lock()
-	fmt.Println("AD: new node:", nodeJoin)
+	defer ctx.NodeLock.Unlock()
+	if e := ctx.checkProfileUnique(nodeJoin.RpcIp, &nodeJoin.Profile); e != nil {
+		return e
+	}
+	if _, rejoin := ctx.nodeList[nodeJoin.RpcIp]; !rejoin && len(ctx.nodeList) >= ctx.limits.MaxQueue {
+		return fmt.Errorf("the queue is full (%d players waiting), try again once the next game has started",
+			len(ctx.nodeList))
+	}
+	lobbyLog.Debug("Adding node", "node", nodeJoin.RpcIp, "ip", nodeJoin.Ip, "profile", nodeJoin.Profile)
 	// Add this client to the gameRoom & NodeList
-	node := &Node{Ip: nodeJoin.Ip}
-	msn := &MsNode{Node: node, Id: ctx.clientNum}
+	node := &Node{Ip: nodeJoin.Ip, Profile: nodeJoin.Profile}
+	msn := &MsNode{Node: node, Id: ctx.clientNum, Joined: time.Now()}
 	ctx.clientNum++
 	ctx.nodeList[nodeJoin.RpcIp] = msn
 
-	log.Println("AD: NodeList:", ctx.nodeList, ". Numb:", len(ctx.nodeList), "players.")
-	ctx.NodeLock.Unlock()
+	lobbyLog.Debug("Added node", "players", len(ctx.nodeList))
+	return nil
 }
 
 // Listen and serve request from client
@@ -252,9 +421,9 @@ func listenToClient(ctx *Context, rpcAddr string) {
 	defer waitGroup.Done()
 	for {
 		rpc.Register(ctx)
-		listener, e := net.Listen("tcp", rpcAddr)
+		listener, e := listenRPC(rpcAddr)
 		FatalError(e)
-		fmt.Println("LISTENING")
+		rpcLog.Info("Listening", "addr", rpcAddr)
 
 		for {
 			connection, e := listener.Accept()
@@ -262,7 +431,7 @@ func listenToClient(ctx *Context, rpcAddr string) {
 			defer connection.Close()
 
 			// Handle one connection at a time
-			go rpc.ServeConn(connection)
+			go serveClient(ctx, connection)
 		}
 		time.Sleep(time.Millisecond * 100)
 	}
@@ -271,37 +440,125 @@ func listenToClient(ctx *Context, rpcAddr string) {
 // Global variables
 var waitGroup sync.WaitGroup // Wait group
 const SESSION_DELAY time.Duration = 30 * time.Second
+const ROOM_LIFETIME time.Duration = 15 * time.Minute
+const SESSION_KEY_SIZE int = 32
 const RPC_START_GAME string = "NodeService.StartGame"
 const RpcMessage string = "NodeService.Message"
 const leastPlayers int = 2
+const defaultRoomLimit int = 6
 
 func main() {
-	// go run MS.go :4421
-	if len(os.Args) != 2 {
+	// go run MS.go abuse.go bots.go cheats.go lobby.go log.go metrics.go profile.go trace.go transport.go [-wrap] [-teams 2] [-friendlyfire] [-bots ../Node-Client/Node-Client] :4421
+	wrapAround := flag.Bool("wrap", false, "play on a wrap-around (toroidal) board")
+	teams := flag.Int("teams", 0, "number of teams (2 or 3), 0 for free for all")
+	friendlyFire := flag.Bool("friendlyfire", false, "colliding with a teammate's trail is lethal")
+	trailLength := flag.Int("traillength", 0, "maximum number of cells in a trail, 0 for no limit")
+	trailLifetime := flag.Int("traillifetime", 0, "number of ticks before a trail cell fades, 0 to never fade")
+	suddenDeath := flag.Int("suddendeath", 0, "tick at which the board starts to shrink, 0 for never")
+	shrinkInterval := flag.Int("shrinkinterval", 10, "number of ticks between two rings of the board closing")
+	maxTicks := flag.Int("maxticks", 0, "number of ticks after which the game is a draw, 0 for no limit")
+	botPath := flag.String("bots", "", "Node-Client binary used to fill rooms with bots, empty for no bots")
+	botLevel := flag.String("botlevel", "medium", "difficulty of the bots (easy, medium or hard)")
+	botHost := flag.String("bothost", "127.0.0.1", "ip the bots listen on")
+	tlsCert := flag.String("tlscert", "", "certificate to serve RPCs over TLS with, signed by -tlsca")
+	tlsKey := flag.String("tlskey", "", "key of the -tlscert certificate")
+	tlsCA := flag.String("tlsca", "", "CA that signs the certificates of the server and every node")
+	encryptPeers := flag.Bool("encryptpeers", false, "make nodes encrypt the packets they send each other")
+	maxConns := flag.Int("maxconns", 8, "connections an ip may keep open, 0 for no limit")
+	joinRate := flag.Int("joinrate", 6, "times an ip may join the queue per minute, 0 for no limit")
+	maxQueue := flag.Int("maxqueue", defaultRoomLimit, "players who may wait for a game at once")
+	banPath := flag.String("banlist", "", "file of banned ips and player ids, read again whenever it changes")
+	metricsAddr := flag.String("metrics", "", "serve the metrics for Prometheus at /metrics, and with -admintoken the log level at /loglevel, on this ip:port")
+	adminTokenPath := flag.String("admintoken", "", "serve the log level to requests with the token in this file")
+	level := flag.String("loglevel", "info", "level to log at: debug, info, warn or error")
+	flag.StringVar(&logFormat, "logformat", "logfmt", "format of the logs: logfmt or json")
+	flag.IntVar(&logMaxSize, "logmaxsize", 10, "megabytes the local log grows to before it is rotated, 0 to never rotate")
+	flag.IntVar(&logBackups, "logbackups", 3, "rotated local logs to keep")
+	flag.StringVar(&traceKind, "trace", TRACE_GOVEC, "how to trace messages: govec for ShiViz, spans, or none")
+	flag.Parse()
+	if flag.NArg() != 1 {
 		fmt.Println("Not enough arguments")
 		os.Exit(-1)
 	}
+	if *teams != 0 && (*teams < 2 || 2**teams > defaultRoomLimit) {
+		fmt.Println("Teams must be 0 (free for all), or allow at least 2 players per team")
+		os.Exit(-1)
+	}
+	if *trailLength < 0 || *trailLifetime < 0 {
+		fmt.Println("Trail length and lifetime cannot be negative")
+		os.Exit(-1)
+	}
+	if *botLevel != "easy" && *botLevel != "medium" && *botLevel != "hard" {
+		fmt.Println("Bot level must be easy, medium or hard")
+		os.Exit(-1)
+	}
+	if *suddenDeath < 0 || *shrinkInterval < 1 || *maxTicks < 0 {
+		fmt.Println("Sudden death and max ticks cannot be negative, and rings need at least 1 tick between them")
+		os.Exit(-1)
+	}
+	if *maxConns < 0 || *joinRate < 0 || *maxQueue < leastPlayers {
+		fmt.Println("Limits cannot be negative, and the queue must fit at least", leastPlayers, "players")
+		os.Exit(-1)
+	}
+	if e := checkLogFlags(*level); e != nil {
+		fmt.Println("Bad log flags:", e)
+		os.Exit(-1)
+	}
+	if *banPath != "" {
+		_, e := readBanList(*banPath)
+		FatalError(e)
+	}
+	FatalError(loadAdminToken(*adminTokenPath))
 
 	// setup the kv service
 	context := &Context{
 		connections: make(map[string]*rpc.Client),
 		nodeList:    make(map[string]*MsNode),
 		clientNum:   0,
-		roomLimit:   6,
+		roomLimit:   defaultRoomLimit,
 		gameRoom:    make([]*Node, 0),
 		gameTimer:   time.NewTimer(SESSION_DELAY),
+		options: GameOptions{
+			WrapAround:    *wrapAround,
+			Teams:         *teams,
+			FriendlyFire:  *friendlyFire,
+			TrailLength:   *trailLength,
+			TrailLifetime: *trailLifetime,
+
+			SuddenDeathTick: *suddenDeath,
+			ShrinkInterval:  *shrinkInterval,
+			MaxTicks:        *maxTicks,
+		},
+		botConfig: BotConfig{Path: *botPath, Level: *botLevel, Host: *botHost},
+		bots:      make(map[string]bool),
+
+		cheatReports: make(map[string]int),
+		encryptPeers: *encryptPeers,
+
+		limits: Limits{MaxConns: *maxConns, JoinRate: *joinRate, MaxQueue: *maxQueue, BanPath: *banPath},
+		conns:  make(map[string]int),
+		joins:  make(map[string]*joinBucket),
+		bans:   &BanList{},
 	}
+	context.timerDeadline = time.Now().Add(SESSION_DELAY)
 
 	// get arguments
-	rpcAddr, e := net.ResolveTCPAddr("tcp", os.Args[1])
+	rpcAddr, e := net.ResolveTCPAddr("tcp", flag.Arg(0))
 	FatalError(e)
-	DebugPrint(1, "Starting MS server")
+	context.rpcAddr = rpcAddr.String()
 	initLogging(rpcAddr.String())
+	opsLog.Info("Starting MS server")
+	FatalError(setupTLS(*tlsCert, *tlsKey, *tlsCA))
+	if *metricsAddr != "" {
+		go metricsServe(*metricsAddr)
+	}
 
-	waitGroup.Add(2)
+	waitGroup.Add(4)
 
 	go endSession(context) // Timer
 	go listenToClient(context, rpcAddr.String())
+	go lobbyUpdates(context)
+	go watchBans(context)
 
 	// Wait until processes are done.
 	waitGroup.Wait()
@@ -0,0 +1,428 @@
+package main
+
+// These tests run the server against nodes in memory: the server dials them
+// over a network the test can cut nodes off from, and they answer its RPCs by
+// recording them. Joins are called on the context directly, since net/rpc
+// serves a single context per process
+
+import (
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	discard := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	lobbyLog, rpcLog, botLog, abuseLog = discard, discard, discard, discard
+	cheatLog, tlsLog, opsLog = discard, discard, discard
+	tracer = noopTracer{}
+	os.Exit(m.Run())
+}
+
+// a network in memory, where every connection is a net.Pipe
+type memNetwork struct {
+	lock      sync.Mutex
+	listeners map[string]*memListener
+	down      map[string]bool       // addresses cut off from the network
+	conns     map[string][]net.Conn // address to both ends of its connections
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{listeners: make(map[string]*memListener), down: make(map[string]bool),
+		conns: make(map[string][]net.Conn)}
+}
+
+func (n *memNetwork) Listen(addr string) (net.Listener, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.listeners[addr]; ok {
+		return nil, errors.New("address already in use: " + addr)
+	}
+	listener := &memListener{net: n, addr: memAddr(addr), accepts: make(chan net.Conn, 16),
+		closed: make(chan struct{})}
+	n.listeners[addr] = listener
+	return listener, nil
+}
+
+func (n *memNetwork) Dial(addr string) (net.Conn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	listener, ok := n.listeners[addr]
+	if !ok || n.down[addr] {
+		return nil, errors.New("connection refused: " + addr)
+	}
+	client, server := net.Pipe()
+	select {
+	case listener.accepts <- server:
+	default:
+		return nil, errors.New("connection refused, too many pending: " + addr)
+	}
+	n.conns[addr] = append(n.conns[addr], client, server)
+	return client, nil
+}
+
+// cut the host at addr off, closing its connections
+func (n *memNetwork) partition(addr string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.down[addr] = true
+	for _, conn := range n.conns[addr] {
+		conn.Close()
+	}
+	delete(n.conns, addr)
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	net       *memNetwork
+	addr      memAddr
+	accepts   chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.accepts:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.net.lock.Lock()
+		delete(l.net.listeners, string(l.addr))
+		l.net.lock.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// a node, as far as the server can tell: it serves the NodeService RPCs and
+// records the games it is started in
+type fakeNode struct {
+	rpcAddr string
+	ip      string
+	games   chan *GameArgs
+}
+
+func (n *fakeNode) StartGame(args *GameArgs, reply *ValReply) error {
+	n.games <- args
+	return nil
+}
+
+func (n *fakeNode) Message(args *GameArgs, reply *ValReply) error {
+	return nil
+}
+
+func (n *fakeNode) LobbyUpdate(args *LobbyStatus, reply *ValReply) error {
+	return nil
+}
+
+// a server with no one waiting, on a network of its own
+type testServer struct {
+	t   *testing.T
+	ctx *Context
+	net *memNetwork
+}
+
+func newTestServer(t *testing.T, roomLimit int, maxQueue int) *testServer {
+	s := &testServer{t: t, net: newMemNetwork()}
+	network = s.net
+	s.ctx = &Context{
+		connections:  make(map[string]*rpc.Client),
+		nodeList:     make(map[string]*MsNode),
+		roomLimit:    roomLimit,
+		gameRoom:     make([]*Node, 0),
+		gameTimer:    time.NewTimer(SESSION_DELAY),
+		rpcAddr:      "127.0.0.1:4421",
+		bots:         make(map[string]bool),
+		cheatReports: make(map[string]int),
+		limits:       Limits{MaxQueue: maxQueue},
+		conns:        make(map[string]int),
+		joins:        make(map[string]*joinBucket),
+		bans:         &BanList{},
+	}
+	t.Cleanup(func() { s.ctx.gameTimer.Stop() })
+	return s
+}
+
+// start a node listening on the server's network
+func (s *testServer) node(n int) *fakeNode {
+	node := &fakeNode{rpcAddr: "127.0.0.1:" + string('0'+byte(n)) + "000",
+		ip: "127.0.0.1:" + string('0'+byte(n)) + "001", games: make(chan *GameArgs, 1)}
+	listener, e := s.net.Listen(node.rpcAddr)
+	if e != nil {
+		s.t.Fatal(e)
+	}
+	server := rpc.NewServer()
+	if e := server.RegisterName("NodeService", node); e != nil {
+		s.t.Fatal(e)
+	}
+	go server.Accept(listener)
+	s.t.Cleanup(func() { listener.Close() })
+	return node
+}
+
+func (s *testServer) join(node *fakeNode) error {
+	return s.ctx.Join(&NodeJoin{RpcIp: node.rpcAddr, Ip: node.ip,
+		Profile: Profile{PlayerId: "player-" + node.rpcAddr}}, &ValReply{})
+}
+
+// the game a node is started in, nil if it isn't within a second
+func waitForGame(node *fakeNode) *GameArgs {
+	select {
+	case args := <-node.games:
+		return args
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func nodeIps(nodes []*Node) string {
+	ips := make([]string, len(nodes))
+	for i, node := range nodes {
+		ips[i] = node.Id + "=" + node.Ip
+	}
+	return strings.Join(ips, ",")
+}
+
+func TestRoomStartsWhenFull(t *testing.T) {
+	s := newTestServer(t, 3, 6)
+	nodes := []*fakeNode{s.node(1), s.node(2), s.node(3)}
+	for _, node := range nodes {
+		if e := s.join(node); e != nil {
+			t.Fatal(e)
+		}
+	}
+
+	want := "p1=127.0.0.1:1001,p2=127.0.0.1:2001,p3=127.0.0.1:3001"
+	var first *GameArgs
+	for _, node := range nodes {
+		args := waitForGame(node)
+		if args == nil {
+			t.Fatalf("%s wasn't started", node.rpcAddr)
+		}
+		if got := nodeIps(args.NodeList); got != want {
+			t.Errorf("%s was started with %s, want %s", node.rpcAddr, got, want)
+		}
+		if len(args.SessionKey) != SESSION_KEY_SIZE {
+			t.Errorf("%s was started with a %d byte key", node.rpcAddr, len(args.SessionKey))
+		}
+		if first == nil {
+			first = args
+		} else if string(args.SessionKey) != string(first.SessionKey) || args.RoomId != first.RoomId {
+			t.Errorf("%s was started in room %d, %s in room %d with another key",
+				nodes[0].rpcAddr, first.RoomId, node.rpcAddr, args.RoomId)
+		}
+	}
+}
+
+// a node the server can't reach by the time someone else joins is dropped
+// from the room, and the game starts without it
+func TestUnreachableNodeLeavesRoom(t *testing.T) {
+	s := newTestServer(t, 3, 6)
+	gone, nodes := s.node(1), []*fakeNode{s.node(2), s.node(3), s.node(4)}
+	if e := s.join(gone); e != nil {
+		t.Fatal(e)
+	}
+	if e := s.join(nodes[0]); e != nil {
+		t.Fatal(e)
+	}
+
+	s.net.partition(gone.rpcAddr)
+	if e := s.join(nodes[1]); e != nil {
+		t.Fatal(e)
+	}
+	s.ctx.NodeLock.RLock()
+	if _, ok := s.ctx.nodeList[gone.rpcAddr]; ok || len(s.ctx.nodeList) != 2 {
+		t.Errorf("%d nodes waiting once %s was cut off, want 2 without it", len(s.ctx.nodeList), gone.rpcAddr)
+	}
+	s.ctx.NodeLock.RUnlock()
+
+	if e := s.join(nodes[2]); e != nil {
+		t.Fatal(e)
+	}
+	want := "p1=127.0.0.1:2001,p2=127.0.0.1:3001,p3=127.0.0.1:4001"
+	for _, node := range nodes {
+		args := waitForGame(node)
+		if args == nil {
+			t.Fatalf("%s wasn't started", node.rpcAddr)
+		}
+		if got := nodeIps(args.NodeList); got != want {
+			t.Errorf("%s was started with %s, want %s", node.rpcAddr, got, want)
+		}
+	}
+	select {
+	case <-gone.games:
+		t.Errorf("%s was started once cut off", gone.rpcAddr)
+	default:
+	}
+}
+
+// a node joining right as a room starts waits for the next game instead of
+// being dropped or started with the room
+func TestJoinWhileRoomStarts(t *testing.T) {
+	s := newTestServer(t, 2, 6)
+	nodes, next := []*fakeNode{s.node(1), s.node(2)}, s.node(3)
+	for _, node := range nodes {
+		if e := s.join(node); e != nil {
+			t.Fatal(e)
+		}
+	}
+	if e := s.join(next); e != nil {
+		t.Fatal(e)
+	}
+
+	want := "p1=127.0.0.1:1001,p2=127.0.0.1:2001"
+	for _, node := range nodes {
+		args := waitForGame(node)
+		if args == nil {
+			t.Fatalf("%s wasn't started", node.rpcAddr)
+		}
+		if got := nodeIps(args.NodeList); got != want {
+			t.Errorf("%s was started with %s, want %s", node.rpcAddr, got, want)
+		}
+	}
+	s.ctx.NodeLock.RLock()
+	if _, ok := s.ctx.nodeList[next.rpcAddr]; !ok || len(s.ctx.nodeList) != 1 {
+		t.Errorf("%d nodes waiting after the game started, want only %s", len(s.ctx.nodeList), next.rpcAddr)
+	}
+	s.ctx.NodeLock.RUnlock()
+}
+
+func TestQueueFull(t *testing.T) {
+	s := newTestServer(t, 6, 2)
+	for n := 1; n <= 2; n++ {
+		if e := s.join(s.node(n)); e != nil {
+			t.Fatal(e)
+		}
+	}
+	e := s.join(s.node(3))
+	if e == nil || !strings.Contains(e.Error(), "queue is full") {
+		t.Errorf("third join returned %v, want the queue to be full", e)
+	}
+}
+
+// the log level can only be changed with the admin token, so that a page
+// open in the operator's browser can't change it
+func TestLogLevelNeedsToken(t *testing.T) {
+	adminToken = []byte("secret")
+	defer func() { adminToken = nil; logLevel.Set(slog.LevelInfo) }()
+	handler := requireAdmin(serveLogLevel)
+
+	for _, token := range []string{"", "wrong", "secret"} {
+		logLevel.Set(slog.LevelInfo)
+		r := httptest.NewRequest(http.MethodPost, LOG_LEVEL_PATH, strings.NewReader("level=debug"))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		allowed := token == "secret"
+		if got := w.Code == http.StatusOK; got != allowed {
+			t.Errorf("with token %q, got status %d", token, w.Code)
+		}
+		if changed := logLevel.Level() == slog.LevelDebug; changed != allowed {
+			t.Errorf("with token %q, the level is %v", token, logLevel.Level())
+		}
+	}
+}
+
+func TestValidateProfile(t *testing.T) {
+	for _, test := range []struct {
+		profile Profile
+		valid   bool
+	}{
+		{Profile{PlayerId: "a1", Name: "Flynn", Colour: "#00ffcc"}, true},
+		{Profile{PlayerId: "a1"}, true},
+		{Profile{Name: "Flynn"}, false},
+		{Profile{PlayerId: "a1", Name: strings.Repeat("x", MAX_NAME_LENGTH)}, true},
+		{Profile{PlayerId: "a1", Name: strings.Repeat("x", MAX_NAME_LENGTH+1)}, false},
+		// 16 characters, but 32 bytes
+		{Profile{PlayerId: "a1", Name: strings.Repeat("é", MAX_NAME_LENGTH)}, true},
+		{Profile{PlayerId: "a1", Name: "Fly\nnn"}, false},
+		{Profile{PlayerId: "a1", Colour: "teal"}, false},
+	} {
+		if e := validateProfile(&test.profile); (e == nil) != test.valid {
+			t.Errorf("validating %+v returned %v", test.profile, e)
+		}
+	}
+}
+
+// players without a name are given one nobody else in the room has
+func TestNamelessPlayersGetFreeNames(t *testing.T) {
+	s := newTestServer(t, 3, 6)
+	s.ctx.gameRoom = []*Node{{Id: "p1"}, {Id: "p2", Profile: Profile{Name: "P1"}},
+		{Id: "p3", Profile: Profile{Name: "player p1"}}}
+	s.ctx.settleProfiles()
+	if got := s.ctx.gameRoom[0].Profile.Name; got != "Player p1 2" {
+		t.Errorf("p1 was named %q, want %q", got, "Player p1 2")
+	}
+}
+
+// only the leader of a game can report one of its players, from its own ip,
+// and the next player leads once the leader's node stops answering
+func TestReportCheaterNeedsLeader(t *testing.T) {
+	s := newTestServer(t, 3, 6)
+	nodes := []*fakeNode{s.node(1), s.node(2), s.node(3)}
+	for _, node := range nodes {
+		if e := s.join(node); e != nil {
+			t.Fatal(e)
+		}
+	}
+	for _, node := range nodes {
+		if waitForGame(node) == nil {
+			t.Fatalf("%s wasn't started", node.rpcAddr)
+		}
+	}
+	for started := false; !started; time.Sleep(time.Millisecond) {
+		s.ctx.roomLock.Lock()
+		started = len(s.ctx.rooms) == 1
+		s.ctx.roomLock.Unlock()
+	}
+
+	report := func(reporter *fakeNode, sender string) string {
+		reply := &ValReply{}
+		e := s.ctx.ReportCheater(&CheatReport{Reporter: reporter.ip, Accused: nodes[2].ip,
+			Violations: 3, sender: sender}, reply)
+		if e != nil {
+			t.Fatal(e)
+		}
+		return reply.Val
+	}
+	if got := report(nodes[1], "127.0.0.1"); got != "rejected" {
+		t.Errorf("a follower's report was %s", got)
+	}
+	if got := report(nodes[0], "10.0.0.1"); got != "rejected" {
+		t.Errorf("a report claiming the leader's ip was %s", got)
+	}
+	if got := report(nodes[0], "127.0.0.1"); got != "reported" {
+		t.Errorf("the leader's report was %s", got)
+	}
+	s.net.partition(nodes[0].rpcAddr)
+	if got := report(nodes[1], "127.0.0.1"); got != "reported" {
+		t.Errorf("the new leader's report was %s", got)
+	}
+}
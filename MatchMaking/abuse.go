@@ -0,0 +1,316 @@
+package main
+
+// This file protects the server from clients that ask too much of it. Every
+// ip may only keep a few connections open and join the queue a few times a
+// minute, since every join dials all the waiting nodes. The queue itself is
+// capped, and players can be banned by ip or by player id in a ban list file,
+// which is read again whenever it changes. Clients on the server's own
+// machine aren't limited, since that is where bots and local tests connect
+// from, but they can be banned like anyone else.
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"strings"
+	"time"
+)
+
+// How often the ban list file is checked for changes
+const BAN_RELOAD_RATE time.Duration = 5 * time.Second
+
+// Limits on what one client can ask of the server
+type Limits struct {
+	MaxConns int    // open connections per ip, 0 for no limit
+	JoinRate int    // joins per minute per ip, 0 for no limit
+	MaxQueue int    // players waiting for a game
+	BanPath  string // ban list file, empty for no bans
+}
+
+// Players who may not connect or join. Read from a file with one ban per
+// line: "ip 1.2.3.4" or "player <player id>", # starting a comment
+type BanList struct {
+	Ips     map[string]bool
+	Players map[string]bool
+	modTime time.Time // of the file, when it was read
+}
+
+// Joins an ip has left: it gets JoinRate a minute, and can save up to JoinRate
+type joinBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Host part of an address, or the address if it has no port
+func hostOf(addr string) string {
+	if host, _, e := net.SplitHostPort(addr); e == nil {
+		return host
+	}
+	return addr
+}
+
+// Check if an ip is the server's own: loopback, or the ip it listens on
+func (this *Context) isLocal(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return (parsed != nil && parsed.IsLoopback()) || ip == hostOf(this.rpcAddr)
+}
+
+// Check if an ip or player id is banned
+func (this *Context) isBanned(ip string, playerId string) bool {
+	this.guardLock.Lock()
+	defer this.guardLock.Unlock()
+	return this.bans.Ips[ip] || (playerId != "" && this.bans.Players[playerId])
+}
+
+// Count a new connection from ip, or refuse it if the ip is banned or
+// already has too many open
+func (this *Context) acceptConn(ip string) error {
+	if this.isBanned(ip, "") {
+		return errors.New("banned")
+	}
+	this.guardLock.Lock()
+	defer this.guardLock.Unlock()
+	if this.limits.MaxConns > 0 && !this.isLocal(ip) && this.conns[ip] >= this.limits.MaxConns {
+		return fmt.Errorf("already %d connections open", this.conns[ip])
+	}
+	this.conns[ip]++
+	return nil
+}
+
+func (this *Context) releaseConn(ip string) {
+	this.guardLock.Lock()
+	defer this.guardLock.Unlock()
+	this.conns[ip]--
+	if this.conns[ip] <= 0 {
+		delete(this.conns, ip)
+	}
+}
+
+// Take one of the ip's joins, or return why it can't join now
+func (this *Context) allowJoin(ip string) error {
+	if this.isBanned(ip, "") {
+		joins.inc("rejected")
+		return errors.New("you are banned from this server")
+	}
+	if this.limits.JoinRate <= 0 || this.isLocal(ip) {
+		return nil
+	}
+
+	this.guardLock.Lock()
+	defer this.guardLock.Unlock()
+	rate := float64(this.limits.JoinRate) / float64(time.Minute)
+	bucket, ok := this.joins[ip]
+	if !ok {
+		bucket = &joinBucket{tokens: float64(this.limits.JoinRate), last: time.Now()}
+		this.joins[ip] = bucket
+	}
+	now := time.Now()
+	bucket.tokens += rate * float64(now.Sub(bucket.last))
+	if bucket.tokens > float64(this.limits.JoinRate) {
+		bucket.tokens = float64(this.limits.JoinRate)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		joins.inc("throttled")
+		wait := time.Duration((1 - bucket.tokens) / rate)
+		return fmt.Errorf("too many joins, try again in %v", wait.Round(time.Second))
+	}
+	bucket.tokens--
+	return nil
+}
+
+// Serve a client's connection, unless its ip is banned or has too many open
+func serveClient(ctx *Context, conn net.Conn) {
+	ip := hostOf(conn.RemoteAddr().String())
+	if e := ctx.acceptConn(ip); e != nil {
+		abuseLog.Warn("Refused connection", "ip", ip, "err", e)
+		refusedConns.inc("")
+		conn.Close()
+		return
+	}
+	defer ctx.releaseConn(ip)
+
+	buf := bufio.NewWriter(conn)
+	rpc.ServeCodec(&guardedCodec{ctx: ctx, ip: ip, rwc: conn,
+		dec: gob.NewDecoder(conn), enc: gob.NewEncoder(buf), encBuf: buf})
+}
+
+// The gob codec of net/rpc, which also knows the client's ip. A join over
+// the limit is answered with an error instead of reaching Join, so it
+// doesn't dial every waiting node. Cheat reports are stamped with the ip they
+// came from
+type guardedCodec struct {
+	ctx    *Context
+	ip     string
+	method string // of the request being read
+
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+}
+
+func (c *guardedCodec) ReadRequestHeader(r *rpc.Request) error {
+	e := c.dec.Decode(r)
+	c.method = r.ServiceMethod
+	return e
+}
+
+func (c *guardedCodec) ReadRequestBody(body interface{}) error {
+	if e := c.dec.Decode(body); e != nil {
+		return e
+	}
+	if body != nil && c.method == "Context.Join" {
+		if e := c.ctx.allowJoin(c.ip); e != nil {
+			abuseLog.Warn("Refused join", "ip", c.ip, "err", e)
+			return e
+		}
+	}
+	if report, ok := body.(*CheatReport); ok {
+		report.sender = c.ip
+	}
+	return nil
+}
+
+func (c *guardedCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if e := c.enc.Encode(r); e != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return e
+	}
+	if e := c.enc.Encode(body); e != nil {
+		if c.encBuf.Flush() == nil {
+			c.Close()
+		}
+		return e
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *guardedCodec) Close() error {
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// Read a ban list file
+func readBanList(path string) (*BanList, error) {
+	file, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer file.Close()
+
+	bans := &BanList{Ips: make(map[string]bool), Players: make(map[string]bool)}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected \"ip <ip>\" or \"player <id>\"", path, line)
+		}
+		switch fields[0] {
+		case "ip":
+			ip := net.ParseIP(fields[1])
+			if ip == nil {
+				return nil, fmt.Errorf("%s:%d: %q isn't an ip", path, line, fields[1])
+			}
+			bans.Ips[ip.String()] = true
+		case "player":
+			bans.Players[fields[1]] = true
+		default:
+			return nil, fmt.Errorf("%s:%d: unknown ban %q", path, line, fields[0])
+		}
+	}
+	return bans, scanner.Err()
+}
+
+// Read the ban list again if the file changed since it was last read. A
+// malformed file is logged and the previous bans are kept
+func (this *Context) reloadBans() bool {
+	info, e := os.Stat(this.limits.BanPath)
+	if e != nil {
+		abuseLog.Error("Can't read ban list", "path", this.limits.BanPath, "err", e)
+		return false
+	}
+	this.guardLock.Lock()
+	changed := !info.ModTime().Equal(this.bans.modTime)
+	this.guardLock.Unlock()
+	if !changed {
+		return false
+	}
+
+	bans, e := readBanList(this.limits.BanPath)
+	if e != nil {
+		abuseLog.Error("Keeping the previous bans", "path", this.limits.BanPath, "err", e)
+		return false
+	}
+	bans.modTime = info.ModTime()
+	this.guardLock.Lock()
+	this.bans = bans
+	this.guardLock.Unlock()
+	abuseLog.Info("Ban list loaded", "ips", len(bans.Ips), "players", len(bans.Players))
+	return true
+}
+
+// Remove banned players from the waiting room
+func (this *Context) kickBanned() {
+	this.NodeLock.Lock()
+	kicked := 0
+	for rpcIp, msn := range this.nodeList {
+		if !this.isBanned(hostOf(rpcIp), msn.Node.Profile.PlayerId) &&
+			!this.isBanned(hostOf(msn.Node.Ip), "") {
+			continue
+		}
+		abuseLog.Info("Removing banned player", "name", msn.Node.Profile.Name, "node", rpcIp)
+		if conn, ok := this.connections[rpcIp]; ok {
+			conn.Close()
+			delete(this.connections, rpcIp)
+		}
+		delete(this.nodeList, rpcIp)
+		kicked++
+	}
+	this.NodeLock.Unlock()
+
+	if kicked > 0 {
+		go this.pushLobby()
+	}
+}
+
+// Forget the join buckets that have filled up again, so they don't pile up
+func (this *Context) forgetJoins() {
+	this.guardLock.Lock()
+	defer this.guardLock.Unlock()
+	for ip, bucket := range this.joins {
+		if time.Since(bucket.last) > time.Minute {
+			delete(this.joins, ip)
+		}
+	}
+}
+
+// Keep the ban list up to date, and clean up the join buckets
+func watchBans(this *Context) {
+	defer waitGroup.Done()
+	for {
+		if this.limits.BanPath != "" && this.reloadBans() {
+			this.kickBanned()
+		}
+		this.forgetJoins()
+		time.Sleep(BAN_RELOAD_RATE)
+	}
+}
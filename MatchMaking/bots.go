@@ -0,0 +1,97 @@
+package main
+
+// This file lets the matchmaking server fill up rooms with bot players, by
+// launching Node-Client binaries in bot mode.
+
+import (
+	"net"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// Time given to freshly launched bots to join before the room starts
+const BOT_JOIN_DELAY time.Duration = 5 * time.Second
+
+// How bots are launched
+type BotConfig struct {
+	Path  string // Node-Client binary, empty to never launch bots
+	Level string // easy, medium or hard
+	Host  string // ip the bots listen on
+}
+
+// Check if the waiting room should be filled up with bots. Only rooms with a
+// human player waiting get bots, and only once per session.
+func (this *Context) needsBots() bool {
+	humans := len(this.nodeList) - this.countBots()
+	return this.botConfig.Path != "" && !this.botsLaunched && humans > 0 &&
+		len(this.nodeList) < this.roomLimit
+}
+
+// Count the bots waiting in the room
+func (this *Context) countBots() int {
+	count := 0
+	for rpcIp, _ := range this.nodeList {
+		if this.bots[rpcIp] {
+			count++
+		}
+	}
+	return count
+}
+
+// Launch enough bots to fill up the room. They join like any other player.
+func (this *Context) launchBots() {
+	this.NodeLock.Lock()
+	defer this.NodeLock.Unlock()
+
+	this.botsLaunched = true
+	missing := this.roomLimit - len(this.nodeList)
+	botLog.Info("Launching bots", "count", missing, "level", this.botConfig.Level)
+	for i := 0; i < missing; i++ {
+		addrs := make([]string, 3) // udp, rpc and http
+		for j := range addrs {
+			port, e := freePort()
+			if e != nil {
+				botLog.Error("Failed to find a port for a bot", "err", e)
+				return
+			}
+			addrs[j] = net.JoinHostPort(this.botConfig.Host, strconv.Itoa(port))
+		}
+
+		// Every bot launched gets its own name, since names are unique in a room
+		name := this.botConfig.Level + " bot " + strconv.Itoa(len(this.bots)+1)
+		args := append([]string{"-bot", this.botConfig.Level, "-name", name, "-trace", traceKind}, tlsArgs...)
+		cmd := exec.Command(this.botConfig.Path,
+			append(args, addrs[0], addrs[1], this.rpcAddr, addrs[2])...)
+		if e := cmd.Start(); e != nil {
+			botLog.Error("Failed to launch bot", "path", this.botConfig.Path, "err", e)
+			return
+		}
+		this.bots[addrs[1]] = true
+		botLog.Info("Launched bot", "name", name, "node", addrs[1], "pid", cmd.Process.Pid)
+
+		// Bots exit on their own once their game is over
+		go cmd.Wait()
+	}
+}
+
+// Find a local port nothing is listening on, over TCP or UDP, since a bot
+// listens on both
+func freePort() (int, error) {
+	var e error
+	for try := 0; try < 10; try++ {
+		var listener net.Listener
+		if listener, e = net.Listen("tcp", ":0"); e != nil {
+			return 0, e
+		}
+		port := listener.Addr().(*net.TCPAddr).Port
+		var udpConn *net.UDPConn
+		udpConn, e = net.ListenUDP("udp", &net.UDPAddr{Port: port})
+		listener.Close()
+		if e == nil {
+			udpConn.Close()
+			return port, nil
+		}
+	}
+	return 0, e
+}
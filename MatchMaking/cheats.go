@@ -0,0 +1,108 @@
+package main
+
+// This file keeps track of the players that cheat. A game's leader checks its
+// followers' moves, and reports those that keep making illegal ones. Reports
+// are counted by the player's stable id, so they follow the player across
+// games.
+
+import "net"
+
+// Sent by a game's leader about a follower that keeps cheating
+type CheatReport struct {
+	Reporter   string // ip of the leader
+	Accused    string // ip of the follower
+	Violations int    // illegal moves the follower made
+	Reason     string // the last illegal move
+	Log        []byte
+
+	sender string // ip the report really came from, set by the codec
+}
+
+// Find the player with the given ip in a room, or nil. Called with roomLock held
+func findPlayer(room *Room, ip string) *Node {
+	for _, player := range room.Players {
+		if player.Ip == ip {
+			return player
+		}
+	}
+	return nil
+}
+
+// Check if ip is the host of addr. Loopback ips are all the same host
+func isHostOf(ip string, addr string) bool {
+	host := hostOf(addr)
+	if host == ip {
+		return true
+	}
+	a, b := net.ParseIP(host), net.ParseIP(ip)
+	return a != nil && b != nil && (a.Equal(b) || (a.IsLoopback() && b.IsLoopback()))
+}
+
+// Check if the node serving the ms server at rpcIp still answers
+func isNodeUp(rpcIp string) bool {
+	client, e := dialRPC(rpcIp)
+	if e != nil {
+		return false
+	}
+	client.Close()
+	return true
+}
+
+// RPC called by a game's leader to report a cheating follower. Only the
+// leader of a live game can report one of its players, from the leader's own
+// ip. The server doesn't see leaders change, but a player only leads once
+// every node before it in the room failed, so the report is rejected while
+// one of them still answers
+func (this *Context) ReportCheater(report *CheatReport, reply *ValReply) error {
+	logReceive("CR: cheater reported: "+report.Accused, report.Log)
+	var accused *Node
+	var ahead []string // rpc ips of the players before the reporter
+	this.roomLock.Lock()
+	for _, room := range this.rooms {
+		if findPlayer(room, report.Reporter) == nil {
+			continue
+		}
+		accused = findPlayer(room, report.Accused)
+		if accused != nil {
+			for _, player := range room.Players {
+				if player.Ip == report.Reporter {
+					break
+				}
+				ahead = append(ahead, room.rpcIps[player.Id])
+			}
+			break
+		}
+	}
+	this.roomLock.Unlock()
+
+	reason := ""
+	switch {
+	case accused == nil || report.Accused == report.Reporter:
+		reason = "not players of the same game"
+	case !isHostOf(report.sender, report.Reporter):
+		reason = "not sent from the reporter's ip"
+	default:
+		for _, rpcIp := range ahead {
+			if isNodeUp(rpcIp) {
+				reason = "the reporter doesn't lead the game"
+				break
+			}
+		}
+	}
+	if reason != "" {
+		cheatLog.Warn("Rejected report", "reporter", report.Reporter, "accused", report.Accused,
+			"sender", report.sender, "reason", reason)
+		reply.Val = "rejected"
+		return nil
+	}
+
+	this.cheatLock.Lock()
+	this.cheatReports[accused.Profile.PlayerId]++
+	count := this.cheatReports[accused.Profile.PlayerId]
+	this.cheatLock.Unlock()
+
+	cheatLog.Warn("Cheater reported", "name", accused.Profile.Name, "player", accused.Profile.PlayerId,
+		"ip", accused.Ip, "violations", report.Violations, "reason", report.Reason, "games", count)
+	reply.Val = "reported"
+	return nil
+}
@@ -1,7 +1,10 @@
+//go:build ignore
+
 package main
 
 // This file was used for testing the Matchmaking server implementation. It may
-// or may not work with the current implementation.
+// or may not work with the current implementation. It is left out of the
+// build; run it with go run client.go
 
 import (
 	"fmt"
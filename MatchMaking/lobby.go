@@ -0,0 +1,155 @@
+package main
+
+// This file keeps the players waiting in the room informed: the matchmaking
+// server pushes the room's status to every waiting node, and nodes can mark
+// themselves ready or leave the queue. A room whose human players are all
+// ready starts without waiting for the timer.
+
+import (
+	"time"
+)
+
+// How often waiting nodes are sent the room's status, on top of every change
+const LOBBY_UPDATE_RATE time.Duration = 1 * time.Second
+const RPC_LOBBY_UPDATE string = "NodeService.LobbyUpdate"
+
+// Sent by a waiting node to change its place in the queue
+type LobbyArgs struct {
+	RpcIp string // the node, as it joined
+	Ready bool   // for SetReady
+	Log   []byte
+}
+
+// Status of the waiting room, pushed to every waiting node
+type LobbyStatus struct {
+	RoomId     int           // id the room will have once started
+	Waiting    int           // players in the room, bots included
+	Ready      int           // players ready to start, bots included
+	Capacity   int           // players at which the room starts straight away
+	MinPlayers int           // players needed for the room to start when the timer fires
+	StartsIn   time.Duration // until the timer fires
+	Log        []byte
+}
+
+// Reset the session timer, remembering when it will fire
+func (this *Context) resetTimer(d time.Duration) {
+	this.gameTimer.Reset(d)
+	this.timerLock.Lock()
+	this.timerDeadline = time.Now().Add(d)
+	this.timerLock.Unlock()
+}
+
+// Number of players the room needs to start when the timer fires
+func (this *Context) minPlayers() int {
+	if this.options.Teams > 0 {
+		return 2 * this.options.Teams
+	}
+	return leastPlayers
+}
+
+// Check if every human player waiting is ready
+func (this *Context) allHumansReady() bool {
+	for rpcIp, msn := range this.nodeList {
+		if !this.bots[rpcIp] && !msn.Ready {
+			return false
+		}
+	}
+	return true
+}
+
+// Status of the waiting room. Called with NodeLock held
+func (this *Context) lobbyStatus() *LobbyStatus {
+	status := &LobbyStatus{
+		Waiting:    len(this.nodeList),
+		Capacity:   this.roomLimit,
+		MinPlayers: this.minPlayers(),
+	}
+	for rpcIp, msn := range this.nodeList {
+		if msn.Ready || this.bots[rpcIp] {
+			status.Ready++
+		}
+	}
+
+	this.roomLock.Lock()
+	status.RoomId = this.nextRoomId + 1
+	this.roomLock.Unlock()
+
+	this.timerLock.Lock()
+	status.StartsIn = this.timerDeadline.Sub(time.Now())
+	this.timerLock.Unlock()
+	if status.StartsIn < 0 {
+		status.StartsIn = 0
+	}
+	return status
+}
+
+// Send the room's status to every waiting node, without waiting for replies
+func (this *Context) pushLobby() {
+	this.NodeLock.RLock()
+	defer this.NodeLock.RUnlock()
+
+	status := this.lobbyStatus()
+	queueLength.set("", float64(len(this.nodeList)))
+	for rpcIp, _ := range this.nodeList {
+		conn, ok := this.connections[rpcIp]
+		if !ok || this.bots[rpcIp] {
+			continue
+		}
+		args := *status
+		args.Log = logSend("Rpc Call " + RPC_LOBBY_UPDATE + " to " + rpcIp)
+		conn.Go(RPC_LOBBY_UPDATE, &args, &ValReply{}, nil)
+	}
+}
+
+// Keep sending the room's status, so countdowns stay in sync
+func lobbyUpdates(this *Context) {
+	defer waitGroup.Done()
+	for {
+		time.Sleep(LOBBY_UPDATE_RATE)
+		this.pushLobby()
+	}
+}
+
+// RPC called by a waiting node to say whether it is ready to start
+func (this *Context) SetReady(args *LobbyArgs, reply *ValReply) error {
+	logReceive("SR: node ready: "+args.RpcIp, args.Log)
+	this.NodeLock.Lock()
+	msn, ok := this.nodeList[args.RpcIp]
+	if !ok {
+		this.NodeLock.Unlock()
+		reply.Val = "not waiting"
+		return nil
+	}
+	msn.Ready = args.Ready
+	lobbyLog.Info("Ready", "node", args.RpcIp, "ready", args.Ready)
+
+	// Everybody is ready, no need to wait for the timer
+	if this.allHumansReady() && this.canStartGame(len(this.nodeList)) {
+		lobbyLog.Info("Everybody is ready")
+		this.makeGameRoom()
+		this.assignID()
+		go this.startGame(this.takeGameRoom())
+		this.NodeLock.Unlock()
+		return nil
+	}
+	this.NodeLock.Unlock()
+
+	go this.pushLobby()
+	return nil
+}
+
+// RPC called by a waiting node leaving the queue
+func (this *Context) Leave(args *LobbyArgs, reply *ValReply) error {
+	logReceive("LV: node leaving: "+args.RpcIp, args.Log)
+	this.NodeLock.Lock()
+	if conn, ok := this.connections[args.RpcIp]; ok {
+		conn.Close()
+		delete(this.connections, args.RpcIp)
+	}
+	delete(this.nodeList, args.RpcIp)
+	lobbyLog.Info("Left the queue", "node", args.RpcIp, "players", len(this.nodeList))
+	this.NodeLock.Unlock()
+
+	go this.pushLobby()
+	return nil
+}
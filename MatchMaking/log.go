@@ -1,44 +1,153 @@
 package main
 
-// This file provides utilities for logging.
+// This file provides utilities for logging. The tracer picked with -trace
+// timestamps the messages exchanged with the nodes (see trace.go). Everything
+// else goes through leveled, structured loggers, one per subsystem, which write
+// logfmt (or JSON with -logformat json) to stderr and to the -local.txt file.
+// Every record carries the server's address and subsystem. The local file is
+// rotated once it grows past -logmaxsize megabytes, and with -admintoken the
+// level can be changed while running at /loglevel on the -metrics address
 
 import (
-	"github.com/arcaneiceman/GoVector/govec"
-	"log"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
 	"strings"
-	"time"
+	"sync"
 )
 
-type Msg struct {
-	RealTimestamp string
-}
+const LOG_LEVEL_PATH string = "/loglevel"
+
+var logLevel = new(slog.LevelVar) // level of every logger, can be changed while running
+var logFormat string              // logfmt or json
+var logMaxSize int                // megabytes the local log grows to before it is rotated, 0 to never rotate
+var logBackups int                // rotated local logs to keep
 
-var Logger *govec.GoLog
-var fileLogger *log.Logger
+// loggers of each subsystem, set up by initLogging
+var (
+	lobbyLog *slog.Logger // the queue, rooms and starting games
+	rpcLog   *slog.Logger // connections to the nodes
+	botLog   *slog.Logger
+	abuseLog *slog.Logger // limits and bans
+	cheatLog *slog.Logger
+	tlsLog   *slog.Logger
+	opsLog   *slog.Logger // metrics and log levels
+)
 
 func initLogging(rpcAddr string) {
 	// Windows doesn't accept colons in paths, so we filter them out here.
 	logFileName := strings.Replace(rpcAddr, ":", "", -1)
-	Logger = govec.Initialize(rpcAddr, logFileName)
 
-	localLogFile, err := os.Create(logFileName + "-local.txt")
-	CheckError(err, 24)
-	fileLogger = log.New(localLogFile, "", 0)
+	localLogFile, err := openRotatingFile(logFileName+"-local.txt", int64(logMaxSize)<<20, logBackups)
+	FatalError(err)
+	out := io.MultiWriter(os.Stderr, localLogFile)
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(out, options)
+	if logFormat == "json" {
+		handler = slog.NewJSONHandler(out, options)
+	}
+
+	root := slog.New(handler).With("addr", rpcAddr)
+	lobbyLog = root.With("subsystem", "lobby")
+	rpcLog = root.With("subsystem", "rpc")
+	botLog = root.With("subsystem", "bots")
+	abuseLog = root.With("subsystem", "abuse")
+	cheatLog = root.With("subsystem", "cheats")
+	tlsLog = root.With("subsystem", "tls")
+	opsLog = root.With("subsystem", "ops")
+
+	tracer, err = newTracer(traceKind, rpcAddr, logFileName)
+	FatalError(err)
+}
+
+// Check the -loglevel, -logformat and -trace flags
+func checkLogFlags(level string) error {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	if logFormat != "logfmt" && logFormat != "json" {
+		return fmt.Errorf("unknown log format %q", logFormat)
+	}
+	if logMaxSize < 0 || logBackups < 0 {
+		return fmt.Errorf("log size and backups cannot be negative")
+	}
+	if !isTraceKind(traceKind) {
+		return fmt.Errorf("unknown tracer %q", traceKind)
+	}
+	return nil
 }
 
 func logSend(msg string) []byte {
-	outgoingMessage := Msg{time.Now().String()}
-	return Logger.PrepareSend(msg, outgoingMessage)
+	return tracer.Send(msg)
+}
+
+func logReceive(msg string, buf []byte) {
+	tracer.Receive(msg, buf)
+}
+
+// A log file that is rotated once it grows past maxSize: the previous file
+// is renamed to path.1, the one before to path.2, and so on up to backups
+type rotatingFile struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, backups: backups, file: file}, nil
+}
+
+// Write a record, rotating the file first if the record would make it too big
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
 }
 
-func logReceive(msg string, buf []byte) *Msg {
-	incommingMessage := new(Msg)
-	Logger.UnpackReceive(msg, buf[:], &incommingMessage)
-	return incommingMessage
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	for i := f.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.backups > 0 {
+		os.Rename(f.path, f.path+".1")
+	}
+	file, err := os.Create(f.path)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = 0
+	return nil
 }
 
-func localLog(v ...interface{}) {
-	log.Println(v)
-	fileLogger.Println(v)
+// Show the log level, or change it with a POST or PUT of level=debug, info,
+// warn or error
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(r.FormValue("level"))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logLevel.Set(level)
+		opsLog.Info("Log level changed", "level", level)
+	}
+	fmt.Fprintln(w, logLevel.Level())
 }
@@ -0,0 +1,194 @@
+package main
+
+// This file exposes the server's metrics for Prometheus to scrape, in its
+// text format, at /metrics on the -metrics address. Only the few metric types
+// needed are implemented, like in the nodes, instead of pulling in the
+// Prometheus client library. Game durations and packet counts are only known
+// to the nodes, so they are exposed by the nodes
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const METRICS_PATH string = "/metrics"
+
+// A counter or a gauge, with a value for each value of its label, or a single
+// value when it has no label
+type metric struct {
+	name   string
+	help   string
+	kind   string // counter or gauge
+	label  string // name of the label, empty for none
+	lock   sync.Mutex
+	values map[string]float64 // label value to the metric's value
+}
+
+// Counts of observed values, in buckets
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64 // upper bounds, increasing
+	lock    sync.Mutex
+	counts  []uint64 // observations in each bucket, not cumulative
+	sum     float64
+	count   uint64
+}
+
+type exporter interface {
+	export(w io.Writer)
+}
+
+var registry []exporter // every metric, in the order they are exported
+
+var (
+	joins        = newMetric("gotron_ms_joins_total", "Joins, by result: accepted, rejected or throttled.", "counter", "result")
+	refusedConns = newMetric("gotron_ms_connections_refused_total", "Connections refused, banned or over the limit.", "counter", "")
+	queueLength  = newMetric("gotron_ms_queue_length", "Players waiting for a game, bots included.", "gauge", "")
+	gamesStarted = newMetric("gotron_ms_games_started_total", "Games started.", "counter", "")
+	timeToMatch  = newHistogram("gotron_ms_time_to_match_seconds", "Time players waited from joining to their game starting, bots excluded.",
+		[]float64{1, 5, 10, 20, 30, 45, 60, 120, 300})
+)
+
+func newMetric(name string, help string, kind string, label string) *metric {
+	m := &metric{name: name, help: help, kind: kind, label: label, values: make(map[string]float64)}
+	registry = append(registry, m)
+	return m
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	registry = append(registry, h)
+	return h
+}
+
+// Add to the value of a label, or of the metric when labelValue is empty
+func (m *metric) add(labelValue string, v float64) {
+	m.lock.Lock()
+	m.values[labelValue] += v
+	m.lock.Unlock()
+}
+
+func (m *metric) inc(labelValue string) {
+	m.add(labelValue, 1)
+}
+
+func (m *metric) set(labelValue string, v float64) {
+	m.lock.Lock()
+	m.values[labelValue] = v
+	m.lock.Unlock()
+}
+
+func (m *metric) export(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.label == "" {
+		fmt.Fprintf(w, "%s %v\n", m.name, m.values[""])
+		return
+	}
+	labelValues := make([]string, 0, len(m.values))
+	for labelValue := range m.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %v\n", m.name, m.label, labelValue, m.values[labelValue])
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) export(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %v\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+// Note how long the humans of a room waited for it to start
+func (this *Context) observeTimeToMatch() {
+	for rpcIp, msn := range this.nodeList {
+		if !this.bots[rpcIp] {
+			timeToMatch.observe(time.Since(msn.Joined).Seconds())
+		}
+	}
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range registry {
+		m.export(w)
+	}
+}
+
+var adminToken []byte // token /loglevel requests must carry, empty to not serve it
+
+// read the admin token from path, if any
+func loadAdminToken(path string) error {
+	if path == "" {
+		return nil
+	}
+	token, e := ioutil.ReadFile(path)
+	if e != nil {
+		return e
+	}
+	adminToken = []byte(strings.TrimSpace(string(token)))
+	if len(adminToken) == 0 {
+		return errors.New("the admin token in " + path + " is empty")
+	}
+	return nil
+}
+
+// only let requests with the admin token through
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), adminToken) != 1 {
+			opsLog.Warn("Refused admin request", "path", r.URL.Path, "from", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Serve the metrics, and the log level if there is an admin token, on their
+// own address
+func metricsServe(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(METRICS_PATH, serveMetrics)
+	if len(adminToken) != 0 {
+		mux.HandleFunc(LOG_LEVEL_PATH, requireAdmin(serveLogLevel))
+	}
+	opsLog.Info("Serving metrics", "addr", addr+METRICS_PATH)
+	if e := http.ListenAndServe(addr, mux); e != nil {
+		opsLog.Error("Metrics server error", "err", e)
+	}
+}
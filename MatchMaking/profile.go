@@ -0,0 +1,97 @@
+package main
+
+// This file checks the profiles players join with. A profile is chosen by the
+// player and kept across games: a stable id, a display name and a preferred
+// colour. Two players waiting in the same room can't share an id or a name.
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const MAX_NAME_LENGTH int = 16
+
+// Player chosen identity, sent at join and carried in Node to every peer
+type Profile struct {
+	PlayerId string // stable id of the player, the same across games
+	Name     string // display name, the slot id when empty
+	Colour   string // preferred colour, "#rrggbb", or empty for the slot colour
+}
+
+var colourPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Check a profile is well formed, the same way the nodes do. Names are limited
+// in characters, not bytes
+func validateProfile(p *Profile) error {
+	if p.PlayerId == "" {
+		return errors.New("profile has no player id")
+	}
+	if utf8.RuneCountInString(p.Name) > MAX_NAME_LENGTH {
+		return errors.New("name is longer than 16 characters")
+	}
+	for _, r := range p.Name {
+		if r < ' ' || r == 0x7f {
+			return errors.New("name has control characters")
+		}
+	}
+	if p.Colour != "" && !colourPattern.MatchString(p.Colour) {
+		return errors.New("colour is not #rrggbb")
+	}
+	return nil
+}
+
+// Check no other node waiting in the room uses the profile's id or name.
+// Called with NodeLock held
+func (this *Context) checkProfileUnique(rpcIp string, p *Profile) error {
+	for otherRpcIp, msn := range this.nodeList {
+		if otherRpcIp == rpcIp {
+			continue
+		}
+		other := msn.Node.Profile
+		if other.PlayerId == p.PlayerId {
+			return errors.New("player " + p.PlayerId + " is already waiting")
+		}
+		if p.Name != "" && strings.EqualFold(other.Name, p.Name) {
+			return errors.New("name " + p.Name + " is already taken")
+		}
+	}
+	return nil
+}
+
+// Give players without a name their slot id, and drop colours already picked
+// by a player who joined earlier. Called by assignID, in join order
+func (this *Context) settleProfiles() {
+	names := make(map[string]bool)
+	colours := make(map[string]bool)
+	for _, client := range this.gameRoom {
+		names[strings.ToLower(client.Profile.Name)] = true
+	}
+	for _, client := range this.gameRoom {
+		if client.Profile.Name == "" {
+			client.Profile.Name = freeName(names, client.Id)
+			names[strings.ToLower(client.Profile.Name)] = true
+		}
+		colour := strings.ToLower(client.Profile.Colour)
+		if colour != "" && colours[colour] {
+			lobbyLog.Info("Dropping colour, already taken", "name", client.Profile.Name, "colour", colour)
+			client.Profile.Colour = ""
+		}
+		colours[colour] = true
+	}
+}
+
+// The first of the slot id, "Player pN", "Player pN 2"... that no player in
+// the room is called, ignoring case like checkProfileUnique
+func freeName(names map[string]bool, id string) string {
+	name := id
+	for n := 1; names[strings.ToLower(name)]; n++ {
+		name = "Player " + id
+		if n > 1 {
+			name += " " + strconv.Itoa(n)
+		}
+	}
+	return name
+}
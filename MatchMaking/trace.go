@@ -0,0 +1,180 @@
+package main
+
+// This file implements the tracers that timestamp the RPCs exchanged with the
+// nodes, picked with -trace. GoVector, the default, stamps every message with
+// a vector clock and writes the -Log.txt file that ShiViz reads. The span
+// tracer writes OpenTelemetry-style spans to a -spans.json file instead, and
+// none leaves messages unstamped. Bots are launched with the server's tracer,
+// but the nodes of players must be given the same one, since each tracer only
+// reads its own stamps
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/arcaneiceman/GoVector/govec"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TRACE_GOVEC string = "govec"
+	TRACE_SPANS string = "spans"
+	TRACE_NONE  string = "none"
+)
+
+// Timestamps the messages sent and received
+type Tracer interface {
+	// record a message about to be sent, and return the stamp that goes in
+	// its Log field, nil to leave it empty
+	Send(event string) []byte
+	// record a message received, with the stamp its sender put in it
+	Receive(event string, stamp []byte)
+}
+
+var traceKind string // one of the TRACE_ constants
+var tracer Tracer
+
+func isTraceKind(kind string) bool {
+	return kind == TRACE_GOVEC || kind == TRACE_SPANS || kind == TRACE_NONE
+}
+
+// Make the tracer picked with -trace, its files named after logFileName
+func newTracer(kind string, rpcAddr string, logFileName string) (Tracer, error) {
+	switch kind {
+	case TRACE_GOVEC:
+		return &govecTracer{log: govec.Initialize(rpcAddr, logFileName), clock: 1}, nil
+	case TRACE_SPANS:
+		return newSpanTracer(rpcAddr, logFileName+"-spans.json")
+	case TRACE_NONE:
+		return noopTracer{}, nil
+	}
+	return nil, fmt.Errorf("unknown tracer %q", kind)
+}
+
+// The payload GoVector stamps messages with
+type Msg struct {
+	RealTimestamp string
+}
+
+// GoVector doesn't log when events happen, so every event is also logged at
+// debug, with the clock of the server GoVector gave it, for tools/shiviz to
+// filter on. Each event ticks the clock once, after the tick of
+// Initialization Complete
+type govecTracer struct {
+	lock  sync.Mutex // keeps the clock in step with GoVector's
+	log   *govec.GoLog
+	clock int
+}
+
+func (t *govecTracer) Send(event string) []byte {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	outgoingMessage := Msg{time.Now().String()}
+	stamp := t.log.PrepareSend(event, outgoingMessage)
+	t.logged()
+	return stamp
+}
+
+func (t *govecTracer) Receive(event string, stamp []byte) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	// a message without a clock is only an event of the server
+	if len(stamp) == 0 {
+		t.log.LogLocalEvent(event)
+	} else {
+		incommingMessage := new(Msg)
+		t.log.UnpackReceive(event, stamp, &incommingMessage)
+	}
+	t.logged()
+}
+
+// note the time of the event GoVector just logged, called with lock held
+func (t *govecTracer) logged() {
+	t.clock++
+	rpcLog.Debug("Traced", "clock", t.clock)
+}
+
+// Leaves messages unstamped, for production
+type noopTracer struct{}
+
+func (noopTracer) Send(event string) []byte {
+	return nil
+}
+
+func (noopTracer) Receive(event string, stamp []byte) {}
+
+// A span, as OpenTelemetry exports them to JSON. Sending and receiving a
+// message take no time, so every span starts and ends at once
+type Span struct {
+	TraceId      string            `json:"traceId"`
+	SpanId       string            `json:"spanId"`
+	ParentSpanId string            `json:"parentSpanId,omitempty"` // the sender's span, for receives
+	Name         string            `json:"name"`
+	Kind         string            `json:"kind"` // PRODUCER for sends, CONSUMER for receives
+	StartTime    int64             `json:"startTimeUnixNano"`
+	EndTime      int64             `json:"endTimeUnixNano"`
+	Attributes   map[string]string `json:"attributes"`
+}
+
+// Writes a span for every message, one JSON object per line. Messages are
+// stamped with a W3C traceparent, so the receiver's span is a child of the
+// sender's. Every span of the server is in the same trace, unless it continues
+// a node's
+type spanTracer struct {
+	lock    sync.Mutex
+	service string // rpcAddr, the service.name of every span
+	traceId string
+	file    *os.File
+	encoder *json.Encoder
+}
+
+func newSpanTracer(service string, path string) (*spanTracer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &spanTracer{service: service, traceId: randomHex(16), file: file, encoder: json.NewEncoder(file)}, nil
+}
+
+func (t *spanTracer) Send(event string) []byte {
+	span := t.newSpan(event, "PRODUCER")
+	span.TraceId = t.traceId
+	t.export(span)
+	return []byte("00-" + span.TraceId + "-" + span.SpanId + "-01")
+}
+
+func (t *spanTracer) Receive(event string, stamp []byte) {
+	span := t.newSpan(event, "CONSUMER")
+	span.TraceId = t.traceId
+	parts := strings.Split(string(stamp), "-")
+	if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		span.TraceId = parts[1]
+		span.ParentSpanId = parts[2]
+	}
+	t.export(span)
+}
+
+func (t *spanTracer) newSpan(event string, kind string) *Span {
+	now := time.Now().UnixNano()
+	return &Span{SpanId: randomHex(8), Name: event, Kind: kind,
+		StartTime: now, EndTime: now, Attributes: map[string]string{"service.name": t.service}}
+}
+
+func (t *spanTracer) export(span *Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if err := t.encoder.Encode(span); err != nil {
+		opsLog.Error("Failed to export span", "err", err)
+	}
+}
+
+// Random bytes, hex encoded, for trace and span ids
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
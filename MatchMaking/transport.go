@@ -0,0 +1,106 @@
+package main
+
+// This file sets up the optional TLS transport for RPCs. With -tlscert,
+// -tlskey and -tlsca, the server only talks TLS: nodes must dial it with a
+// certificate signed by the CA, and it checks the certificate of every node
+// it dials back. Without them, RPCs are plaintext TCP as before. Either way,
+// connections go over the Network, which the tests replace.
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+)
+
+var tlsConfig *tls.Config // nil when RPCs are plaintext
+var tlsArgs []string      // flags passed on to the bots, so they speak TLS too
+
+// Load the certificate, its key and the CA that signs every certificate of
+// the deployment. All three are needed to turn TLS on, none to leave it off
+func setupTLS(certFile string, keyFile string, caFile string) error {
+	if certFile == "" && keyFile == "" && caFile == "" {
+		return nil
+	}
+	if certFile == "" || keyFile == "" || caFile == "" {
+		return errors.New("TLS needs -tlscert, -tlskey and -tlsca")
+	}
+
+	cert, e := tls.LoadX509KeyPair(certFile, keyFile)
+	if e != nil {
+		return e
+	}
+	caPem, e := ioutil.ReadFile(caFile)
+	if e != nil {
+		return e
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return errors.New("no certificate found in " + caFile)
+	}
+
+	tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	tlsArgs = []string{"-tlscert", certFile, "-tlskey", keyFile, "-tlsca", caFile}
+	tlsLog.Info("RPCs use TLS", "ca", caFile)
+	return nil
+}
+
+// Carries the RPCs between the server and the nodes. It is TCP, except in
+// the tests, which run the nodes in memory
+type Network interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+var network Network = tcpNetwork{}
+
+type tcpNetwork struct{}
+
+func (tcpNetwork) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpNetwork) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+// Listen for RPCs, over TLS when it is on
+func listenRPC(addr string) (net.Listener, error) {
+	listener, e := network.Listen(addr)
+	if e != nil || tlsConfig == nil {
+		return listener, e
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// Dial a node's RPC server, over TLS when it is on
+func dialRPC(addr string) (*rpc.Client, error) {
+	conn, e := network.Dial(addr)
+	if e != nil {
+		return nil, e
+	}
+	if tlsConfig != nil {
+		// check the node's certificate against its host, as tls.Dial would
+		config := tlsConfig.Clone()
+		config.ServerName, _, e = net.SplitHostPort(addr)
+		if e != nil {
+			conn.Close()
+			return nil, e
+		}
+		tlsConn := tls.Client(conn, config)
+		if e := tlsConn.Handshake(); e != nil {
+			conn.Close()
+			return nil, e
+		}
+		conn = tlsConn
+	}
+	return rpc.NewClient(conn), nil
+}
@@ -36,7 +36,24 @@ const PLAYER_CODE_TO_COLOUR = {
   "t6": "black",
 };
 
-const gSocket = io();
+// Board code of a wall cell, closed off during sudden death.
+const WALL_CODE = "ww";
+const WALL_COLOUR = "gray";
+
+// Maps team numbers to a colour. Used instead of the player colours when
+// playing in teams.
+const TEAM_TO_COLOUR = {
+  1: "red",
+  2: "blue",
+  3: "green",
+};
+
+// Version of the protocol spoken with the node, see protocol/SCHEMA.md.
+const PROTOCOL_VERSION = 1;
+
+const gSocket = new WebSocket("ws://" + window.location.host + "/ws");
+// Maps message types to their handler.
+const gHandlers = {};
 // We use a StaticCanvas since we don't want users to be able to be able to
 // perform interactions such as resizing objects.
 const gCanvas = new fabric.StaticCanvas("mainCanvas");
@@ -48,6 +65,55 @@ var gGameEnded = false;
 // Keep track of current direction so we don't send redundant emits.
 var curDirection = 0;
 
+// Maps player IDs such as "p1" to their team number. null when playing free
+// for all.
+var gTeams = null;
+
+// Maps player IDs to the display names the players picked.
+var gNames = {};
+
+// Maps player IDs to the colours the players picked, for players who picked
+// one. Ignored when playing in teams.
+var gColours = {};
+
+// Whether a replay is playing, as opposed to paused.
+var gReplayPlaying = false;
+
+// The board last drawn. The node only sends the cells that changed since.
+var gBoard = null;
+
+// Counts down to the lobby's timer, null when not waiting in a lobby.
+var gLobbyCountdown = null;
+
+/**
+ * Sends a message to the node.
+ *
+ * @param {String} type
+ *        A message type defined in protocol/SCHEMA.md.
+ * @param {Object} data
+ *        The message's data, if it has any.
+ */
+function send(type, data) {
+  gSocket.send(JSON.stringify({"version": PROTOCOL_VERSION, "type": type, "data": data}));
+}
+
+/**
+ * Passes a message from the node to its handler.
+ */
+function handleMessage(event) {
+  let msg = JSON.parse(event.data);
+  if (msg.version !== PROTOCOL_VERSION) {
+    throw new Error("Node speaks protocol version " + msg.version);
+  }
+
+  let handler = gHandlers[msg.type];
+  if (!handler) {
+    console.log("Ignoring message " + msg.type);
+    return;
+  }
+  handler(msg.data || {});
+}
+
 function handleKeyPress(event) {
   if (event.keyCode === curDirection) return;
 
@@ -55,22 +121,22 @@ function handleKeyPress(event) {
     case W:
       if (curDirection === S) break;
       curDirection = W;
-      gSocket.emit("playerMove", {"direction": Direction.UP});
+      send("playerMove", {"direction": Direction.UP});
       break;
     case A:
       if (curDirection === D) break;
       curDirection = A;
-      gSocket.emit("playerMove", {"direction": Direction.LEFT});
+      send("playerMove", {"direction": Direction.LEFT});
       break;
     case S:
       if (curDirection === W) break;
       curDirection = S;
-      gSocket.emit("playerMove", {"direction": Direction.DOWN});
+      send("playerMove", {"direction": Direction.DOWN});
       break;
     case D:
       if (curDirection === A) break;
       curDirection = D;
-      gSocket.emit("playerMove", {"direction": Direction.RIGHT});
+      send("playerMove", {"direction": Direction.RIGHT});
       break;
     default:
       return;
@@ -106,6 +172,65 @@ function objContainsProps(obj, expectedProps) {
   return true;
 }
 
+/**
+ * Returns the colour to draw the given player code with.
+ *
+ * @param {String} playerCode
+ *        A player code such as "p1", "t1" or "d1".
+ * @returns {String}
+ *          The colour of the player's team when playing in teams, or the
+ *          player's own colour otherwise.
+ */
+function getPlayerColour(playerCode) {
+  if (playerCode === WALL_CODE) {
+    return WALL_COLOUR;
+  }
+  let id = "p" + playerCode.charAt(1);
+  if (gTeams) {
+    return TEAM_TO_COLOUR[gTeams[id]];
+  }
+  return gColours[id] || PLAYER_CODE_TO_COLOUR[playerCode];
+}
+
+/**
+ * Remembers the name and colour of every player.
+ *
+ * @param {Array} players
+ *        Players as defined in protocol/SCHEMA.md.
+ */
+function setPlayers(players) {
+  gNames = {};
+  gColours = {};
+  for (let player of players || []) {
+    gNames[player.id] = player.name;
+    if (player.colour) {
+      gColours[player.id] = player.colour;
+    }
+  }
+}
+
+/**
+ * @param {String} text
+ *        Text picked by a player, such as their name.
+ * @returns {String}
+ *          The text, safe to put in HTML.
+ */
+function escapeHtml(text) {
+  let div = document.createElement("div");
+  div.textContent = text;
+  return div.innerHTML;
+}
+
+/**
+ * @param {String} id
+ *        A player ID such as "p1".
+ * @returns {String}
+ *          The player's display name, safe to put in HTML.
+ */
+function getPlayerName(id) {
+  return escapeHtml(gNames[id] || id);
+}
+
 function hideIntroScreen() {
   let introElem = document.getElementById("intro");
   if (!introElem) {
@@ -144,7 +269,7 @@ function handleGameStateUpdate(state) {
         continue;
       }
 
-      if (!(playerCode in PLAYER_CODE_TO_COLOUR)) {
+      if (!(playerCode in PLAYER_CODE_TO_COLOUR) && playerCode !== WALL_CODE) {
         throw new Error("State contains unknown player code: " + playerCode);
       }
 
@@ -153,7 +278,7 @@ function handleGameStateUpdate(state) {
         top: y * PLAYER_RECT_HEIGHT,
         width: PLAYER_RECT_WIDTH,
         height: PLAYER_RECT_HEIGHT,
-        fill: PLAYER_CODE_TO_COLOUR[playerCode],
+        fill: getPlayerColour(playerCode),
       };
       // If this is a trail, lower the opacity to make it visually obvious.
       if (playerCode.charAt(0) == "t") {
@@ -177,14 +302,129 @@ function handleGameStateUpdate(state) {
   }
 }
 
+/**
+ * Draws the whole board.
+ *
+ * @param {Object} msg
+ *        A "state" message as defined in protocol/SCHEMA.md.
+ */
+function onState(msg) {
+  gBoard = msg.board;
+  handleGameStateUpdate(gBoard);
+}
+
+/**
+ * Draws the board after applying the cells that changed.
+ *
+ * @param {Object} msg
+ *        A "stateDiff" message as defined in protocol/SCHEMA.md.
+ */
+function onStateDiff(msg) {
+  if (!gBoard) {
+    throw new Error("Received a stateDiff before the state");
+  }
+
+  for (let cell of msg.cells) {
+    gBoard[cell.y][cell.x] = cell.code;
+  }
+  handleGameStateUpdate(gBoard);
+}
+
+/**
+ * Shows the queue we wait in: who is waiting, when the room starts, and
+ * buttons to say we are ready or to leave the queue.
+ *
+ * @param {Object} msg
+ *        A "lobby" message as defined in protocol/SCHEMA.md.
+ */
+function onLobby(msg) {
+  let lobbyElem = document.getElementById("lobby");
+  let readyButton = document.getElementById("readyButton");
+  let queueButton = document.getElementById("queueButton");
+  let countdownElem = document.getElementById("lobbyCountdown");
+  lobbyElem.style.display = "block";
+  clearInterval(gLobbyCountdown);
+  gLobbyCountdown = null;
+
+  // Only the tab steering the player can change its place in the queue.
+  readyButton.disabled = !msg.isController || !msg.inQueue;
+  queueButton.disabled = !msg.isController;
+
+  if (!msg.inQueue) {
+    document.getElementById("introMsg").innerHTML = "You left the queue";
+    document.getElementById("lobbyStatus").innerHTML = "";
+    countdownElem.innerHTML = "";
+    readyButton.style.display = "none";
+    queueButton.innerHTML = "Join queue";
+    queueButton.onclick = () => send("joinQueue");
+    return;
+  }
+
+  document.getElementById("introMsg").innerHTML = msg.roomId ?
+      "Waiting in room " + msg.roomId : "Looking for players";
+  document.getElementById("lobbyStatus").innerHTML =
+      msg.waiting + " / " + msg.capacity + " players waiting, " + msg.ready + " ready";
+  readyButton.style.display = "inline";
+  readyButton.innerHTML = msg.isReady ? "Not ready" : "Ready";
+  readyButton.onclick = () => send("setReady", {"ready": !msg.isReady});
+  queueButton.innerHTML = "Leave queue";
+  queueButton.onclick = () => send("leaveQueue");
+
+  if (!msg.roomId) {
+    countdownElem.innerHTML = "";
+    return;
+  }
+  let deadline = Date.now() + msg.startsIn * 1000;
+  let showCountdown = () => {
+    let seconds = Math.max(0, Math.ceil((deadline - Date.now()) / 1000));
+    countdownElem.innerHTML = msg.waiting >= msg.minPlayers ?
+        "Starting in " + seconds + "s, or once everybody is ready" :
+        "Need " + (msg.minPlayers - msg.waiting) + " more players, checking again in " + seconds + "s";
+  };
+  showCountdown();
+  gLobbyCountdown = setInterval(showCountdown, 1000);
+}
+
 /**
  * Starts the game when we are paired with enough players.
+ *
+ * @param {Object} msg
+ *        A "startGame" message as defined in protocol/SCHEMA.md.
  */
-function startGame(id, addr, direction) {
-  curDirection = getDirectionCode(direction);
-  window.onkeydown = handleKeyPress;
+function startGame(msg) {
+  clearInterval(gLobbyCountdown);
+  gTeams = msg.teams || null;
+  setPlayers(msg.players);
+  // Other tabs of the same player only watch.
+  if (msg.isController) {
+    takeControl(msg);
+  }
   hideIntroScreen();
-  document.getElementById('stats').innerHTML = '<h3 style="color:' + PLAYER_CODE_TO_COLOUR[id]  + '">Player : ' + id + ' ' + addr  + '</h3>';
+  // Show the board edges as passable when the arena wraps around.
+  if (msg.wrapAround) {
+    document.getElementById("mainCanvas").classList.add("wrapAround");
+  }
+  let team = gTeams ? ' (Team ' + gTeams[msg.id] + ')' : '';
+  let watching = msg.isController ? '' : ' <small id="watchingMsg">(watching from another tab)</small>';
+  document.getElementById('stats').innerHTML = '<h3 style="color:' + getPlayerColour(msg.id)  + '">Player : ' + getPlayerName(msg.id) + ' ' + escapeHtml(msg.addr) + team + watching + '</h3>';
+}
+
+/**
+ * Lets this tab steer the player, e.g. once the controlling tab is closed.
+ *
+ * @param {Object} msg
+ *        A "takeControl" message as defined in protocol/SCHEMA.md.
+ */
+function takeControl(msg) {
+  if (gGameEnded) {
+    return;
+  }
+  curDirection = getDirectionCode(msg.direction);
+  window.onkeydown = handleKeyPress;
+  let watchingElem = document.getElementById("watchingMsg");
+  if (watchingElem) {
+    watchingElem.style.display = "none";
+  }
 }
 
 /**
@@ -212,25 +452,227 @@ function onPlayerDeath() {
 }
 
 /**
- * Player won the game.
+ * Player (or, in a team game, the player's team) won the game.
  */
 function onPlayerVictory() {
-  if (gGameEnded) {
+  // Dead players still share their team's victory.
+  if (gGameEnded && !gTeams) {
     return;
   }
   console.log('onPlayerVictory')
   gGameEnded = true;
   window.onkeydown = null;
+  document.getElementById("deadMsg").style.display = "none";
   document.getElementById("winMsg").style.display = "inline";
 }
 
+/**
+ * The arena started shrinking.
+ */
+function onSuddenDeath() {
+  console.log('onSuddenDeath')
+  document.getElementById("suddenDeathMsg").style.display = "inline";
+}
+
+/**
+ * The game lasted too long and nobody won.
+ */
+function onGameDraw() {
+  if (gGameEnded) {
+    return;
+  }
+  console.log('onGameDraw')
+  gGameEnded = true;
+  window.onkeydown = null;
+  document.getElementById("suddenDeathMsg").style.display = "none";
+  document.getElementById("drawMsg").style.display = "inline";
+}
+
+/**
+ * Shows every player's statistics once the game is over. A summary from the
+ * leader replaces the one our node made on its own.
+ *
+ * @param {Object} msg
+ *        A "gameSummary" message as defined in protocol/SCHEMA.md.
+ */
+function onGameSummary(msg) {
+  let html = "<h3>" + (msg.isDraw ? "Draw" : "Game over") + " at tick " + msg.tick + "</h3>";
+  if (!msg.fromLeader) {
+    html += "<small>Waiting for the leader's summary</small>";
+  }
+  html += "<table class='table'><tr><th>#</th><th>Player</th><th>Ticks survived</th>" +
+          "<th>Cells covered</th><th>Kills</th><th>Turns</th></tr>";
+  for (let player of msg.players) {
+    html += '<tr style="color:' + getPlayerColour(player.id) + '">' +
+            "<td>" + player.placement + "</td>" +
+            "<td>" + escapeHtml(player.name) + "</td>" +
+            "<td>" + player.survived + "</td>" +
+            "<td>" + player.cells + "</td>" +
+            "<td>" + player.kills + "</td>" +
+            "<td>" + player.turns + "</td></tr>";
+  }
+  html += "</table>";
+
+  let summaryElem = document.getElementById("summary");
+  summaryElem.innerHTML = html;
+  summaryElem.style.display = "block";
+}
+
+/**
+ * Lists the rooms a spectator can watch.
+ *
+ * @param {Object} msg
+ *        A "roomList" message as defined in protocol/SCHEMA.md.
+ */
+function onRoomList(msg) {
+  document.getElementById("introMsg").innerHTML = "Pick a game to watch";
+  let roomsElem = document.getElementById("rooms");
+  roomsElem.innerHTML = "";
+
+  for (let room of msg.rooms) {
+    let players = room.players.map(player => escapeHtml(player.name || player.id)).join(", ");
+    let button = document.createElement("button");
+    button.className = "btn btn-default roomButton";
+    button.innerHTML = "Room " + room.id + ": " + players;
+    button.onclick = () => send("spectateRoom", {"roomId": room.id});
+    roomsElem.appendChild(button);
+  }
+
+  let refresh = document.createElement("button");
+  refresh.className = "btn btn-primary roomButton";
+  refresh.innerHTML = "Refresh";
+  refresh.onclick = () => send("listRooms");
+  roomsElem.appendChild(refresh);
+}
+
+/**
+ * Starts showing the game of the given room, without any controls.
+ *
+ * @param {Object} msg
+ *        A "startSpectating" message as defined in protocol/SCHEMA.md.
+ */
+function onStartSpectating(msg) {
+  hideIntroScreen();
+  document.getElementById("stats").innerHTML = "<h3>Spectating room " + msg.roomId + "</h3>";
+}
+
+/**
+ * Logs why the node rejected a message, and shows it in the lobby if we wait
+ * there, e.g. when the matchmaking server turned us away.
+ *
+ * @param {Object} msg
+ *        An "error" message as defined in protocol/SCHEMA.md.
+ */
+function onError(msg) {
+  console.error("Node rejected a message: " + msg.message);
+  if (document.getElementById("lobby").style.display == "block") {
+    document.getElementById("lobbyStatus").innerHTML = escapeHtml(msg.message);
+  }
+}
+
+/**
+ * Shows spectators the status of every player.
+ *
+ * @param {Object} msg
+ *        A "players" message as defined in protocol/SCHEMA.md.
+ */
+function onPlayers(msg) {
+  let players = msg.players;
+  if (!(players instanceof Array)) {
+    throw new Error("Passed players that aren't an array");
+  }
+
+  if (players.some(player => player.team > 0)) {
+    gTeams = {};
+    for (let player of players) {
+      gTeams[player.id] = player.team;
+    }
+  }
+  setPlayers(players);
+
+  let html = "<h3>" + (msg.isPlaying ? "Tick " + msg.tick : "Game over") + "</h3><table class='table'>";
+  html += "<tr><th>Player</th><th>Id</th><th>Address</th><th>Status</th><th>Score</th></tr>";
+  for (let player of players) {
+    let team = player.team > 0 ? " (Team " + player.team + ")" : "";
+    html += '<tr style="color:' + getPlayerColour(player.id) + '">' +
+            "<td>" + getPlayerName(player.id) + team + "</td>" +
+            "<td>" + escapeHtml(player.id) + "</td>" +
+            "<td>" + escapeHtml(player.addr) + "</td>" +
+            "<td>" + (player.isAlive ? "Alive" : "Dead") + "</td>" +
+            "<td>" + player.score + "</td></tr>";
+  }
+  html += "</table>";
+  document.getElementById("stats").innerHTML = html;
+}
+
+/**
+ * Shows a replay, with controls to play, pause, seek and change its speed.
+ *
+ * @param {Object} msg
+ *        A "startReplay" message as defined in protocol/SCHEMA.md.
+ */
+function onStartReplay(msg) {
+  gTeams = msg.teams || null;
+  setPlayers(msg.players);
+  hideIntroScreen();
+  if (msg.wrapAround) {
+    document.getElementById("mainCanvas").classList.add("wrapAround");
+  }
+
+  let playButton = document.getElementById("replayPlay");
+  let seek = document.getElementById("replaySeek");
+  let speed = document.getElementById("replaySpeed");
+  seek.max = msg.frames - 1;
+
+  playButton.onclick = () => {
+    gReplayPlaying = !gReplayPlaying;
+    playButton.innerHTML = gReplayPlaying ? "Pause" : "Play";
+    send("replayControl", {"action": gReplayPlaying ? "play" : "pause"});
+  };
+  seek.oninput = () => send("replayControl", {"action": "seek", "value": Number(seek.value)});
+  speed.onchange = () => send("replayControl", {"action": "speed", "value": Number(speed.value)});
+  document.getElementById("replayControls").style.display = "block";
+}
+
+/**
+ * Moves the replay controls to the frame being shown.
+ *
+ * @param {Object} msg
+ *        A "replayFrame" message as defined in protocol/SCHEMA.md.
+ */
+function onReplayFrame(msg) {
+  let index = msg.index;
+  let seek = document.getElementById("replaySeek");
+  seek.value = index;
+  document.getElementById("replayTick").innerHTML = "Tick " + index + " / " + seek.max;
+  // Playback stops at the end of the replay.
+  if (index === Number(seek.max)) {
+    gReplayPlaying = false;
+    document.getElementById("replayPlay").innerHTML = "Play";
+  }
+}
+
 function main() {
   console.log('main')
   // Register handlers.
-  gSocket.on("startGame", startGame);
-  gSocket.on("gameStateUpdate", handleGameStateUpdate);
-  gSocket.on("playerDead", onPlayerDeath);
-  gSocket.on("playerVictory", onPlayerVictory);
+  gHandlers["hello"] = msg => console.log("Node is in " + msg.mode + " mode");
+  gHandlers["lobby"] = onLobby;
+  gHandlers["startGame"] = startGame;
+  gHandlers["takeControl"] = takeControl;
+  gHandlers["state"] = onState;
+  gHandlers["stateDiff"] = onStateDiff;
+  gHandlers["playerDead"] = onPlayerDeath;
+  gHandlers["playerVictory"] = onPlayerVictory;
+  gHandlers["suddenDeath"] = onSuddenDeath;
+  gHandlers["gameDraw"] = onGameDraw;
+  gHandlers["gameSummary"] = onGameSummary;
+  gHandlers["roomList"] = onRoomList;
+  gHandlers["startSpectating"] = onStartSpectating;
+  gHandlers["players"] = onPlayers;
+  gHandlers["startReplay"] = onStartReplay;
+  gHandlers["replayFrame"] = onReplayFrame;
+  gHandlers["error"] = onError;
+  gSocket.onmessage = handleMessage;
 }
 
 main();
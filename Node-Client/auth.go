@@ -0,0 +1,223 @@
+package main
+
+// This file authenticates the messages nodes send each other. The matchmaking
+// server gives every node of a game the same session key when the game starts,
+// and every message is wrapped in a packet signed with an HMAC of the sender's
+// id, its tick, a sequence number and the message. Receivers drop packets that
+// aren't signed with the key, come from an address other than the sender's,
+// were already received, are far from our tick, or claim to come from the
+// leader when they don't.
+//
+// The key is shared by the whole game, so it keeps out anyone who isn't
+// playing, but a player could still sign messages as another player. Checking
+// the sender's address makes that harder.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	MAX_TICK_SKEW int    = 20 // How many ticks a packet's tick may be away from ours.
+	SEQ_WINDOW    uint64 = 64 // How many sequence numbers back packets may arrive out of order.
+)
+
+// A message, signed by its sender.
+type SignedPacket struct {
+	Sender  string          // Id of the sending node.
+	Tick    int             // Sender's tick when sending.
+	Seq     uint64          // Increases with every packet the sender signs.
+	Payload json.RawMessage // The Message, exactly as signed.
+	Mac     []byte          // HMAC-SHA256 of the fields above.
+}
+
+// Sequence numbers seen from a sender: the highest, and a bit for each of the
+// SEQ_WINDOW before it.
+type seqWindow struct {
+	highest uint64
+	seen    uint64
+}
+
+// What a game needs to authenticate its messages.
+type authState struct {
+	sessionKey []byte // Key of the current game, from the ms server.
+	sendSeq    uint64 // Sequence number of the last packet we signed.
+
+	authLock   sync.Mutex
+	seqWindows map[string]*seqWindow // Sender id to the sequence numbers seen from it.
+	senderIps  map[string][]net.IP   // Sender id to the IPs its address resolves to.
+}
+
+// Start authenticating messages with the key of a new game.
+func (g *Game) startAuth(key []byte) {
+	g.authLock.Lock()
+	defer g.authLock.Unlock()
+	g.sessionKey = key
+	g.seqWindows = make(map[string]*seqWindow)
+	g.senderIps = make(map[string][]net.IP)
+}
+
+// Compute the HMAC of a packet.
+func (g *Game) packetMac(packet *SignedPacket) []byte {
+	mac := hmac.New(sha256.New, g.sessionKey)
+	fmt.Fprintf(mac, "%s\n%d\n%d\n", packet.Sender, packet.Tick, packet.Seq)
+	mac.Write(packet.Payload)
+	return mac.Sum(nil)
+}
+
+// Wrap a message in a packet signed with the session key.
+func (g *Game) signMessage(message *Message) ([]byte, error) {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return nil, err
+	}
+	packet := &SignedPacket{Sender: g.nodeId, Tick: g.tick, Seq: atomic.AddUint64(&g.sendSeq, 1),
+		Payload: payload}
+	packet.Mac = g.packetMac(packet)
+	return json.Marshal(packet)
+}
+
+// Check a packet received from addr, and return its message. When the packet
+// must be dropped, the message is nil and the reason is returned instead.
+// Spectators aren't in the game, so their subscriptions are the only messages
+// accepted unsigned, and unencrypted when packets are encrypted. Updates are
+// streamed to the address a spectator claims, so it must subscribe from it.
+func (g *Game) verifyPacket(buf []byte, addr *net.UDPAddr) (*Message, string) {
+	buf, sealed := g.openPacket(buf)
+	if buf == nil {
+		return nil, "packet not encrypted with the peer key"
+	}
+	var packet SignedPacket
+	if err := json.Unmarshal(buf, &packet); err != nil {
+		decodeErrors.inc("")
+		return nil, "malformed packet"
+	}
+	if packet.Mac == nil {
+		var message Message
+		if err := json.Unmarshal(buf, &message); err == nil && message.IsSpectate {
+			if !isFromIp(message.Node.Ip, addr) {
+				return nil, "spectator " + message.Node.Ip + " subscribed from " + addr.String()
+			}
+			return &message, ""
+		}
+		return nil, "unsigned packet"
+	}
+	if !sealed && g.isEncrypted() {
+		return nil, "unencrypted packet from " + packet.Sender
+	}
+
+	// What the packet is checked against, as of now.
+	g.mutex.Lock()
+	var sender *Node
+	if node := g.getNode(packet.Sender); node != nil {
+		copied := *node
+		sender = &copied
+	}
+	tick, leaderId, amLeader := g.tick, "", g.isLeader()
+	if len(g.nodes) > 0 {
+		leaderId = g.nodes[0].Id
+	}
+	g.mutex.Unlock()
+
+	g.authLock.Lock()
+	defer g.authLock.Unlock()
+	if g.sessionKey == nil {
+		return nil, "no session key yet"
+	}
+	if !hmac.Equal(packet.Mac, g.packetMac(&packet)) {
+		return nil, "bad signature from " + packet.Sender
+	}
+	if sender == nil {
+		return nil, "unknown sender " + packet.Sender
+	}
+	if !g.isSenderAddr(sender, addr) {
+		return nil, packet.Sender + " sent from " + addr.String() + " instead of " + sender.Ip
+	}
+	if packet.Tick < tick-MAX_TICK_SKEW || packet.Tick > tick+MAX_TICK_SKEW {
+		return nil, fmt.Sprintf("tick %d of %s too far from ours", packet.Tick, packet.Sender)
+	}
+	if !g.checkSeq(packet.Sender, packet.Seq) {
+		return nil, fmt.Sprintf("replayed packet %d from %s", packet.Seq, packet.Sender)
+	}
+
+	var message Message
+	if err := json.Unmarshal(packet.Payload, &message); err != nil {
+		decodeErrors.inc("")
+		return nil, "malformed message from " + packet.Sender
+	}
+	// Only the leader speaks for the game, and death reports carry the
+	// dead node instead of the sender.
+	fromLeader := packet.Sender == leaderId
+	if (message.IsLeader || message.IsDeathReport) && !fromLeader {
+		return nil, packet.Sender + " impersonating the leader"
+	}
+	if !message.IsDeathReport && message.Node.Id != packet.Sender {
+		return nil, packet.Sender + " sent a message as " + message.Node.Id
+	}
+	if message.IsSpectate && !isFromIp(message.Node.Ip, addr) {
+		return nil, packet.Sender + " subscribed a spectator at " + message.Node.Ip
+	}
+	if fromLeader && !amLeader {
+		leaderLag.set("", float64(packet.Tick-tick))
+	}
+	return &message, ""
+}
+
+// Check a packet came from the sender's IP. Its port is random, since nodes
+// send from a new socket every time. Called with authLock held.
+func (g *Game) isSenderAddr(sender *Node, addr *net.UDPAddr) bool {
+	ips, ok := g.senderIps[sender.Id]
+	if !ok {
+		host, _, err := net.SplitHostPort(sender.Ip)
+		if err != nil {
+			return false
+		}
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			authLog.Warn("Failed to resolve", "peer", sender.Id, "ip", sender.Ip, "err", err)
+			return false
+		}
+		g.senderIps[sender.Id] = ips
+	}
+
+	for _, ip := range ips {
+		if ip.Equal(addr.IP) || (ip.IsLoopback() && addr.IP.IsLoopback()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a sequence number wasn't seen from the sender, and remember it.
+// Packets may arrive out of order, but not more than SEQ_WINDOW late.
+// Called with authLock held.
+func (g *Game) checkSeq(sender string, seq uint64) bool {
+	window, ok := g.seqWindows[sender]
+	if !ok {
+		window = &seqWindow{}
+		g.seqWindows[sender] = window
+	}
+
+	if seq > window.highest {
+		shift := seq - window.highest
+		if shift > SEQ_WINDOW {
+			window.seen = 0
+		} else {
+			// Keep the previous highest, now shift numbers back.
+			window.seen = window.seen<<shift | 1<<(shift-1)
+		}
+		window.highest = seq
+		return true
+	}
+	back := window.highest - seq
+	if back == 0 || back > SEQ_WINDOW || window.seen&(1<<(back-1)) != 0 {
+		return false
+	}
+	window.seen |= 1 << (back - 1)
+	return true
+}
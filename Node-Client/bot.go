@@ -0,0 +1,144 @@
+package main
+
+// This file implements bot players. A bot is a node without a browser: it
+// joins the matchmaking server straight away and picks its own turns, using
+// the same UDP messages as a human player.
+
+import (
+	"math/rand"
+	"os"
+	"time"
+)
+
+const (
+	BOT_EASY   string = "easy"   // Turns at random, avoiding immediate crashes.
+	BOT_MEDIUM string = "medium" // Maximizes its space, but sometimes plays like an easy bot.
+	BOT_HARD   string = "hard"   // Always heads for the direction with the most space.
+
+	botMistakeRate float64 = 0.3 // How often a medium bot plays like an easy bot.
+	botTurnRate    float64 = 0.2 // How often an easy bot turns when it doesn't have to.
+)
+
+var botLevel string // Difficulty of this node's bot, empty for a human player.
+
+var directions = []string{DIRECTION_UP, DIRECTION_DOWN, DIRECTION_LEFT, DIRECTION_RIGHT}
+
+// Check if the given string is a bot difficulty.
+func isBotLevel(level string) bool {
+	return level == BOT_EASY || level == BOT_MEDIUM || level == BOT_HARD
+}
+
+// Join a game as a bot, and exit once it is over.
+func botServe() {
+	defer waitGroup.Done()
+	rand.Seed(time.Now().UnixNano())
+	botLog.Info("Playing as a bot", "level", botLevel)
+	if err := joinAndPlay(); err != nil {
+		os.Exit(1)
+	}
+	// The rpc server never stops on its own.
+	os.Exit(0)
+}
+
+// Pick the bot's next turn and tell peers about it. Called once per tick.
+func (g *Game) botMove() {
+	g.mutex.Lock()
+	if !g.isPlaying || g.myNode == nil || !g.myNode.IsAlive {
+		g.mutex.Unlock()
+		return
+	}
+
+	current := g.lastQueuedDirection(g.myNode)
+	var next string
+	if botLevel == BOT_EASY || (botLevel == BOT_MEDIUM && rand.Float64() < botMistakeRate) {
+		next = g.randomSafeDirection(current)
+	} else {
+		next = g.mostSpaceDirection(current)
+	}
+	g.mutex.Unlock()
+
+	if next != current {
+		g.notifyPeersDirChanged(next)
+	}
+}
+
+// Return the directions the bot can take from its current heading without
+// crashing on the next tick.
+func (g *Game) safeDirections(current string) []string {
+	safe := make([]string, 0, len(directions))
+	for _, dir := range directions {
+		if isReversal(current, dir) {
+			continue
+		}
+		x, y := g.nextPosition(g.myNode.CurrLoc.X, g.myNode.CurrLoc.Y, dir)
+		if !g.nodeHasCollided(g.nodeId, g.myNode.CurrLoc.X, g.myNode.CurrLoc.Y, x, y) {
+			safe = append(safe, dir)
+		}
+	}
+	return safe
+}
+
+// EASY: Mostly keep going straight, turning at random when it has to, or
+// every now and then.
+func (g *Game) randomSafeDirection(current string) string {
+	safe := g.safeDirections(current)
+	if len(safe) == 0 {
+		return current
+	}
+	for _, dir := range safe {
+		if dir == current && rand.Float64() >= botTurnRate {
+			return current
+		}
+	}
+	return safe[rand.Intn(len(safe))]
+}
+
+// HARD: Head in the direction from which the most cells can be reached,
+// preferring to keep going straight on a tie.
+func (g *Game) mostSpaceDirection(current string) string {
+	best := current
+	bestSpace := -1
+	for _, dir := range g.safeDirections(current) {
+		x, y := g.nextPosition(g.myNode.CurrLoc.X, g.myNode.CurrLoc.Y, dir)
+		space := g.reachableCells(x, y)
+		if space > bestSpace || (space == bestSpace && dir == current) {
+			best = dir
+			bestSpace = space
+		}
+	}
+	return best
+}
+
+// Flood fill the board from x, y and return how many free cells can be
+// reached. Cells next to another live bike's head count as taken, since that
+// bike may move into them first.
+func (g *Game) reachableCells(x int, y int) int {
+	var taken [BOARD_SIZE][BOARD_SIZE]bool
+	for _, node := range g.nodes {
+		if node.Id == g.nodeId || !node.IsAlive {
+			continue
+		}
+		for _, dir := range directions {
+			nx, ny := g.nextPosition(node.CurrLoc.X, node.CurrLoc.Y, dir)
+			taken[ny][nx] = true
+		}
+	}
+
+	count := 0
+	taken[y][x] = true
+	queue := []Pos{{X: x, Y: y}}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		count++
+		for _, dir := range directions {
+			nx, ny := g.nextPosition(p.X, p.Y, dir)
+			if taken[ny][nx] || g.nodeHasCollided(g.nodeId, p.X, p.Y, nx, ny) {
+				continue
+			}
+			taken[ny][nx] = true
+			queue = append(queue, Pos{X: nx, Y: ny})
+		}
+	}
+	return count
+}
@@ -0,0 +1,167 @@
+package main
+
+// This file lets the leader catch followers that cheat. Followers report
+// their position and direction, and the leader checks every report against
+// its own simulation of the game before applying it: bikes move at most one
+// cell per tick (give or take the latency), never turn around, and never pass
+// through occupied cells. Illegal reports are dropped, and the follower is
+// corrected by the leader's next game history. Followers that keep cheating
+// are reported to the matchmaking server.
+
+import (
+	"fmt"
+)
+
+const (
+	MAX_DRIFT      int = 2 // Cells a reported position may be away from the simulated one, for latency.
+	MAX_VIOLATIONS int = 3 // Illegal reports after which the leader reports a follower.
+)
+
+// Sent by the leader to the ms server about a follower that keeps cheating.
+type CheatReport struct {
+	Reporter   string // Ip of the leader.
+	Accused    string // Ip of the follower.
+	Violations int
+	Reason     string // The last violation.
+	Log        []byte
+}
+
+// The cheat detection of a Game.
+type cheatState struct {
+	violations map[string]int // Id to the number of illegal reports from each follower.
+}
+
+// Start counting violations for a new game.
+func (g *Game) startCheatDetection() {
+	g.violations = make(map[string]int)
+}
+
+// Check if a peer's report can be applied. The leader checks every report
+// of a live follower, and drops illegal ones; followers trust what they
+// receive. Called with mutex held.
+func (g *Game) acceptReport(local *Node, reported *Node) bool {
+	if local == nil {
+		return false
+	}
+	if !g.isLeader() || local.Id == g.nodeId || reported.Direction == local.Direction {
+		return true
+	}
+	if !local.IsAlive {
+		return false // The dead don't move.
+	}
+
+	reason := g.checkReport(local, reported)
+	if reason == "" {
+		return true
+	}
+	g.recordViolation(local.Id, reason)
+	if isReversal(local.Direction, reported.Direction) {
+		// The turn in between may have been lost, and every later report
+		// would look like a reversal too. Turn our copy where the follower
+		// says it heads, so that a lost turn is only counted once.
+		local.Direction = reported.Direction
+		g.recordMove(local)
+	}
+	return false
+}
+
+// LEADER: Return why a follower's report is illegal, or "" if it isn't.
+func (g *Game) checkReport(local *Node, reported *Node) string {
+	if !isDirection(reported.Direction) {
+		return "unknown direction " + reported.Direction
+	}
+	if isReversal(local.Direction, reported.Direction) {
+		return "turned from " + local.Direction + " to " + reported.Direction
+	}
+	if reported.CurrLoc == nil {
+		return "no position"
+	}
+	x, y := reported.CurrLoc.X, reported.CurrLoc.Y
+	if x < 0 || y < 0 || x >= BOARD_SIZE || y >= BOARD_SIZE {
+		return fmt.Sprintf("off the board at %d,%d", x, y)
+	}
+	if d := g.boardDistance(local.CurrLoc, reported.CurrLoc); d > MAX_DRIFT {
+		return fmt.Sprintf("%d cells away from %d,%d", d, local.CurrLoc.X, local.CurrLoc.Y)
+	}
+	if cell := g.blockedCell(local, reported.CurrLoc); cell != nil {
+		return fmt.Sprintf("passed through %s at %d,%d", g.board[cell.Y][cell.X], cell.X, cell.Y)
+	}
+	return ""
+}
+
+// Number of cells between two positions, the shorter way round on a
+// wrap-around board.
+func (g *Game) boardDistance(a *Pos, b *Pos) int {
+	dx, dy := intAbs(a.X-b.X), intAbs(a.Y-b.Y)
+	if g.gameOptions.WrapAround {
+		dx = intMin(dx, BOARD_SIZE-dx)
+		dy = intMin(dy, BOARD_SIZE-dy)
+	}
+	return dx + dy
+}
+
+// Return the first cell the node would run into on its way to the reported
+// position, going the way updateLocationOfNode does, or nil if the way is
+// clear.
+func (g *Game) blockedCell(node *Node, to *Pos) *Pos {
+	axes := []int{AXIS_X, AXIS_Y}
+	if node.Direction == DIRECTION_UP || node.Direction == DIRECTION_DOWN {
+		axes = []int{AXIS_Y, AXIS_X}
+	}
+
+	x, y := node.CurrLoc.X, node.CurrLoc.Y
+	for _, axis := range axes {
+		for (axis == AXIS_X && x != to.X) || (axis == AXIS_Y && y != to.Y) {
+			if axis == AXIS_X {
+				x = wrapCoord(x + g.stepToward(x, to.X))
+			} else {
+				y = wrapCoord(y + g.stepToward(y, to.Y))
+			}
+			if !g.isPassable(node.Id, g.board[y][x]) {
+				return &Pos{x, y}
+			}
+		}
+	}
+	return nil
+}
+
+// Check if a node can go through a cell: it's empty, it's the node's own
+// trail, or a teammate's trail that is safe to cross.
+func (g *Game) isPassable(id string, cell string) bool {
+	return cell == "" || (cell != WALL && cell[1:] == id[1:]) || g.isTeammateTrail(id, cell)
+}
+
+// LEADER: Count an illegal report, and report the follower to the ms server
+// once it has made too many.
+func (g *Game) recordViolation(id string, reason string) {
+	if g.violations == nil {
+		return // The game hasn't started yet.
+	}
+	g.violations[id]++
+	cheatLog.Warn("Rejected report", "peer", g.playerName(id), "reason", reason, "violations", g.violations[id])
+	if g.violations[id] == MAX_VIOLATIONS {
+		if node := g.getNode(id); node != nil {
+			go g.reportCheater(node.Ip, g.violations[id], reason)
+		}
+	}
+}
+
+// LEADER: Tell the ms server about a follower that keeps cheating.
+func (g *Game) reportCheater(ip string, count int, reason string) {
+	client, err := dialRPC(msServerAddr)
+	if err != nil {
+		cheatLog.Error("Failed to report cheater", "ip", ip, "err", err)
+		return
+	}
+	defer client.Close()
+
+	reply := &ValReply{}
+	log := logSend("Rpc Call Context.ReportCheater to " + msServerAddr)
+	err = client.Call("Context.ReportCheater", &CheatReport{Reporter: g.nodeAddr, Accused: ip,
+		Violations: count, Reason: reason, Log: log}, reply)
+	if err != nil {
+		cheatLog.Error("Failed to report cheater", "ip", ip, "err", err)
+		return
+	}
+	cheatLog.Warn("Reported cheater to the ms server", "ip", ip, "reply", reply.Val)
+}
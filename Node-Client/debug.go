@@ -0,0 +1,199 @@
+package main
+
+// This file implements the admin debug endpoints, served under /debug/ on the
+// http server and on the -metrics address when -admintoken is given. They dump
+// the board, the peers and the last packets sent and received as JSON, and
+// serve Go's pprof profiles. Every request must carry the token, as
+// "Authorization: Bearer <token>". The http server doesn't use
+// http.DefaultServeMux, where net/http/pprof registers itself without any
+// check.
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DEBUG_STATE_PATH    string = "/debug/state"
+	DEBUG_PEERS_PATH    string = "/debug/peers"
+	DEBUG_MESSAGES_PATH string = "/debug/messages"
+	DEBUG_PPROF_PATH    string = "/debug/pprof/"
+	RECENT_MESSAGES     int    = 200 // Packets kept for /debug/messages.
+)
+
+// A packet sent to or received from a peer.
+type PacketRecord struct {
+	Time      time.Time
+	Direction string // "in" or "out".
+	Type      string // See messageType, "unknown" for packets that couldn't be read.
+	Peer      string // Id of the peer, or its address when it couldn't be read.
+	Tick      int    // Our tick when the packet was sent or received.
+	Size      int
+	Dropped   string `json:",omitempty"` // Why the packet was dropped, if it was.
+}
+
+// A peer, as /debug/peers shows it.
+type PeerStatus struct {
+	Id          string
+	Ip          string
+	IsAlive     bool
+	CurrLoc     *Pos
+	Direction   string
+	LastCheckin float64 // Seconds since the peer's last packet, -1 if it never sent one.
+}
+
+var adminTokenPath string // File holding the token, empty to turn the endpoints off.
+var adminToken []byte
+
+// What a game keeps for /debug/messages.
+type debugState struct {
+	recentLock    sync.Mutex
+	recentPackets []*PacketRecord // The last RECENT_MESSAGES packets, oldest first.
+}
+
+// Read the admin token, if any.
+func loadAdminToken() error {
+	if adminTokenPath == "" {
+		return nil
+	}
+	token, err := ioutil.ReadFile(adminTokenPath)
+	if err != nil {
+		return err
+	}
+	adminToken = []byte(strings.TrimSpace(string(token)))
+	if len(adminToken) == 0 {
+		return errors.New("the admin token in " + adminTokenPath + " is empty")
+	}
+	opsLog.Info("Debug endpoints are on", "path", "/debug/")
+	return nil
+}
+
+// Add the debug endpoints and the log level to mux, if there is an admin
+// token.
+func registerDebug(mux *http.ServeMux) {
+	if len(adminToken) == 0 {
+		return
+	}
+	mux.HandleFunc(LOG_LEVEL_PATH, requireAdmin(serveLogLevel))
+	mux.HandleFunc(DEBUG_STATE_PATH, requireAdmin(serveDebugState))
+	mux.HandleFunc(DEBUG_PEERS_PATH, requireAdmin(serveDebugPeers))
+	mux.HandleFunc(DEBUG_MESSAGES_PATH, requireAdmin(serveDebugMessages))
+	mux.HandleFunc(DEBUG_PPROF_PATH, requireAdmin(pprof.Index))
+	mux.HandleFunc(DEBUG_PPROF_PATH+"cmdline", requireAdmin(pprof.Cmdline))
+	mux.HandleFunc(DEBUG_PPROF_PATH+"profile", requireAdmin(pprof.Profile))
+	mux.HandleFunc(DEBUG_PPROF_PATH+"symbol", requireAdmin(pprof.Symbol))
+	mux.HandleFunc(DEBUG_PPROF_PATH+"trace", requireAdmin(pprof.Trace))
+}
+
+// Only let requests with the admin token through.
+func requireAdmin(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), adminToken) != 1 {
+			opsLog.Warn("Refused admin request", "path", r.URL.Path, "from", r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Remember a packet for /debug/messages.
+func (g *Game) recordPacket(direction string, msgType string, peer string, size int, dropped string) {
+	if len(adminToken) == 0 {
+		return
+	}
+	record := &PacketRecord{Time: time.Now(), Direction: direction, Type: msgType, Peer: peer,
+		Tick: loadTags(&g.tags).tick, Size: size, Dropped: dropped}
+	g.recentLock.Lock()
+	defer g.recentLock.Unlock()
+	if len(g.recentPackets) == RECENT_MESSAGES {
+		g.recentPackets = g.recentPackets[1:]
+	}
+	g.recentPackets = append(g.recentPackets, record)
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(v); err != nil {
+		opsLog.Error("Failed to write debug response", "err", err)
+	}
+}
+
+// The game, the tick, the leader and the board.
+func serveDebugState(w http.ResponseWriter, r *http.Request) {
+	state := struct {
+		Game      int
+		Node      string
+		Tick      int
+		IsPlaying bool
+		IsAlive   bool
+		Leader    string
+		IsLeader  bool
+		Board     [][]string
+	}{}
+
+	if game != nil {
+		game.mutex.Lock()
+		state.Game, state.Node = game.gameId, game.nodeId
+		state.Tick, state.IsPlaying, state.IsAlive = game.tick, game.isPlaying, game.imAlive
+		if len(game.nodes) > 0 {
+			state.Leader = game.nodes[0].Id
+			state.IsLeader = game.isLeader()
+		}
+		state.Board = boardToRows(game.board)
+		game.mutex.Unlock()
+	}
+	writeJson(w, &state)
+}
+
+// Every node still in the game, when it last checked in, and the nodes found
+// to have failed.
+func serveDebugPeers(w http.ResponseWriter, r *http.Request) {
+	peers := struct {
+		Leader      string
+		Nodes       []*PeerStatus
+		FailedNodes []string
+		AliveNodes  int
+	}{Nodes: make([]*PeerStatus, 0)}
+
+	if game != nil {
+		game.mutex.Lock()
+		if len(game.nodes) > 0 {
+			peers.Leader = game.nodes[0].Id
+		}
+		for _, node := range game.nodes {
+			peer := &PeerStatus{Id: node.Id, Ip: node.Ip, IsAlive: node.IsAlive, CurrLoc: node.CurrLoc,
+				Direction: node.Direction, LastCheckin: -1}
+			if checkin, ok := game.lastCheckin[node.Id]; ok {
+				peer.LastCheckin = game.clock.Now().Sub(checkin).Seconds()
+			}
+			peers.Nodes = append(peers.Nodes, peer)
+		}
+		peers.FailedNodes = append([]string{}, game.failedNodes...)
+		peers.AliveNodes = game.aliveNodes
+		game.mutex.Unlock()
+	}
+	writeJson(w, &peers)
+}
+
+// The last packets sent and received, oldest first.
+func serveDebugMessages(w http.ResponseWriter, r *http.Request) {
+	packets := []*PacketRecord{}
+	if game != nil {
+		game.recentLock.Lock()
+		packets = append(packets, game.recentPackets...)
+		game.recentLock.Unlock()
+	}
+	writeJson(w, packets)
+}
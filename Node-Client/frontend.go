@@ -0,0 +1,33 @@
+package main
+
+// This file defines the hooks through which the game shows its state to the
+// player, so the same game can be played in the browser, from the command
+// line or by a bot.
+
+// A way of showing the game to the player.
+type Frontend interface {
+	LobbyUpdate(status *LobbyStatus)                      // The room we wait in changed, nil once we leave it.
+	StartGame()                                           // The game has started.
+	GameStateUpdate(state [BOARD_SIZE][BOARD_SIZE]string) // A tick has passed.
+	PlayerDead()                                          // We died.
+	PlayerVictory()                                       // We (or our team) won.
+	SuddenDeath()                                         // The arena started shrinking.
+	GameDraw()                                            // The game ended in a draw.
+	GameSummary(summary *GameSummary)                     // Every player's statistics, once the game is over.
+	QueueError(err error)                                 // The ms server turned us away.
+}
+
+var frontend Frontend // How this node shows the game.
+
+// Frontend of bots, which have nobody to show the game to.
+type noFrontend struct{}
+
+func (noFrontend) LobbyUpdate(status *LobbyStatus)                      {}
+func (noFrontend) StartGame()                                           {}
+func (noFrontend) GameStateUpdate(state [BOARD_SIZE][BOARD_SIZE]string) {}
+func (noFrontend) PlayerDead()                                          {}
+func (noFrontend) PlayerVictory()                                       {}
+func (noFrontend) SuddenDeath()                                         {}
+func (noFrontend) GameDraw()                                            {}
+func (noFrontend) GameSummary(summary *GameSummary)                     {}
+func (noFrontend) QueueError(err error)                                 {}
@@ -0,0 +1,207 @@
+package main
+
+// This file implements headless mode, for automated tests and load
+// generators: the node joins the matchmaking server straight away, takes its
+// turns from stdin or a script file, and writes game events to stdout as JSON
+// lines.
+//
+// Every input line is a turn, either "D" to turn as soon as possible or
+// "12 D" to turn at tick 12. Directions are U, D, L and R (or up, down, left
+// and right). Blank lines and anything after a # are ignored.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var isHeadless bool   // Is this node running without a browser.
+var scriptPath string // File to read turns from, instead of stdin.
+
+// A game event, written to stdout as a line of JSON.
+type HeadlessEvent struct {
+	Event     string                          `json:"event"`
+	Tick      int                             `json:"tick"`
+	Id        string                          `json:"id,omitempty"`
+	Addr      string                          `json:"addr,omitempty"`
+	Name      string                          `json:"name,omitempty"`
+	Team      int                             `json:"team,omitempty"`
+	Direction string                          `json:"direction,omitempty"`
+	Board     *[BOARD_SIZE][BOARD_SIZE]string `json:"board,omitempty"`
+	Lobby     *LobbyStatus                    `json:"lobby,omitempty"`
+	Summary   *GameSummary                    `json:"summary,omitempty"`
+	Error     string                          `json:"error,omitempty"`
+}
+
+// Frontend of headless nodes, writing every event as a line of JSON.
+type jsonFrontend struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func newJSONFrontend(w io.Writer) *jsonFrontend {
+	return &jsonFrontend{encoder: json.NewEncoder(w)}
+}
+
+func (f *jsonFrontend) write(event *HeadlessEvent) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	event.Tick = loadTags(&tags).tick
+	if err := f.encoder.Encode(event); err != nil {
+		uiLog.Error("Failed to write event", "event", event.Event, "err", err)
+	}
+}
+
+func (f *jsonFrontend) LobbyUpdate(status *LobbyStatus) {
+	f.write(&HeadlessEvent{Event: "lobby", Lobby: status})
+}
+
+func (f *jsonFrontend) StartGame() {
+	game.mutex.Lock()
+	event := &HeadlessEvent{Event: "startGame", Id: game.nodeId, Addr: game.nodeAddr,
+		Name: game.myNode.Profile.Name, Team: game.myNode.Team, Direction: game.myNode.Direction}
+	game.mutex.Unlock()
+	f.write(event)
+}
+
+func (f *jsonFrontend) GameStateUpdate(state [BOARD_SIZE][BOARD_SIZE]string) {
+	f.write(&HeadlessEvent{Event: "gameStateUpdate", Board: &state})
+}
+
+func (f *jsonFrontend) PlayerDead() {
+	f.write(&HeadlessEvent{Event: "playerDead", Id: loadTags(&tags).node})
+}
+
+func (f *jsonFrontend) PlayerVictory() {
+	f.write(&HeadlessEvent{Event: "playerVictory", Id: loadTags(&tags).node})
+}
+
+func (f *jsonFrontend) SuddenDeath() {
+	f.write(&HeadlessEvent{Event: "suddenDeath"})
+}
+
+func (f *jsonFrontend) GameDraw() {
+	f.write(&HeadlessEvent{Event: "gameDraw"})
+}
+
+func (f *jsonFrontend) GameSummary(summary *GameSummary) {
+	f.write(&HeadlessEvent{Event: "gameSummary", Summary: summary})
+}
+
+func (f *jsonFrontend) QueueError(err error) {
+	f.write(&HeadlessEvent{Event: "queueError", Error: err.Error()})
+}
+
+// Join a game without a browser, playing the turns from the script file or
+// stdin, and exit once it is over.
+func headlessServe() {
+	defer waitGroup.Done()
+
+	input := io.Reader(os.Stdin)
+	if scriptPath != "" {
+		script, err := os.Open(scriptPath)
+		checkErr(err, 105)
+		defer script.Close()
+		input = script
+	}
+	go readTurns(input)
+
+	if err := joinAndPlay(); err != nil {
+		os.Exit(1)
+	}
+	// The rpc server never stops on its own.
+	os.Exit(0)
+}
+
+// Join the matchmaking server straight away, and return once our game is
+// over, or if the matchmaking server turned us away.
+func joinAndPlay() error {
+	if err := msRpcDial(); err != nil {
+		return err
+	}
+
+	// Wait for the game to start and end.
+	for {
+		tick, isPlaying := game.playing()
+		if tick > 0 && !isPlaying {
+			break
+		}
+		time.Sleep(tickRate)
+	}
+	// Keep answering peers for a little while, in case we are the leader.
+	time.Sleep(2 * enforceGameStateRate)
+	uiLog.Info("Game over, exiting")
+	return nil
+}
+
+// Read turns line by line, making each one once the game reaches its tick.
+func readTurns(input io.Reader) {
+	scanner := bufio.NewScanner(input)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		at, direction, err := parseTurn(scanner.Text())
+		if err != nil {
+			uiLog.Warn("Ignoring input line", "line", lineNum, "err", err)
+			continue
+		}
+		if direction == "" {
+			continue
+		}
+
+		for {
+			tick, isPlaying := game.playing()
+			if tick > 0 && !isPlaying {
+				return // The game is over.
+			}
+			if isPlaying && tick >= at {
+				break
+			}
+			time.Sleep(tickRate / 10)
+		}
+		game.notifyPeersDirChanged(direction)
+	}
+}
+
+// Parse a line of input into the tick to turn at and the direction to turn
+// to. The direction is empty for lines without a turn.
+func parseTurn(line string) (int, string, error) {
+	if i := strings.Index(line, "#"); i >= 0 {
+		line = line[:i]
+	}
+
+	fields := strings.Fields(line)
+	at := 0
+	switch len(fields) {
+	case 0:
+		return 0, "", nil
+	case 1:
+	case 2:
+		var err error
+		at, err = strconv.Atoi(fields[0])
+		if err != nil || at < 0 {
+			return 0, "", errors.New("invalid tick " + fields[0])
+		}
+		fields = fields[1:]
+	default:
+		return 0, "", errors.New("expected [tick] direction")
+	}
+
+	switch strings.ToUpper(fields[0]) {
+	case DIRECTION_UP, "UP":
+		return at, DIRECTION_UP, nil
+	case DIRECTION_DOWN, "DOWN":
+		return at, DIRECTION_DOWN, nil
+	case DIRECTION_LEFT, "LEFT":
+		return at, DIRECTION_LEFT, nil
+	case DIRECTION_RIGHT, "RIGHT":
+		return at, DIRECTION_RIGHT, nil
+	}
+	return 0, "", errors.New("invalid direction " + fields[0])
+}
@@ -1,96 +1,294 @@
 package main
 
-// This file implements the HTTP server portion of the GUI layer.
+// This file implements the HTTP server portion of the GUI layer. The browser
+// talks to the node over WebSocket, see protocol/SCHEMA.md.
 
 import (
-	"github.com/googollee/go-socket.io"
 	"github.com/pkg/browser"
-	"log"
+	"gotron/Node-Client/protocol"
 	"net"
 	"net/http"
 )
 
-// Note: This variable should be treated as private to httpServer.go.
-var _gSO socketio.Socket
+// Frontend of human players, in the browser.
+type browserFrontend struct{}
+
+// Shows the queue we wait in.
+func (browserFrontend) LobbyUpdate(status *LobbyStatus) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for _, s := range sessions {
+		emitLobby(s)
+	}
+}
+
+// Shows why the ms server turned us away, and lets the player join again.
+func (f browserFrontend) QueueError(err error) {
+	f.LobbyUpdate(nil)
+	emitToSessions(protocol.ERROR, &protocol.Error{Message: "The matchmaking server turned us away: " + err.Error()})
+}
 
 // Starts the UI game screen.
-func startGameUI() {
-	if _gSO == nil {
-		localLog("socketio is NIL !!!")
-		return
+func (browserFrontend) StartGame() {
+	startSessions()
+}
+
+// Map each player to their team, or nil when playing free for all. Called
+// with mutex held.
+func (g *Game) getTeamsForJS() map[string]int {
+	if g.gameOptions.Teams == 0 {
+		return nil
 	}
 
-	_gSO.On("playerMove", func(playerMove map[string]string) {
-		direction, ok := playerMove["direction"]
-		if !ok {
-			log.Fatal("Received playerMove without direction")
-			return
+	teams := make(map[string]int)
+	for _, node := range g.nodes {
+		teams[node.Id] = node.Team
+	}
+	return teams
+}
+
+// Every player in the game, with their name and colour. Called with mutex
+// held.
+func (g *Game) getPlayersForJS() []protocol.Player {
+	players := make([]protocol.Player, 0, len(g.nodes))
+	for _, node := range g.nodes {
+		players = append(players, protocol.Player{Id: node.Id, Addr: node.Ip, Team: node.Team,
+			Name: node.Profile.Name, Colour: node.Profile.Colour})
+	}
+	return players
+}
+
+// Copy the board into rows, the way the protocol sends it.
+func boardToRows(state [BOARD_SIZE][BOARD_SIZE]string) [][]string {
+	rows := make([][]string, BOARD_SIZE)
+	for y := range state {
+		rows[y] = make([]string, BOARD_SIZE)
+		copy(rows[y], state[y][:])
+	}
+	return rows
+}
+
+// Called with mutex held.
+func (browserFrontend) GameStateUpdate(state [BOARD_SIZE][BOARD_SIZE]string) {
+	sendBoardToSessions(game.tick, boardToRows(state))
+}
+
+func (browserFrontend) PlayerDead() {
+	emitGameEvent(protocol.PLAYER_DEAD)
+}
+
+func (browserFrontend) PlayerVictory() {
+	emitGameEvent(protocol.PLAYER_VICTORY)
+}
+
+func (browserFrontend) SuddenDeath() {
+	emitGameEvent(protocol.SUDDEN_DEATH)
+}
+
+func (browserFrontend) GameDraw() {
+	emitGameEvent(protocol.GAME_DRAW)
+}
+
+func (browserFrontend) GameSummary(summary *GameSummary) {
+	emitSummary(summaryForJS(summary))
+}
+
+// Convert a game summary to what the protocol sends, naming every player.
+func summaryForJS(summary *GameSummary) *protocol.GameSummary {
+	msg := &protocol.GameSummary{Tick: summary.Tick, IsDraw: summary.IsDraw,
+		FromLeader: summary.FromLeader,
+		Players:    make([]protocol.PlayerSummary, 0, len(summary.Players))}
+	game.mutex.Lock()
+	defer game.mutex.Unlock()
+	for _, s := range summary.Players {
+		player := protocol.Player{Id: s.Id, Name: s.Id}
+		if node := game.getNode(s.Id); node != nil {
+			player = protocol.Player{Id: node.Id, Addr: node.Ip, Team: node.Team,
+				Name: node.Profile.Name, Colour: node.Profile.Colour}
+		}
+		msg.Players = append(msg.Players, protocol.PlayerSummary{Player: player,
+			Survived: s.Survived, Cells: s.Cells, Kills: s.Kills, Turns: s.Turns,
+			Placement: s.Placement})
+	}
+	return msg
+}
+
+// Shows the spectator the rooms it can watch, and starts watching the one
+// picked. Tabs that connect once a room is picked watch it too.
+func startSpectatorUI(s *session) {
+	var rooms []*Room
+	sendRooms := func() {
+		var err error
+		rooms, err = msListRooms()
+		if err != nil {
+			uiLog.Error("Failed to list rooms", "err", err)
+		}
+		list := &protocol.RoomList{Rooms: make([]protocol.Room, 0, len(rooms))}
+		for _, room := range rooms {
+			r := protocol.Room{Id: room.Id}
+			for _, player := range room.Players {
+				r.Players = append(r.Players, protocol.Player{Id: player.Id, Addr: player.Ip,
+					Team: player.Team, Name: player.Profile.Name, Colour: player.Profile.Colour})
+			}
+			list.Rooms = append(list.Rooms, r)
 		}
+		s.Emit(protocol.ROOM_LIST, list)
+	}
 
-		notifyPeersDirChanged(direction)
+	s.On(protocol.LIST_ROOMS, func(env *protocol.Envelope) {
+		sendRooms()
+	})
+	s.On(protocol.SPECTATE_ROOM, func(env *protocol.Envelope) {
+		spectate := &protocol.SpectateRoom{}
+		if err := env.Unpack(spectate); err != nil {
+			s.Emit(protocol.ERROR, &protocol.Error{Message: err.Error()})
+			return
+		}
+		for _, room := range rooms {
+			if room.Id == spectate.RoomId {
+				watchRoom(room)
+				return
+			}
+		}
+		uiLog.Warn("Asked to spectate unknown room", "room", spectate.RoomId)
 	})
 
-	// Start the game.
-	_gSO.Emit("startGame", nodeId, nodeAddr, myNode.Direction)
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if spectatedRoom != nil {
+		s.Emit(protocol.START_SPECTATING, &protocol.StartSpectating{RoomId: spectatedRoom.Id})
+		return
+	}
+	go sendRooms()
 }
 
-func pushGameStateToJS(state [BOARD_SIZE][BOARD_SIZE]string) {
-	if _gSO == nil {
-		localLog("socketio is NIL !!!")
+// Start watching a room, unless another tab already picked one.
+func watchRoom(room *Room) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if spectatedRoom != nil {
 		return
 	}
 
-	_gSO.Emit("gameStateUpdate", state)
+	spectatedRoom = room
+	for _, s := range sessions {
+		s.Emit(protocol.START_SPECTATING, &protocol.StartSpectating{RoomId: room.Id})
+	}
+	go spectateRoom(room)
+}
+
+// Convert player statuses to what the protocol sends.
+func playersForJS(tick int, isPlaying bool, players []*PlayerStatus) *protocol.Players {
+	msg := &protocol.Players{Tick: tick, IsPlaying: isPlaying,
+		Players: make([]protocol.PlayerStatus, 0, len(players))}
+	for _, p := range players {
+		msg.Players = append(msg.Players, protocol.PlayerStatus{
+			Player: protocol.Player{Id: p.Id, Addr: p.Ip, Team: p.Team,
+				Name: p.Profile.Name, Colour: p.Profile.Colour},
+			IsAlive: p.IsAlive, Score: p.Score})
+	}
+	return msg
 }
 
-func notifyPlayerDeathToJS() {
-	if _gSO == nil {
-		localLog("socketio is NIL !!!")
+// Show spectators every player's status.
+func pushPlayersToJS(tick int, isPlaying bool, players []*PlayerStatus) {
+	emitToSessions(protocol.PLAYERS, playersForJS(tick, isPlaying, players))
+}
+
+// Play the replay in the browser, following the tab's controls. Every tab
+// plays the replay on its own.
+func startReplayUI(s *session) {
+	replayOnce.Do(func() {
+		r, err := loadReplay(replayPath)
+		if err != nil {
+			replayLog.Error("Failed to load replay", "path", replayPath, "err", err)
+			return
+		}
+		// Simulated on a game of its own, since no node plays it.
+		rg := newGame("")
+		replayFrames = rg.simulateReplay(r)
+		replayTeams = rg.getTeamsForJS()
+		replayPlayers = rg.getPlayersForJS()
+		replayWrapAround = r.Options.WrapAround
+		replayLog.Info("Loaded replay", "ticks", len(replayFrames), "path", replayPath)
+	})
+	if replayFrames == nil {
+		s.Emit(protocol.ERROR, &protocol.Error{Message: "failed to load the replay"})
 		return
 	}
 
-	_gSO.Emit("playerDead")
+	controls := make(chan protocol.ReplayControl)
+	done := make(chan struct{}) // Closed once the replay stops playing.
+	s.On(protocol.REPLAY_CONTROL, func(env *protocol.Envelope) {
+		control := protocol.ReplayControl{}
+		if err := env.Unpack(&control); err != nil {
+			s.Emit(protocol.ERROR, &protocol.Error{Message: err.Error()})
+			return
+		}
+		select {
+		case controls <- control:
+		case <-done:
+		}
+	})
+	onSessionClose(s, func() {
+		select {
+		case controls <- protocol.ReplayControl{Action: REPLAY_STOP}:
+		case <-done:
+		}
+	})
+	s.Emit(protocol.START_REPLAY, &protocol.StartReplay{Frames: len(replayFrames),
+		WrapAround: replayWrapAround, Teams: replayTeams, Players: replayPlayers})
+	go playReplay(s, replayFrames, controls, done)
+}
+
+// Show a tab a replay frame and where it is in the replay.
+func pushReplayFrameToJS(s *session, index int, frame *SpectatorUpdate) {
+	s.sendBoard(frame.Tick, boardToRows(frame.Board))
+	s.Emit(protocol.PLAYERS, playersForJS(frame.Tick, frame.IsPlaying, frame.Players))
+	s.Emit(protocol.REPLAY_FRAME, &protocol.ReplayFrame{Index: index})
 }
 
-func notifyPlayerVictoryToJS() {
-	if _gSO == nil {
-		localLog("socketio is NIL !!!")
+// Upgrade a connection to WebSocket and serve the tab until it goes away.
+func serveSession(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		uiLog.Warn("WebSocket upgrade failed", "err", err)
 		return
 	}
 
-	_gSO.Emit("playerVictory")
+	s := addSession(conn)
+	switch {
+	case isSpectator:
+		s.Emit(protocol.HELLO, &protocol.Hello{Mode: protocol.MODE_SPECTATOR})
+		startSpectatorUI(s)
+	case replayPath != "":
+		s.Emit(protocol.HELLO, &protocol.Hello{Mode: protocol.MODE_REPLAY})
+		startReplayUI(s)
+	default:
+		s.Emit(protocol.HELLO, &protocol.Hello{Mode: protocol.MODE_PLAYER})
+		startPlayerUI(s)
+	}
+	s.readLoop()
 }
 
 // Starts the HTTP server.
 func httpServe() {
 	defer waitGroup.Done()
-	server, err := socketio.NewServer(nil)
-	if err != nil {
-		localLog("ERROR: Fatal socketio.NewServer() error:", err)
-		log.Fatal(err)
-	}
-	server.On("connection", func(so socketio.Socket) {
-		localLog("on connection")
-		_gSO = so
-		go msRpcDial()
-	})
-	server.On("error", func(so socketio.Socket, err error) {
-		localLog("ERROR:", err)
-	})
-	server.On("disconnection", func() {
-		localLog("on disconnect")
-	})
 
-	http.Handle("/socket.io/", server)
-	http.Handle("/", http.FileServer(http.Dir("./asset")))
-	localLog("Serving at ", httpServerAddr, "...")
+	// Not http.DefaultServeMux, see debug.go.
+	mux := http.NewServeMux()
+	mux.HandleFunc(protocol.PATH, serveSession)
+	mux.HandleFunc(METRICS_PATH, serveMetrics)
+	registerDebug(mux)
+	mux.Handle("/", http.FileServer(http.Dir("./asset")))
+	uiLog.Info("Serving", "addr", httpServerAddr)
 
 	listener, err := net.Listen("tcp", httpServerAddr)
 	if err != nil {
-		localLog("httpserver listener error ", err)
+		uiLog.Error("httpserver listener error", "err", err)
 	} else {
-		localLog("httpserver listener success")
+		uiLog.Info("httpserver listener success")
 		browser.OpenURL("http://" + httpServerAddr)
-		http.Serve(listener, nil)
+		http.Serve(listener, mux)
 	}
 }
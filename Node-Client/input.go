@@ -0,0 +1,149 @@
+package main
+
+// This file buffers the turns of every player, so that quick key presses
+// between two ticks are applied one per tick, in order, instead of only the
+// last one counting.
+//
+// Nodes don't tick in step, so a node's tick means nothing to its peers. Turns
+// are sent with the number of ticks the sender waits before making them, and
+// each peer waits as many of its own ticks.
+
+import "fmt"
+
+// A turn queued by a player, and the tick it should be applied at. In a
+// Message, Tick is how many ticks after the sender's tick the turn is made.
+type Turn struct {
+	Direction string
+	Tick      int
+}
+
+const MAX_QUEUED_TURNS int = 3
+
+// The turns of a Game.
+type turnState struct {
+	turnQueues map[string][]*Turn // Id to the turns each player has yet to make, oldest first.
+}
+
+var opposites = map[string]string{
+	DIRECTION_UP:    DIRECTION_DOWN,
+	DIRECTION_DOWN:  DIRECTION_UP,
+	DIRECTION_LEFT:  DIRECTION_RIGHT,
+	DIRECTION_RIGHT: DIRECTION_LEFT,
+}
+
+// Check if the given string is a direction.
+func isDirection(dir string) bool {
+	_, ok := opposites[dir]
+	return ok
+}
+
+// Check if going from one direction to another is a 180 degree turn, which
+// would crash a bike into its own trail.
+func isReversal(from string, to string) bool {
+	return opposites[from] == to
+}
+
+// Return the direction a node will be heading in once all its queued turns
+// have been made.
+func (g *Game) lastQueuedDirection(node *Node) string {
+	queue := g.turnQueues[node.Id]
+	if len(queue) == 0 {
+		return node.Direction
+	}
+	return queue[len(queue)-1].Direction
+}
+
+// Queue a turn for my node, one tick after the last one queued. Return nil if
+// the turn is rejected because it is redundant, a reversal or the queue is
+// full.
+func (g *Game) queueMyTurn(direction string) *Turn {
+	lastDirection := g.lastQueuedDirection(g.myNode)
+	if direction == lastDirection {
+		return nil
+	}
+	if isReversal(lastDirection, direction) {
+		gameLog.Info("Rejected reversal", "from", lastDirection, "to", direction)
+		return nil
+	}
+
+	queue := g.turnQueues[g.nodeId]
+	if len(queue) >= MAX_QUEUED_TURNS {
+		gameLog.Info("Rejected turn, too many queued turns", "to", direction)
+		return nil
+	}
+
+	turn := &Turn{Direction: direction, Tick: g.tick}
+	if len(queue) > 0 {
+		turn.Tick = intMax(g.tick, queue[len(queue)-1].Tick+1)
+	}
+	g.turnQueues[g.nodeId] = append(queue, turn)
+	return turn
+}
+
+// Return the turn to send peers: when it is made, relative to our tick.
+func (g *Game) turnForPeers(turn *Turn) *Turn {
+	return &Turn{Direction: turn.Direction, Tick: turn.Tick - g.tick}
+}
+
+// Queue a turn a peer has told us about, at our tick. Turns are dropped if
+// they couldn't have been queued by the peer: redundant, reversals, or further
+// ahead than its queue goes.
+func (g *Game) queuePeerTurn(id string, turn *Turn) {
+	if !isDirection(turn.Direction) {
+		if g.isLeader() {
+			g.recordViolation(id, "turned to unknown direction "+turn.Direction)
+		}
+		return
+	}
+	if turn.Tick < 0 || turn.Tick >= MAX_QUEUED_TURNS {
+		if g.isLeader() {
+			g.recordViolation(id, fmt.Sprintf("turned %d ticks ahead", turn.Tick))
+		}
+		return
+	}
+	node := g.getNode(id)
+	if node == nil {
+		return
+	}
+	// Our view of the peer may be behind or ahead of its own, e.g. when its
+	// position report overtook the turn, so these aren't violations.
+	lastDirection := g.lastQueuedDirection(node)
+	if turn.Direction == lastDirection {
+		gameLog.Debug("Dropped turn, already heading that way", "peer", id, "to", turn.Direction)
+		return
+	}
+	if isReversal(lastDirection, turn.Direction) {
+		gameLog.Warn("Dropped reversal", "peer", id, "from", lastDirection, "to", turn.Direction)
+		return
+	}
+
+	queue := g.turnQueues[id]
+	if len(queue) >= MAX_QUEUED_TURNS {
+		gameLog.Warn("Dropped turn, too many queued turns", "peer", id)
+		return
+	}
+	queued := &Turn{Direction: turn.Direction, Tick: g.tick + turn.Tick}
+	if len(queue) > 0 {
+		queued.Tick = intMax(queued.Tick, queue[len(queue)-1].Tick+1)
+	}
+	g.turnQueues[id] = append(queue, queued)
+}
+
+// Make the node's oldest queued turn if it is due. At most one turn is made
+// per tick, and reversals are never made.
+func (g *Game) applyQueuedTurn(node *Node) {
+	queue := g.turnQueues[node.Id]
+	if len(queue) == 0 || queue[0].Tick > g.tick {
+		return
+	}
+
+	turn := queue[0]
+	g.turnQueues[node.Id] = queue[1:]
+	if isReversal(node.Direction, turn.Direction) {
+		gameLog.Warn("Rejected reversal", "peer", g.playerName(node.Id), "from", node.Direction, "to", turn.Direction)
+		return
+	}
+	node.Direction = turn.Direction
+	g.statsTurn(node.Id)
+	g.recordEvent(&ReplayEvent{Type: REPLAY_TURN, Id: node.Id, Direction: node.Direction})
+}
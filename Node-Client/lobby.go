@@ -0,0 +1,143 @@
+package main
+
+// This file keeps track of our place in the matchmaking server's queue while
+// we wait for a game. The server pushes the status of the waiting room, which
+// the frontend shows, and the player can say they are ready to start or leave
+// the queue.
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Status of the room we are waiting in, pushed by the matchmaking server.
+type LobbyStatus struct {
+	RoomId     int           // Id the room will have once started.
+	Waiting    int           // Players in the room, bots included.
+	Ready      int           // Players ready to start, bots included.
+	Capacity   int           // Players at which the room starts straight away.
+	MinPlayers int           // Players needed for the room to start when the timer fires.
+	StartsIn   time.Duration // Until the room's timer fires.
+	Log        []byte        `json:"-"`
+}
+
+type LobbyArgs struct {
+	RpcIp string
+	Ready bool
+	Log   []byte
+}
+
+var lobbyLock sync.Mutex
+var inQueue bool           // Are we waiting in the ms server's room.
+var isReady bool           // Did we tell the ms server we are ready to start.
+var lastLobby *LobbyStatus // Latest status of the room, nil when not waiting.
+
+// Remember that we joined the queue.
+func joinedQueue() {
+	lobbyLock.Lock()
+	defer lobbyLock.Unlock()
+	inQueue = true
+	isReady = false
+	lastLobby = nil
+}
+
+// Remember that we are no longer in the queue, because we left or because
+// our game started.
+func leftQueue() {
+	lobbyLock.Lock()
+	defer lobbyLock.Unlock()
+	inQueue = false
+	isReady = false
+	lastLobby = nil
+}
+
+// Return whether we are in the queue, whether we are ready, and the latest
+// status of the room.
+func queueState() (bool, bool, *LobbyStatus) {
+	lobbyLock.Lock()
+	defer lobbyLock.Unlock()
+	return inQueue, isReady, lastLobby
+}
+
+// This RPC function is called by the ms server with the status of the room
+// we are waiting in.
+func (nc *NodeService) LobbyUpdate(args *LobbyStatus, response *ValReply) error {
+	logReceive("Rpc Called LobbyUpdate", args.Log)
+	lobbyLock.Lock()
+	if !inQueue {
+		lobbyLock.Unlock()
+		return nil
+	}
+	lastLobby = args
+	lobbyLock.Unlock()
+
+	frontend.LobbyUpdate(args)
+	return nil
+}
+
+// Tell the ms server whether we are ready to start. Once every human player
+// is ready, the room starts without waiting for its timer.
+func setReady(ready bool) error {
+	lobbyLock.Lock()
+	if !inQueue {
+		lobbyLock.Unlock()
+		return errors.New("not in the queue")
+	}
+
+	reply := &ValReply{}
+	log := logSend("Rpc Call Context.SetReady to " + msServerAddr)
+	err := msService.Call("Context.SetReady",
+		&LobbyArgs{RpcIp: nodeRpcAddr, Ready: ready, Log: log}, reply)
+	if err != nil {
+		lobbyLock.Unlock()
+		return err
+	}
+	isReady = ready
+	status := lastLobby
+	lobbyLock.Unlock()
+
+	msLog.Info("Ready", "ready", ready)
+	if status != nil {
+		frontend.LobbyUpdate(status)
+	}
+	return nil
+}
+
+// Leave the ms server's queue.
+func leaveQueue() error {
+	lobbyLock.Lock()
+	if !inQueue {
+		lobbyLock.Unlock()
+		return errors.New("not in the queue")
+	}
+
+	reply := &ValReply{}
+	log := logSend("Rpc Call Context.Leave to " + msServerAddr)
+	err := msService.Call("Context.Leave", &LobbyArgs{RpcIp: nodeRpcAddr, Log: log}, reply)
+	if err != nil {
+		lobbyLock.Unlock()
+		return err
+	}
+	msService.Close()
+	inQueue = false
+	isReady = false
+	lastLobby = nil
+	lobbyLock.Unlock()
+
+	msLog.Info("Left the queue")
+	frontend.LobbyUpdate(nil)
+	return nil
+}
+
+// Join the ms server's queue again after leaving it.
+func rejoinQueue() {
+	if _, isPlaying := game.playing(); isPlaying {
+		return
+	}
+	if in, _, _ := queueState(); in {
+		return
+	}
+	msLog.Info("Joining the queue again")
+	msRpcDial()
+}
@@ -1,44 +1,227 @@
 package main
 
-// This file provides utilities for logging.
+// This file provides utilities for logging. The tracer picked with -trace
+// timestamps the messages exchanged with other nodes (see trace.go). Everything
+// else goes through leveled, structured loggers, one per subsystem, which write
+// logfmt (or JSON with -logformat json) to stderr and to the -local.txt file.
+// Every record carries the node's address and subsystem and, during a game, the
+// node's id, the game's id and the tick. The local file is rotated once it
+// grows past -logmaxsize megabytes, and with -admintoken the level can be
+// changed while running at /loglevel (see debug.go).
 
 import (
-	"github.com/arcaneiceman/GoVector/govec"
-	"log"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
 	"os"
 	"strings"
-	"time"
+	"sync"
+	"sync/atomic"
 )
 
-type Msg struct {
-	RealTimestamp string
+const LOG_LEVEL_PATH string = "/loglevel"
+
+var logLevel = new(slog.LevelVar) // Level of every logger, can be changed while running.
+var logFormat string              // "logfmt" or "json".
+var logMaxSize int                // Megabytes the local log grows to before it is rotated, 0 to never rotate.
+var logBackups int                // Rotated local logs to keep.
+var consoleMuted int32            // Set when the terminal frontend draws over stderr.
+
+// What the records of a game are tagged with, as of its last tick.
+type gameTags struct {
+	node string
+	game int
+	tick int
 }
 
-var Logger *govec.GoLog
-var fileLogger *log.Logger
+var tags atomic.Value // The gameTags of the game being played, once it starts.
+
+// Loggers of each subsystem, set up by initLogging.
+var (
+	gameLog   *slog.Logger // Ticks, moves, deaths and the end of the game.
+	netLog    *slog.Logger // Packets to and from peers, and peer failures.
+	authLog   *slog.Logger // Signing and encryption of packets.
+	msLog     *slog.Logger // Talking to the matchmaking server.
+	uiLog     *slog.Logger // The browser, terminal and headless frontends.
+	replayLog *slog.Logger
+	cheatLog  *slog.Logger
+	botLog    *slog.Logger
+	opsLog    *slog.Logger // Metrics and log levels.
+)
 
 func initLogging() {
 	// Windows doesn't accept colons in paths, so we filter them out here.
 	logFileName := strings.Replace(nodeAddr, ":", "", -1)
-	Logger = govec.Initialize(nodeAddr, logFileName)
 
-	localLogFile, err := os.Create(logFileName + "-local.txt")
-	checkErr(err, 24)
-	fileLogger = log.New(localLogFile, "", 0)
+	localLogFile, err := openRotatingFile(logFileName+"-local.txt", int64(logMaxSize)<<20, logBackups)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to open the local log:", err)
+		os.Exit(1)
+	}
+	out := io.MultiWriter(consoleWriter{}, localLogFile)
+	options := &slog.HandlerOptions{Level: logLevel}
+	var handler slog.Handler = slog.NewTextHandler(out, options)
+	if logFormat == "json" {
+		handler = slog.NewJSONHandler(out, options)
+	}
+
+	root := slog.New(gameHandler{handler}).With("addr", nodeAddr)
+	gameLog = root.With("subsystem", "game")
+	netLog = root.With("subsystem", "net")
+	authLog = root.With("subsystem", "auth")
+	msLog = root.With("subsystem", "ms")
+	uiLog = root.With("subsystem", "ui")
+	replayLog = root.With("subsystem", "replay")
+	cheatLog = root.With("subsystem", "cheat")
+	botLog = root.With("subsystem", "bot")
+	opsLog = root.With("subsystem", "ops")
+
+	tracer, err = newTracer(traceKind, logFileName)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start tracing:", err)
+		os.Exit(1)
+	}
+}
+
+// Check the -loglevel, -logformat and -trace flags.
+func checkLogFlags(level string) error {
+	if err := logLevel.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	if logFormat != "logfmt" && logFormat != "json" {
+		return fmt.Errorf("unknown log format %q", logFormat)
+	}
+	if logMaxSize < 0 || logBackups < 0 {
+		return fmt.Errorf("log size and backups cannot be negative")
+	}
+	if !isTraceKind(traceKind) {
+		return fmt.Errorf("unknown tracer %q", traceKind)
+	}
+	return nil
 }
 
 func logSend(msg string) []byte {
-	outgoingMessage := Msg{time.Now().String()}
-	return Logger.PrepareSend(msg, outgoingMessage)
+	return tracer.Send(msg)
+}
+
+func logReceive(msg string, buf []byte) {
+	tracer.Receive(msg, buf)
+}
+
+// Adds the fields of the game being played to every record.
+type gameHandler struct {
+	slog.Handler
+}
+
+func (h gameHandler) Handle(ctx context.Context, r slog.Record) error {
+	if t := loadTags(&tags); t.game != 0 {
+		r.AddAttrs(slog.String("node", t.node), slog.Int("game", t.game), slog.Int("tick", t.tick))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h gameHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return gameHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h gameHandler) WithGroup(name string) slog.Handler {
+	return gameHandler{h.Handler.WithGroup(name)}
+}
+
+// Tag the records of the game with its node, id and tick, so that handlers
+// don't need the mutex. Called with mutex held.
+func (g *Game) tagLogs() {
+	t := gameTags{node: g.nodeId, game: g.gameId, tick: g.tick}
+	g.tags.Store(t)
+	if g == game {
+		tags.Store(t)
+	}
+}
+
+// The tags stored in v, zero until a game starts.
+func loadTags(v *atomic.Value) gameTags {
+	t, _ := v.Load().(gameTags)
+	return t
+}
+
+// Writes to stderr, unless the console is muted.
+type consoleWriter struct{}
+
+func (consoleWriter) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(&consoleMuted) == 1 {
+		return len(p), nil
+	}
+	return os.Stderr.Write(p)
+}
+
+// Stop logging to stderr, so logs aren't drawn over the terminal frontend.
+func muteConsole() {
+	atomic.StoreInt32(&consoleMuted, 1)
+}
+
+// A log file that is rotated once it grows past maxSize: the previous file
+// is renamed to path.1, the one before to path.2, and so on up to backups.
+type rotatingFile struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64
+	backups int
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64, backups int) (*rotatingFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	return &rotatingFile{path: path, maxSize: maxSize, backups: backups, file: file}, nil
+}
+
+// Write a record, rotating the file first if the record would make it too big.
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
 }
 
-func logReceive(msg string, buf []byte) *Msg {
-	incommingMessage := new(Msg)
-	Logger.UnpackReceive(msg, buf[:], &incommingMessage)
-	return incommingMessage
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	for i := f.backups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.backups > 0 {
+		os.Rename(f.path, f.path+".1")
+	}
+	file, err := os.Create(f.path)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.size = 0
+	return nil
 }
 
-func localLog(v ...interface{}) {
-	log.Println(v)
-	fileLogger.Println(time.Now().Format("2006-01-02 15:04:05.000"), v)
+// Show the log level, or change it with a POST or PUT of level=debug, info,
+// warn or error.
+func serveLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost || r.Method == http.MethodPut {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(r.FormValue("level"))); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logLevel.Set(level)
+		opsLog.Info("Log level changed", "level", level)
+	}
+	fmt.Fprintln(w, logLevel.Level())
 }
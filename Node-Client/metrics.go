@@ -0,0 +1,185 @@
+package main
+
+// This file exposes the node's metrics for Prometheus to scrape, in its text
+// format, at /metrics on the http server and on the -metrics address. The few
+// metric types needed are implemented here rather than pulling in the
+// Prometheus client library.
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const METRICS_PATH string = "/metrics"
+
+// A counter or a gauge, with a value for each value of its label. Metrics
+// without a label have a single value.
+type metric struct {
+	name   string
+	help   string
+	kind   string // "counter" or "gauge".
+	label  string // Name of the label, "" for none.
+	lock   sync.Mutex
+	values map[string]float64 // Label value to the metric's value.
+}
+
+// Counts of observed values, in buckets.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64 // Upper bounds of the buckets, increasing.
+	lock    sync.Mutex
+	counts  []uint64 // Observations in each bucket, not cumulative.
+	sum     float64
+	count   uint64
+}
+
+type exporter interface {
+	export(w io.Writer)
+}
+
+var registry []exporter // Every metric, in the order they are exported.
+
+var (
+	packetsSent     = newMetric("gotron_node_packets_sent_total", "Packets sent, by message type.", "counter", "type")
+	packetsReceived = newMetric("gotron_node_packets_received_total", "Packets received and accepted, by message type.", "counter", "type")
+	packetsDropped  = newMetric("gotron_node_packets_dropped_total", "Packets dropped, by message type; unknown when it couldn't be read.", "counter", "type")
+	decodeErrors    = newMetric("gotron_node_decode_errors_total", "Packets that couldn't be decoded.", "counter", "")
+	leaderChanges   = newMetric("gotron_node_leader_changes_total", "Times the leader failed and the next node took over.", "counter", "")
+	failures        = newMetric("gotron_node_failures_detected_total", "Peers this node found to have failed.", "counter", "")
+	leaderLag       = newMetric("gotron_node_leader_lag_ticks", "Ticks this node is behind the leader, as of the leader's last packet.", "gauge", "")
+	tickDuration    = newHistogram("gotron_node_tick_duration_seconds", "Time taken to compute a tick.",
+		[]float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5})
+	gameDuration = newHistogram("gotron_node_game_duration_seconds", "Time from the start of a game to its end.",
+		[]float64{10, 30, 60, 120, 300, 600, 1200})
+)
+
+var metricsAddr string // Where to serve the metrics, on top of the http server.
+
+func newMetric(name string, help string, kind string, label string) *metric {
+	m := &metric{name: name, help: help, kind: kind, label: label, values: make(map[string]float64)}
+	registry = append(registry, m)
+	return m
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	registry = append(registry, h)
+	return h
+}
+
+// Add to the value of a label, or to the value of a metric without a label
+// when labelValue is "".
+func (m *metric) add(labelValue string, v float64) {
+	m.lock.Lock()
+	m.values[labelValue] += v
+	m.lock.Unlock()
+}
+
+func (m *metric) inc(labelValue string) {
+	m.add(labelValue, 1)
+}
+
+func (m *metric) set(labelValue string, v float64) {
+	m.lock.Lock()
+	m.values[labelValue] = v
+	m.lock.Unlock()
+}
+
+func (m *metric) export(w io.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	if m.label == "" {
+		fmt.Fprintf(w, "%s %v\n", m.name, m.values[""])
+		return
+	}
+	labelValues := make([]string, 0, len(m.values))
+	for labelValue := range m.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %v\n", m.name, m.label, escapeLabel(labelValue), m.values[labelValue])
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) export(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %v\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// Name the type of a message, for the packet metrics.
+func messageType(m *Message) string {
+	switch {
+	case m.IsSpectate:
+		return "spectate"
+	case m.Spectator != nil:
+		return "spectator_update"
+	case m.Summary != nil:
+		return "summary"
+	case m.IsDeathReport:
+		return "death_report"
+	case m.IsDirectionChange:
+		return "direction_change"
+	case m.GameHistory != nil:
+		return "game_state"
+	case m.Shrink != nil:
+		return "sudden_death"
+	case m.IsDraw:
+		return "draw"
+	case m.IsLeader:
+		return "leader_update"
+	}
+	return "update"
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range registry {
+		m.export(w)
+	}
+}
+
+// Serve the metrics, and the log level and the debug endpoints, on their own
+// address, for nodes without an http server.
+func metricsServe(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(METRICS_PATH, serveMetrics)
+	registerDebug(mux)
+	opsLog.Info("Serving metrics", "addr", addr+METRICS_PATH)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		opsLog.Error("Metrics server error", "err", err)
+	}
+}
@@ -10,21 +10,43 @@ import (
 	"strconv"
 )
 
-type NodeService int
+// Serves the ms server's RPCs to the game.
+type NodeService struct {
+	game *Game
+}
 
 type ValReply struct {
 	Val string
+	Log []byte
+}
+
+// Rules for the game, decided by the matchmaking server.
+type GameOptions struct {
+	WrapAround    bool // Leaving one edge of the board re-enters from the opposite edge.
+	Teams         int  // Number of teams, 0 for free for all.
+	FriendlyFire  bool // Colliding with a teammate's trail is lethal.
+	TrailLength   int  // Maximum number of cells in a trail, 0 for no limit.
+	TrailLifetime int  // Number of ticks before a trail cell fades, 0 to never fade.
+
+	SuddenDeathTick int // Tick at which the board starts to shrink, 0 for never.
+	ShrinkInterval  int // Number of ticks between two rings of the board closing.
+	MaxTicks        int // Number of ticks after which the game is a draw, 0 for no limit.
 }
 
 type GameArgs struct {
-	NodeList []*Node
-	Log      []byte
+	NodeList   []*Node
+	Options    GameOptions
+	SessionKey []byte // Key to sign messages to peers with.
+	PeerKey    []byte // Key to encrypt packets to peers with, empty if they aren't encrypted.
+	RoomId     int    // Id of the game, to tag logs with.
+	Log        []byte
 }
 
 type NodeJoin struct {
-	RpcIp string
-	Ip    string
-	Log   []byte
+	RpcIp   string
+	Ip      string
+	Profile Profile
+	Log     []byte
 }
 
 var nodeRpcAddr string
@@ -33,41 +55,57 @@ var msService *rpc.Client
 
 // This RPC function is triggered when a game is ready to begin.
 func (nc *NodeService) StartGame(args *GameArgs, response *ValReply) error {
-	nodes = args.NodeList
+	g := nc.game
 	logReceive("Rpc Called Start Game to "+msServerAddr, args.Log)
-	if len(nodes) > MAX_PLAYERS {
+	if len(args.NodeList) > MAX_PLAYERS {
 		return errors.New("MS Server returned a node list with more than the " +
 			"max number of supported players")
 	}
+	if len(args.SessionKey) == 0 {
+		return errors.New("MS Server didn't send a session key")
+	}
 
-	localLog("Starting game with nodes: " + printNodes())
-	findMyNode()
-
-	if msService == nil {
-		return errors.New("msService somehow still not setup")
+	g.mutex.Lock()
+	g.nodes = args.NodeList
+	g.gameOptions = args.Options
+	g.gameId = args.RoomId
+	g.startAuth(args.SessionKey)
+	if err := g.startEncryption(args.PeerKey); err != nil {
+		g.mutex.Unlock()
+		return err
+	}
+	msLog.Info("Starting game", "nodes", g.printNodes())
+	msLog.Info("Game options", "options", g.gameOptions)
+	g.findMyNode()
+	g.mutex.Unlock()
+
+	// Games started by the tests never joined through an ms server.
+	if msService != nil {
+		msService.Close()
 	}
-	msService.Close()
 
-	startGame()   // in node.go, call when rpc is working
-	startGameUI() // in httpServer.go, transition to game screen on the client.
+	leftQueue()
+	g.startGame()        // in node.go, call when rpc is working
+	frontend.StartGame() // transition to game screen on the client.
 	return nil
 }
 
-func findMyNode() {
-	for i, node := range nodes {
-		if node.Ip == nodeAddr {
-			myNode = node
-			nodeId = node.Id
-			nodeIndex = strconv.Itoa(i + 1)
+// Called with mutex held.
+func (g *Game) findMyNode() {
+	for i, node := range g.nodes {
+		if node.Ip == g.nodeAddr {
+			g.myNode = node
+			g.nodeId = node.Id
+			g.nodeIndex = strconv.Itoa(i + 1)
 		}
 	}
 }
 
 // Print node in the list
-func printNodes() string {
+func (g *Game) printNodes() string {
 	result := ""
-	for _, n := range nodes {
-		result += n.Ip + " "
+	for _, n := range g.nodes {
+		result += n.Profile.Name + "@" + n.Ip + " "
 	}
 	return result
 }
@@ -75,7 +113,7 @@ func printNodes() string {
 // This RPC function serves as a way for the Matchmaking service to send text to this node.
 func (nc *NodeService) Message(args *GameArgs, response *ValReply) error {
 	logReceive("Rpc Called Message", args.Log)
-	localLog("Received message:" + response.Val)
+	msLog.Debug("Received message", "val", response.Val)
 	return nil
 }
 
@@ -85,27 +123,53 @@ func msRpcServe() {
 	localAddr, err := net.ResolveTCPAddr("tcp", nodeRpcAddr)
 	checkErr(err, 78)
 
-	nodeService := new(NodeService)
+	nodeService := &NodeService{game: game}
 	rpc.Register(nodeService)
-	nodeListener, err := net.Listen("tcp", localAddr.String())
+	nodeListener, err := listenRPC(localAddr.String())
 	checkErr(err, 83)
 
-	localLog("Listening for ms server at ", localAddr.String())
-	conn, err := nodeListener.Accept()
-	checkErr(err, 87)
-	go rpc.ServeConn(conn)
+	msLog.Info("Listening for ms server", "addr", localAddr.String())
+	// The ms server dials again if we leave the queue and join it again.
+	for {
+		conn, err := nodeListener.Accept()
+		checkErr(err, 87)
+		go rpc.ServeConn(conn)
+	}
 }
 
-func msRpcDial() {
-	remoteAddr, e := net.ResolveTCPAddr("tcp", msServerAddr)
-	checkErr(e, 93)
+// Join the ms server's queue. If it turns us away (its queue is full, we are
+// banned, or our name is taken...), the player is told and we stay out of the
+// queue, so they can try again.
+func msRpcDial() error {
+	err := joinMs()
+	if err != nil {
+		msLog.Error("The ms server turned us away", "err", err)
+		frontend.QueueError(err)
+		return err
+	}
+	joinedQueue()
+	return nil
+}
 
-	msService, e = rpc.Dial("tcp", remoteAddr.String())
-	checkErr(e, 96)
+// Dial the ms server and ask it for a place in its queue.
+func joinMs() error {
+	remoteAddr, err := net.ResolveTCPAddr("tcp", msServerAddr)
+	if err != nil {
+		return err
+	}
+	client, err := dialRPC(remoteAddr.String())
+	if err != nil {
+		return err
+	}
 
 	var reply *ValReply = &ValReply{Val: ""}
 	log := logSend("Rpc Call Context.Join to " + msServerAddr)
-	err := msService.Call("Context.Join",
-		&NodeJoin{RpcIp: nodeRpcAddr, Ip: nodeAddr, Log: log}, reply)
-	checkErr(err, 101)
+	err = client.Call("Context.Join",
+		&NodeJoin{RpcIp: nodeRpcAddr, Ip: nodeAddr, Profile: profile, Log: log}, reply)
+	if err != nil {
+		client.Close()
+		return err
+	}
+	msService = client
+	return nil
 }
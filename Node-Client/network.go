@@ -0,0 +1,62 @@
+package main
+
+// This file abstracts the two things a game depends on besides its peers: the
+// network packets go over, and the clock the game loops and the failure
+// detector run on. Nodes use UDP and the system clock; the tests swap in a
+// simulated network that can drop, delay, duplicate, reorder and partition
+// packets, and a clock they move forward themselves, so a game plays the same
+// way every time (see simnet_test.go).
+
+import (
+	"net"
+	"time"
+)
+
+// Carries packets between nodes.
+type Network interface {
+	// Send a packet to the node listening at addr.
+	Send(addr string, data []byte) error
+	// Listen for packets sent to addr.
+	Listen(addr string) (net.PacketConn, error)
+}
+
+// Tells the time, and wakes loops up.
+type Clock interface {
+	Now() time.Time
+	// Return a channel the time is sent on once d has passed.
+	After(d time.Duration) <-chan time.Time
+}
+
+var network Network = udpNetwork{}
+var clock Clock = systemClock{}
+
+type udpNetwork struct{}
+
+func (udpNetwork) Send(addr string, data []byte) error {
+	// a random port is picked since we can't listen and read at the same time
+	udpConn, err := net.Dial("udp", addr)
+	if err != nil {
+		return err
+	}
+	defer udpConn.Close()
+	_, err = udpConn.Write(data)
+	return err
+}
+
+func (udpNetwork) Listen(addr string) (net.PacketConn, error) {
+	localAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenUDP("udp", localAddr)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -4,13 +4,16 @@ package main
 // game state logic.
 
 import (
-	"encoding/json"
+	"context"
+	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -23,9 +26,11 @@ type Pos struct {
 type Node struct {
 	Id        string
 	Ip        string // udp port this node is listening to
+	Team      int    // team assigned by the ms server, 0 when playing free for all
 	CurrLoc   *Pos
 	Direction string
 	IsAlive   bool
+	Profile   Profile // The player's id, name and colour, checked by the ms server.
 }
 
 // Message to be passed among nodes.
@@ -36,7 +41,13 @@ type Message struct {
 	FailedNodes       []string            // id of disconnected nodes.
 	Node              Node                // interval update struct node or dead node.
 	GameHistory       map[string]([]*Pos) // history of at most 5 ticks
-	Log               []byte
+	Turn              *Turn               // turn queued by the node, for a direction change, its tick relative to the sender's.
+	Shrink            *ShrinkSchedule     // when the rings of the board close, once sudden death starts.
+	IsDraw            bool                // did the game end in a draw.
+	IsSpectate        bool                // is this a spectator subscribing to the game.
+	Spectator         *SpectatorUpdate    // game state streamed by the leader to spectators.
+	Summary           *GameSummary        // every player's statistics, sent by the leader once the game is over.
+	Log               []byte              `json:",omitempty"` // stamp of the tracer, if it stamps messages.
 }
 
 const (
@@ -54,54 +65,165 @@ const (
 	enforceGameStateRate time.Duration = 2000 * time.Millisecond
 )
 
-// Game variables.
-var isPlaying bool        // Is the game in session.
-var imAlive bool          // Am I alive.
-var nodeId string         // Name of client.
-var nodeIndex string      // Player number (1 - 6).
 var nodeAddr string       // IP of client.
 var httpServerAddr string // HTTP Server IP.
-var nodes []*Node         // All nodes in the game.
-var myNode *Node          // My node.
 
-var nodeHistory map[string][]*Pos // Id to list of 5 recent local locations of each player
-var aliveNodes int                // Number of alive nodes.
+// The game as a node plays it. A node plays the one in game, but the tests
+// play several nodes in the same process, each with a Game of its own.
+type Game struct {
+	mutex    sync.Mutex     // For the game's state.
+	network  Network        // What the game's packets go over.
+	clock    Clock          // What the game's loops run on.
+	conn     net.PacketConn // Where peers' packets arrive, once the game started.
+	done     chan struct{}  // Closed once the game is stopped.
+	stopOnce sync.Once
+	tags     atomic.Value // gameTags as of the last tick, read without the mutex.
+
+	isPlaying   bool        // Is the game in session.
+	imAlive     bool        // Am I alive.
+	gameId      int         // Id of the game, from the ms server.
+	gameOptions GameOptions // Rules of the game, from the ms server.
+	startTime   time.Time   // When the game started, for gameDuration.
+	nodeId      string      // Name of client.
+	nodeIndex   string      // Player number (1 - 6).
+	nodeAddr    string      // IP of client.
+	nodes       []*Node     // All nodes in the game.
+	myNode      *Node       // My node.
+
+	nodeHistory map[string][]*Pos // Id to list of 5 recent local locations of each player
+	aliveNodes  int               // Number of alive nodes.
+
+	// #LEADER specific.
+	failedNodes []string          // id of failed nodes found.
+	gameHistory map[string][]*Pos // Last five moves of every node in the game. Written ONLY by the leader.
+
+	board       [BOARD_SIZE][BOARD_SIZE]string
+	lastCheckin map[string]time.Time
+
+	trailState
+	turnState
+	suddenDeathState
+	spectatorState
+	statsState
+	cheatState
+	authState
+	peerState
+	recordingState
+	debugState
+}
 
-// #LEADER specific.
-var failedNodes []string          // id of failed nodes found.
-var gameHistory map[string][]*Pos // Last five moves of every node in the game. Written ONLY by the leader.
+var game *Game // The game this node plays, nil for spectators and replays.
 
 // Sync variables.
 var waitGroup sync.WaitGroup // For internal processes.
-var mutex *sync.Mutex        // For global vars.
 
-var board [BOARD_SIZE][BOARD_SIZE]string
 var initialDirections map[string]string // Initial directions for all players.
 var initialPositions map[string]*Pos    // Initial positions for all players.
-var lastCheckin map[string]time.Time
 
 func main() {
-	if len(os.Args) != 5 {
-		log.Println("usage: NodeClient [nodeAddr] [nodeRpcAddr] [msServerAddr] [httpServerAddr]")
+	flag.StringVar(&botLevel, "bot", "", "play as a bot of the given difficulty (easy, medium or hard)")
+	flag.BoolVar(&isHeadless, "headless", false, "play without a browser, reading turns from stdin")
+	flag.StringVar(&scriptPath, "script", "", "in headless mode, read turns from this file instead of stdin")
+	flag.BoolVar(&isSpectator, "spectate", false, "watch a game being played instead of playing")
+	flag.BoolVar(&isTerminal, "terminal", false, "play in the terminal instead of the browser")
+	flag.StringVar(&replayPath, "replay", "", "watch a replay file instead of playing")
+	flag.StringVar(&profileName, "name", "", "display name shown to the other players")
+	flag.StringVar(&profileColour, "colour", "", "preferred colour, as #rrggbb")
+	flag.StringVar(&profilePath, "profile", "", "keep the player's profile in this file, to keep the same player id")
+	flag.StringVar(&tlsCert, "tlscert", "", "certificate to talk to the ms server over TLS with, signed by -tlsca")
+	flag.StringVar(&tlsKey, "tlskey", "", "key of the -tlscert certificate")
+	flag.StringVar(&tlsCA, "tlsca", "", "CA that signs the certificates of the ms server and every node")
+	flag.StringVar(&metricsAddr, "metrics", "", "also serve the metrics for Prometheus on this ip:port")
+	level := flag.String("loglevel", "info", "least severe logs to write (debug, info, warn or error)")
+	flag.StringVar(&logFormat, "logformat", "logfmt", "format of the logs (logfmt or json)")
+	flag.IntVar(&logMaxSize, "logmaxsize", 10, "megabytes the local log grows to before it is rotated, 0 to never rotate")
+	flag.IntVar(&logBackups, "logbackups", 3, "rotated local logs to keep")
+	flag.StringVar(&traceKind, "trace", TRACE_GOVEC, "how to trace messages (govec for ShiViz, spans, or none)")
+	flag.StringVar(&adminTokenPath, "admintoken", "", "serve the debug endpoints and the log level to requests with the token in this file")
+	flag.Parse()
+	if err := checkLogFlags(*level); err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+
+	// Nodes without a browser don't need an http server, and replays only
+	// need the http server.
+	noBrowser := botLevel != "" || isHeadless || isTerminal
+	validArgs := flag.NArg() == 4 || (noBrowser && flag.NArg() == 3)
+	if replayPath != "" {
+		validArgs = flag.NArg() == 1 && !noBrowser && !isSpectator
+	}
+	if !validArgs || (botLevel != "" && !isBotLevel(botLevel)) ||
+		(scriptPath != "" && !isHeadless) || (isSpectator && noBrowser) ||
+		(isTerminal && (botLevel != "" || isHeadless)) {
+		log.Println("usage: NodeClient [-bot easy|medium|hard | -headless [-script file] | -terminal | -spectate] [-name name] [-colour #rrggbb] [-profile file] [-tlscert file -tlskey file -tlsca file] [-metrics addr] [-loglevel level] [-logformat logfmt|json] [-trace govec|spans|none] [-admintoken file] [nodeAddr] [nodeRpcAddr] [msServerAddr] [httpServerAddr]")
+		log.Println("       NodeClient -replay file [httpServerAddr]")
+		log.Println("[-bot] play as a bot instead of opening the browser")
+		log.Println("[-headless] play without a browser, reading turns from stdin (or the -script file) and writing game events to stdout")
+		log.Println("[-terminal] play in the terminal, with WASD or the arrow keys")
+		log.Println("[-spectate] watch a game in the browser instead of playing")
+		log.Println("[-replay] watch a game recorded in a replay file")
+		log.Println("[-name] [-colour] the name and colour other players see, kept in the -profile file if given")
+		log.Println("[-tlscert] [-tlskey] [-tlsca] talk to the ms server over TLS, with a certificate signed by the CA")
+		log.Println("[-metrics] serve the metrics for Prometheus at /metrics on this ip:port, on top of the http server")
+		log.Println("[-loglevel] [-logformat] the least severe logs to write, and their format; see -help for rotation")
+		log.Println("[-trace] stamp messages with GoVector's vector clocks for ShiViz, record them as spans, or neither")
+		log.Println("[-admintoken] serve the state of the node and pprof profiles under /debug/, and the log level at /loglevel, to requests with the token in this file")
 		log.Println("[nodeAddr] the udp ip:port node is listening to")
 		log.Println("[nodeRpcAddr] the rpc ip:port node is hosting for ms server")
 		log.Println("[msServerAddr] the rpc ip:port of matchmaking server node is connecting to")
-		log.Println("[httpServerAddr] the ip:port the http server is binded to ")
+		log.Println("[httpServerAddr] the ip:port the http server is binded to, optional with -bot, -headless or -terminal")
 		os.Exit(1)
 	}
 
-	nodeAddr, nodeRpcAddr, msServerAddr = os.Args[1], os.Args[2], os.Args[3]
+	if replayPath != "" {
+		nodeAddr = "replay" // Only used to name the logs.
+		httpServerTcpAddr, err := net.ResolveTCPAddr("tcp", flag.Arg(0))
+		checkErr(err, 96)
+		httpServerAddr = httpServerTcpAddr.String()
+	} else {
+		nodeAddr, nodeRpcAddr, msServerAddr = flag.Arg(0), flag.Arg(1), flag.Arg(2)
+	}
 
-	httpServerTcpAddr, err := net.ResolveTCPAddr("tcp", os.Args[4])
-	checkErr(err, 96)
-	httpServerAddr = httpServerTcpAddr.String()
+	if flag.NArg() == 4 {
+		httpServerTcpAddr, err := net.ResolveTCPAddr("tcp", flag.Arg(3))
+		checkErr(err, 96)
+		httpServerAddr = httpServerTcpAddr.String()
+	}
 
-	log.Println(nodeAddr, nodeRpcAddr, msServerAddr, httpServerAddr)
 	initLogging()
+	gameLog.Info("Starting node", "rpcAddr", nodeRpcAddr, "msAddr", msServerAddr, "httpAddr", httpServerAddr)
+	checkErr(setupTLS(), 103)
+	checkErr(loadAdminToken(), 107)
+	if metricsAddr != "" {
+		go metricsServe(metricsAddr)
+	}
+	if !isSpectator && replayPath == "" {
+		game = newGame(nodeAddr)
+		checkErr(loadProfile(), 104)
+		gameLog.Info("Playing as", "name", profile.Name, "playerId", profile.PlayerId, "colour", profile.Colour)
+	}
 
-	waitGroup.Add(2) // Add internal process.
-	go httpServe()
-	go msRpcServe()
+	waitGroup.Add(1) // Add internal process.
+	switch {
+	case botLevel != "":
+		frontend = noFrontend{}
+		go botServe()
+	case isHeadless:
+		frontend = newJSONFrontend(os.Stdout)
+		go headlessServe()
+	case isTerminal:
+		frontend = newTerminalFrontend()
+		go terminalServe()
+	default:
+		frontend = browserFrontend{}
+		go httpServe()
+	}
+	// Spectators and replays are never started by the ms server.
+	if !isSpectator && replayPath == "" {
+		waitGroup.Add(1)
+		go msRpcServe()
+	}
 	waitGroup.Wait() // Wait until processes are done.
 }
 
@@ -125,18 +247,27 @@ func init() {
 		"p6": &Pos{8, 5},
 	}
 
+	sessions = make(map[string]*session)
+}
+
+// Set up the game of the node listening at addr, until the ms server starts
+// it.
+func newGame(addr string) *Game {
+	g := &Game{network: network, clock: clock, done: make(chan struct{}), nodeAddr: addr}
 	for player, pos := range initialPositions {
-		board[pos.Y][pos.X] = player
+		g.board[pos.Y][pos.X] = player
 	}
 
-	nodeHistory = make(map[string][]*Pos)
-	nodes = make([]*Node, 0)
-
-	mutex = &sync.Mutex{}
-
-	gameHistory = make(map[string][]*Pos)
-	lastCheckin = make(map[string]time.Time)
-	failedNodes = make([]string, 0)
+	g.nodeHistory = make(map[string][]*Pos)
+	g.nodes = make([]*Node, 0)
+	g.gameHistory = make(map[string][]*Pos)
+	g.trails = make(map[string][]*TrailCell)
+	g.turnQueues = make(map[string][]*Turn)
+	g.spectators = make(map[string]time.Time)
+	g.scores = make(map[string]int)
+	g.lastCheckin = make(map[string]time.Time)
+	g.failedNodes = make([]string, 0)
+	return g
 }
 
 func intMax(a int, b int) int {
@@ -153,149 +284,290 @@ func intMin(a int, b int) int {
 	return b
 }
 
-func startGame() {
+func intAbs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// Wrap a coordinate that stepped off one edge of the board around to the
+// opposite edge.
+func wrapCoord(c int) int {
+	return (c%BOARD_SIZE + BOARD_SIZE) % BOARD_SIZE
+}
+
+// Return the position one step from x, y in the given direction.
+// On a wrap-around board this may cross the seam; otherwise it is clamped to
+// the board, so a node driving into a wall stays on its own (trailed) cell.
+func (g *Game) nextPosition(x int, y int, direction string) (int, int) {
+	switch direction {
+	case DIRECTION_UP:
+		y = y - 1
+	case DIRECTION_DOWN:
+		y = y + 1
+	case DIRECTION_LEFT:
+		x = x - 1
+	case DIRECTION_RIGHT:
+		x = x + 1
+	}
+
+	if g.gameOptions.WrapAround {
+		return wrapCoord(x), wrapCoord(y)
+	}
+	return intMin(BOARD_SIZE-1, intMax(0, x)), intMin(BOARD_SIZE-1, intMax(0, y))
+}
+
+// Return the step (1 or -1) to take to go from one coordinate to another.
+// On a wrap-around board the shorter way round is taken, even if it crosses
+// the seam.
+func (g *Game) stepToward(from int, to int) int {
+	step := 1
+	if to < from {
+		step = -1
+	}
+	if g.gameOptions.WrapAround && intAbs(to-from) > BOARD_SIZE/2 {
+		step = -step
+	}
+	return step
+}
+
+func (g *Game) startGame() {
+	g.mutex.Lock()
 	// Find myself and init variables.
-	for _, node := range nodes {
-		node.CurrLoc = initialPositions[node.Id]
+	for _, node := range g.nodes {
+		// Copied, since nodes move the positions they are given.
+		loc := *initialPositions[node.Id]
+		node.CurrLoc = &loc
 		node.Direction = initialDirections[node.Id]
 		node.IsAlive = true
-		lastCheckin[node.Id] = time.Now()
+		g.lastCheckin[node.Id] = g.clock.Now()
 	}
 
 	// Remove the node IDs of non-present players from the board.
-	for i := len(nodes) + 1; i <= MAX_PLAYERS; i++ {
+	for i := len(g.nodes) + 1; i <= MAX_PLAYERS; i++ {
 		pos, ok := initialPositions[fmt.Sprintf("p%d", i)]
 		if !ok {
 			continue
 		}
 
-		board[pos.Y][pos.X] = ""
+		g.board[pos.Y][pos.X] = ""
 	}
 
-	localLog("nodeId:", nodeId)
-	localLog("----INITIAL STATE----")
-	printBoard()
-	localLog("----INITIAL STATE----")
+	gameLog.Info("Initial state")
+	g.printBoard()
 
 	// ================================================= //
 
-	imAlive = true
-	isPlaying = true
-	aliveNodes = len(nodes)
+	g.imAlive = true
+	g.isPlaying = true
+	g.aliveNodes = len(g.nodes)
+	g.startRecording()
+	g.startStats()
+	g.startCheatDetection()
+	g.startTime = g.clock.Now()
+	g.tagLogs()
 
-	go listenUDPPacket()
-	go intervalUpdate()
-	go tickGame()
-	go handleNodeFailure()
-	go enforceGameState()
+	conn, err := g.network.Listen(g.nodeAddr)
+	checkErr(err, 644)
+	if udpConn, ok := conn.(*net.UDPConn); ok {
+		err = udpConn.SetReadBuffer(9000)
+		checkErr(err, 646)
+	}
+	g.conn = conn
+	g.mutex.Unlock()
+
+	go g.listenUDPPacket(conn)
+	go g.intervalUpdate()
+	go g.tickGame()
+	go g.handleNodeFailure()
+	go g.enforceGameState()
+}
+
+// Stop the game's loops and stop listening to peers, as if the node was
+// killed.
+func (g *Game) stop() {
+	g.stopOnce.Do(func() {
+		close(g.done)
+		g.mutex.Lock()
+		if g.conn != nil {
+			g.conn.Close()
+		}
+		g.mutex.Unlock()
+	})
+}
+
+// Sleep for d on the game's clock. Return false, sooner, if the game is
+// stopped.
+func (g *Game) sleep(d time.Duration) bool {
+	select {
+	case <-g.clock.After(d):
+		return true
+	case <-g.done:
+		return false
+	}
+}
+
+// Return the tick, and whether the game is in session.
+func (g *Game) playing() (int, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.tick, g.isPlaying
+}
+
+// Check if the player can turn: the game is in session and we are alive.
+func (g *Game) canTurn() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.isPlaying && g.myNode != nil && g.myNode.IsAlive
+}
+
+// Return the direction the player heads in, empty until the game starts.
+func (g *Game) myDirection() string {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.myNode == nil {
+		return ""
+	}
+	return g.myNode.Direction
 }
 
 // Update the board based on leader's history
-func UpdateBoard() {
-	mutex.Lock()
-	fmt.Println("Updating Board")
-	localLog("Received gameHistory from Leader")
+func (g *Game) UpdateBoard() {
+	g.mutex.Lock()
+	gameLog.Debug("Received gameHistory from Leader")
 
 	// Clear everything on the board except our head
-	for _, v := range nodeHistory {
-		for _, e := range v {
-			board[e.Y][e.X] = ""
+	for id, v := range g.nodeHistory {
+		for i, e := range v {
+			if i == 0 {
+				g.board[e.Y][e.X] = ""
+			} else {
+				g.eraseTrail(id, e.X, e.Y)
+			}
 		}
 	}
 	// Color board based on Leader's hitory
-	for id, _ := range gameHistory {
-		buf := []byte(id)
-		playerIndex := string(buf[1])
-
-		localLog(id)
-		// for _, p := range nodeHistory[id] {
-		for _, p := range gameHistory[id] {
-			localLog(*p)
-		}
-
-		// Apply Leader's History onto the board
-		for i, pos := range gameHistory[id] {
+	for id, _ := range g.gameHistory {
+		gameLog.Debug("Leader's history", "peer", id, "moves", formatMoves(g.gameHistory[id]))
+
+		// Apply Leader's History onto the board, laying the trail oldest
+		// first so it keeps its order.
+		history := g.gameHistory[id]
+		for i := len(history) - 1; i >= 0; i-- {
+			pos := history[i]
 			if i == 0 {
 				// Check if History's head is the same as our head
-				board[pos.Y][pos.X] = getPlayerState(id)
-				peerNode := getNode(id)
-				peerNode.CurrLoc.X = pos.X
-				peerNode.CurrLoc.Y = pos.Y
+				g.board[pos.Y][pos.X] = g.getPlayerState(id)
+				// The leader may not know yet that we removed a failed node.
+				if peerNode := g.getNode(id); peerNode != nil {
+					peerNode.CurrLoc.X = pos.X
+					peerNode.CurrLoc.Y = pos.Y
+					g.recordMove(peerNode)
+				}
 			} else {
-				board[pos.Y][pos.X] = "t" + playerIndex
+				g.layTrailAtTick(id, pos.X, pos.Y, g.tick-i)
 			}
 		}
 	}
-	mutex.Unlock()
+	g.mutex.Unlock()
 }
 
 // Each tick of the game
-func tickGame() {
+func (g *Game) tickGame() {
 	for {
-		if isPlaying {
-			mutex.Lock()
-			for _, node := range nodes {
-				playerIndex := string(node.Id[len(node.Id)-1])
+		g.mutex.Lock()
+		if g.isPlaying {
+			tickStart := time.Now()
+			for _, node := range g.nodes {
+				if node.IsAlive {
+					g.applyQueuedTurn(node)
+				}
 				direction := node.Direction
 				x := node.CurrLoc.X
 				y := node.CurrLoc.Y
-				new_x := node.CurrLoc.X
-				new_y := node.CurrLoc.Y
+				var new_x, new_y int
 
 				// only predict for live nodes
-				if isPlaying && node.IsAlive {
+				if g.isPlaying && node.IsAlive {
+					g.scores[node.Id]++
+
 					// Path prediction
-					board[y][x] = "t" + playerIndex // Change position to be a trail.
-					switch direction {
-					case DIRECTION_UP:
-						new_y = intMax(0, y-1)
-					case DIRECTION_DOWN:
-						new_y = intMin(BOARD_SIZE-1, y+1)
-					case DIRECTION_LEFT:
-						new_x = intMax(0, x-1)
-					case DIRECTION_RIGHT:
-						new_x = intMin(BOARD_SIZE-1, x+1)
-					}
+					g.layTrail(node.Id, x, y) // Change position to be a trail.
+					new_x, new_y = g.nextPosition(x, y, direction)
 
-					if nodeHasCollided(x, y, new_x, new_y) {
-						localLog("NODE " + node.Id + " IS DEAD")
-						if isLeader() && node.Id == nodeId && node.IsAlive {
+					if g.nodeHasCollided(node.Id, x, y, new_x, new_y) {
+						g.statsCollision(node.Id, new_x, new_y)
+						gameLog.Info("NODE IS DEAD", "peer", g.playerName(node.Id))
+						if g.isLeader() && node.Id == g.nodeId && node.IsAlive {
 							node.IsAlive = false
-							aliveNodes = aliveNodes - 1
-							localLog("IM LEADER AND IM DEAD REPORTING TO FRONT END")
-							notifyPlayerDeathToJS()
-							reportASorrowfulDeathToPeers(node)
-						} else if isLeader() {
+							g.aliveNodes = g.aliveNodes - 1
+							g.recordDeath(node)
+							g.statsDeath(node)
+							gameLog.Info("IM LEADER AND IM DEAD REPORTING TO FRONT END")
+							frontend.PlayerDead()
+							g.reportASorrowfulDeathToPeers(node)
+						} else if g.isLeader() {
 							// we tell peers who the dead node is.
 							node.IsAlive = false
-							aliveNodes = aliveNodes - 1
-							localLog("Leader sending death report ", node.Id)
-							reportASorrowfulDeathToPeers(node)
+							g.aliveNodes = g.aliveNodes - 1
+							g.recordDeath(node)
+							g.statsDeath(node)
+							gameLog.Info("Leader sending death report", "peer", g.playerName(node.Id))
+							g.reportASorrowfulDeathToPeers(node)
 						}
 						// We don't update the position to a new value
-						board[y][x] = getPlayerState(node.Id)
-						if haveIWon() {
-							localLog("Leader won")
+						g.removeTrailCell(node.Id, x, y)
+						g.board[y][x] = g.getPlayerState(node.Id)
+						if g.haveIWon() {
+							gameLog.Info("Leader won")
 							break
 						}
 					} else {
 						// Update player's new position.
-						board[new_y][new_x] = getPlayerState(node.Id)
+						g.board[new_y][new_x] = g.getPlayerState(node.Id)
 						node.CurrLoc.X = new_x
 						node.CurrLoc.Y = new_y
+						g.statsMove(node.Id, new_x, new_y)
 					}
 				}
 			}
-			mutex.Unlock()
+			g.fadeTrails()
+			if g.isPlaying {
+				if g.isLeader() {
+					g.startSuddenDeath()
+					g.checkMaxDuration()
+				}
+				g.closeRings()
+			}
+			g.tick++
+			g.tagLogs()
+			tickDuration.observe(time.Since(tickStart).Seconds())
+			g.mutex.Unlock()
+		} else if g.tick > 0 && len(g.nodes) > 0 {
+			// The game is over.
+			leader := g.isLeader()
+			g.mutex.Unlock()
+			g.finishStats()
+			if leader {
+				g.saveReplay()
+			}
+		} else {
+			g.mutex.Unlock()
+		}
+		g.renderGame()
+		if botLevel != "" {
+			g.botMove()
+		}
+		if !g.sleep(tickRate) {
+			return
 		}
-		renderGame()
-		time.Sleep(tickRate)
 	}
 }
 
 // Change Position of a node by creating a trail from its previous location.
 // (Predicting a path from a given prev location and new location).
-func updateLocationOfNode(fromCurrent *Node, to *Node) {
+func (g *Game) updateLocationOfNode(fromCurrent *Node, to *Node) {
 	currentDir := fromCurrent.Direction
 	newDir := to.Direction
 
@@ -304,424 +576,438 @@ func updateLocationOfNode(fromCurrent *Node, to *Node) {
 	}
 
 	if currentDir == DIRECTION_UP || currentDir == DIRECTION_DOWN {
-		matchPositionInAxis(AXIS_Y, false, fromCurrent, to)
-		matchPositionInAxis(AXIS_X, true, fromCurrent, to)
+		g.matchPositionInAxis(AXIS_Y, false, fromCurrent, to)
+		g.matchPositionInAxis(AXIS_X, true, fromCurrent, to)
 	} else {
-		matchPositionInAxis(AXIS_X, false, fromCurrent, to)
-		matchPositionInAxis(AXIS_Y, true, fromCurrent, to)
+		g.matchPositionInAxis(AXIS_X, false, fromCurrent, to)
+		g.matchPositionInAxis(AXIS_Y, true, fromCurrent, to)
 	}
 
 	fromCurrent.Direction = newDir
+	g.recordMove(fromCurrent)
 }
 
 // Match position of current node to the new position in the
 // given axis direction and whether to draw or delete trail.
 // Axis is one of:
-//		- AXIS_X
-//		- AXIS_Y
-func matchPositionInAxis(axis int, draw bool, from *Node, to *Node) {
-	nodeName := from.Id
+//   - AXIS_X
+//   - AXIS_Y
+func (g *Game) matchPositionInAxis(axis int, draw bool, from *Node, to *Node) {
 	fromX := from.CurrLoc.X
 	fromY := from.CurrLoc.Y
 	toX := to.CurrLoc.X
 	toY := to.CurrLoc.Y
 
-	nodeTrail := ""
-	if draw {
-		nodeTrail = "t" + nodeName[len(nodeName)-1:]
+	matchCell := func(x int, y int) {
+		if draw {
+			g.layTrail(from.Id, x, y)
+		} else {
+			g.eraseTrail(from.Id, x, y)
+		}
 	}
 
-	nodePlayer := getPlayerState(from.Id)
+	nodePlayer := g.getPlayerState(from.Id)
 
 	if axis == AXIS_X { // Match X axis.
 		i := fromX
-		increment := -1
-		if toX > fromX {
-			increment = 1
-		}
+		increment := g.stepToward(fromX, toX)
 		for i != toX {
-			board[fromY][i] = nodeTrail
-			i = increment + i
+			matchCell(i, fromY)
+			i = wrapCoord(increment + i)
 		}
-		board[fromY][i] = nodePlayer
+		g.board[fromY][i] = nodePlayer
 		from.CurrLoc.X = toX
 	} else { // Match Y axis.
 		i := fromY
-		increment := -1
-		if toY > fromY {
-			increment = 1
-		}
+		increment := g.stepToward(fromY, toY)
 		for i != toY {
-			board[fromY][i] = nodeTrail
-			i = increment + i
+			matchCell(fromX, i)
+			i = wrapCoord(increment + i)
 		}
-		board[i][fromX] = nodePlayer
+		g.board[i][fromX] = nodePlayer
 		from.CurrLoc.Y = toY
 	}
 }
 
 // Check if a node has collided into a trail, wall, or another node.
-func nodeHasCollided(oldX int, oldY int, newX int, newY int) bool {
-	// Wall boundaries.
-	if newX < 0 || newY < 0 || newX > BOARD_SIZE || newY > BOARD_SIZE {
+func (g *Game) nodeHasCollided(id string, oldX int, oldY int, newX int, newY int) bool {
+	// Wall boundaries. There are none on a wrap-around board.
+	if !g.gameOptions.WrapAround &&
+		(newX < 0 || newY < 0 || newX >= BOARD_SIZE || newY >= BOARD_SIZE) {
 		return true
 	}
 	// Collision with another player or trail.
-	if board[newY][newX] != "" {
+	if g.board[newY][newX] != "" && !g.isTeammateTrail(id, g.board[newY][newX]) {
 		return true
 	}
 	return false
 }
 
+// Check if a cell holds the trail of a teammate of the given node. Without
+// friendly fire, nodes can safely run over their teammates' trails.
+func (g *Game) isTeammateTrail(id string, cell string) bool {
+	if g.gameOptions.Teams == 0 || g.gameOptions.FriendlyFire || cell[0] != 't' {
+		return false
+	}
+	self := g.getNode(id)
+	owner := g.getNode("p" + cell[1:])
+	return self != nil && owner != nil && self.Id != owner.Id && self.Team == owner.Team
+}
+
 // Renders the game.
-func renderGame() {
-	mutex.Lock()
-	if isLeader() {
-		go collectLast7Moves()
+func (g *Game) renderGame() {
+	g.mutex.Lock()
+	if g.isLeader() {
+		g.collectLast7Moves()
+		g.sendSpectatorUpdates()
 	} else {
 		// Only non-leader nodes have to do this
-		go cacheLocation()
+		g.cacheLocation()
 	}
-	printBoard()
-	pushGameStateToJS(board)
-	mutex.Unlock()
+	g.printBoard()
+	frontend.GameStateUpdate(g.board)
+	g.mutex.Unlock()
 }
 
 // NON-LEADER: Build a history of last 5 moves for node on the board.
-func cacheLocation() {
-	mutex.Lock()
+// Called with mutex held.
+func (g *Game) cacheLocation() {
 	// Collect the state of nodes on the board as the 'TRUE' state.
-	for _, node := range nodes {
-		// Clear the list.
-		nodeHistory[node.Id] = make([]*Pos, 0)
-
-		// Put in current location.
-		nodeHistory[node.Id] = append(nodeHistory[node.Id], node.CurrLoc)
-
-		i := 1
-		xPos := node.CurrLoc.X
-		yPos := node.CurrLoc.Y
-		trail := "t" + string(node.Id[len(node.Id)-1])
-		for i < 5 {
-			p := findTrail(xPos, yPos, trail, nodeHistory[node.Id])
-			if p != nil {
-				nodeHistory[node.Id] = append(nodeHistory[node.Id], p)
-				xPos = p.X
-				yPos = p.Y
-			} else {
-				break
-			}
-			i++
-		}
+	for _, node := range g.nodes {
+		g.nodeHistory[node.Id] = g.recentMoves(node, 5)
 
-		localLog("Cache of node ", node.Id, "with len", len(nodeHistory[node.Id]))
-		for _, p := range nodeHistory[node.Id] {
-			localLog(*p)
-		}
+		gameLog.Debug("Cache of node", "peer", node.Id, "moves", formatMoves(g.nodeHistory[node.Id]))
 	}
-	mutex.Unlock()
 }
 
 // LEADER: Build a history of last 7 moves for node on the board.
-func collectLast7Moves() {
+// Called with mutex held.
+func (g *Game) collectLast7Moves() {
 	// Collect the state of nodes on the board as the 'TRUE' state.
-	for _, node := range nodes {
-		// Clear the list.
-		gameHistory[node.Id] = make([]*Pos, 0)
-
-		// Put in current location.
-		gameHistory[node.Id] = append(gameHistory[node.Id], node.CurrLoc)
-
-		i := 1
-		xPos := node.CurrLoc.X
-		yPos := node.CurrLoc.Y
-		trail := "t" + string(node.Id[len(node.Id)-1])
-		for i < 7 {
-			p := findTrail(xPos, yPos, trail, gameHistory[node.Id])
-			if p != nil {
-				gameHistory[node.Id] = append(gameHistory[node.Id], p)
-				xPos = p.X
-				yPos = p.Y
-			} else {
-				break
-			}
-			i++
-		}
-
-		localLog("History of node ", node.Id, "with len", len(gameHistory[node.Id]))
-		for _, p := range gameHistory[node.Id] {
-			localLog(*p)
-		}
-	}
-}
+	for _, node := range g.nodes {
+		g.gameHistory[node.Id] = g.recentMoves(node, 7)
 
-// Find the next unvisited trail around the x, y position on the board.
-// Return nil if trail cannot be found.
-func findTrail(x int, y int, trail string, visited []*Pos) *Pos {
-	if y > 0 && board[y-1][x] == trail && !contains(x, y-1, visited) {
-		return &Pos{X: x, Y: y - 1}
-	} else if y < BOARD_SIZE && board[y+1][x] == trail && !contains(x, y+1, visited) {
-		return &Pos{X: x, Y: y + 1}
-	} else if x > 0 && board[y][x-1] == trail && !contains(x-1, y, visited) {
-		return &Pos{X: x - 1, Y: y}
-	} else if x < BOARD_SIZE && board[y][x+1] == trail && !contains(x+1, y, visited) {
-		return &Pos{X: x + 1, Y: y}
-	} else {
-		return nil
+		gameLog.Debug("History of node", "peer", node.Id, "moves", formatMoves(g.gameHistory[node.Id]))
 	}
 }
 
-// Check if x y is a position already in the list.
-func contains(x int, y int, list []*Pos) bool {
-	for _, p := range list {
-		if p.X == x && p.Y == y {
-			return true
-		}
-	}
-	return false
-}
-
 // Continuously send game history of at most 5 previous ticks to all nodes
 // Do it even if game ends because the last standing node might not communicate to other peers
-func enforceGameState() {
-	for {
-		time.Sleep(enforceGameStateRate)
-		if isLeader() {
-			mutex.Lock()
-			message := &Message{IsLeader: true, GameHistory: gameHistory, Node: *myNode}
-			mutex.Unlock()
+func (g *Game) enforceGameState() {
+	for g.sleep(enforceGameStateRate) {
+		g.mutex.Lock()
+		if g.isLeader() {
+			message := &Message{IsLeader: true, GameHistory: g.gameHistory,
+				Shrink: g.shrinkSchedule, IsDraw: g.isDraw, Node: *g.myNode}
 			logMsg := "Leader enforcing game state packet with game history"
-			sendPacketsToPeers(logMsg, message)
-			localLog(logMsg, message)
+			g.sendPacketsToPeers(logMsg, message)
+			netLog.Debug(logMsg)
+
+			// Keep sending the summary, in case a packet is lost.
+			if summary := g.summaryMessage(); summary != nil {
+				g.sendPacketsToPeers("Leader sending game summary", summary)
+			}
 		}
+		g.mutex.Unlock()
 	}
 }
 
 // Update peers with node's current location.
-func intervalUpdate() {
+func (g *Game) intervalUpdate() {
 	for {
-		if imAlive == false || isPlaying == false {
+		g.mutex.Lock()
+		if g.imAlive == false || g.isPlaying == false {
+			g.mutex.Unlock()
 			return
 		}
-		var message *Message
-		if isLeader() {
-			mutex.Lock()
-			message = &Message{IsLeader: true, FailedNodes: failedNodes, Node: *myNode}
-			mutex.Unlock()
-		} else {
-			message = &Message{Node: *myNode}
+		message := &Message{Node: *g.myNode}
+		if g.isLeader() {
+			message = &Message{IsLeader: true, FailedNodes: g.failedNodes, Node: *g.myNode}
 		}
 		logMsg := "Interval update"
-		sendPacketsToPeers(logMsg, message)
-		time.Sleep(intervalUpdateRate)
+		g.sendPacketsToPeers(logMsg, message)
+		g.mutex.Unlock()
+		if !g.sleep(intervalUpdateRate) {
+			return
+		}
 	}
 }
 
-func sendPacketsToPeers(logMsg string, message *Message) {
-	for _, node := range nodes {
-		if node.Id != nodeId {
+// Called with mutex held.
+func (g *Game) sendPacketsToPeers(logMsg string, message *Message) {
+	for _, node := range g.nodes {
+		if node.Id != g.nodeId {
 			log := logSend("Sending: " + logMsg + " [to: " + node.Id + " at ip " + node.Ip + "]")
 			message.Log = log
-			nodeJson, err := json.Marshal(message)
+			nodeJson, err := g.signMessage(message)
 			checkErr(err, 548)
-			go sendUDPPacket(node.Ip, nodeJson)
+			nodeJson, err = g.sealPacket(nodeJson)
+			checkErr(err, 549)
+			packetsSent.inc(messageType(message))
+			g.recordPacket("out", messageType(message), node.Id, len(nodeJson), "")
+			go g.sendUDPPacket(node.Ip, nodeJson)
 		}
 	}
 }
 
-// Send data to ip via UDP.
-func sendUDPPacket(ip string, data []byte) {
-	// a random port is picked since we can't listen and read at the same time
-	udpConn, err := net.Dial("udp", ip)
+// Send data to ip over the network, UDP outside of the tests.
+func (g *Game) sendUDPPacket(ip string, data []byte) {
+	err := g.network.Send(ip, data)
 	checkErr(err, 559)
-	defer udpConn.Close()
-
-	_, err = udpConn.Write(data)
-	checkErr(err, 563)
 }
 
-func processPacket(buf []byte, addr *net.UDPAddr, n int) {
-	var message Message
+func (g *Game) processPacket(packet []byte, addr *net.UDPAddr) {
 	var node Node
-	err := json.Unmarshal(buf[0:n], &message)
-	checkErr(err, 570)
+	message, reason := g.verifyPacket(packet, addr)
+	if message == nil {
+		netLog.Warn("Dropping packet", "peer", addr.String(), "reason", reason)
+		packetsDropped.inc("unknown")
+		g.recordPacket("in", "unknown", addr.String(), len(packet), reason)
+		return
+	}
 	node = message.Node
+	packetsReceived.inc(messageType(message))
+	g.recordPacket("in", messageType(message), node.Id, len(packet), "")
 
-	logReceive("Received packet from "+addr.String()+": "+string(buf[0:n]), message.Log)
-	localLog("Received: Id:", node.Id, "Ip:", node.Ip, "X:",
-		node.CurrLoc.X, "Y:", node.CurrLoc.Y, "Dir:", node.Direction)
-	lastCheckin[node.Id] = time.Now()
+	logReceive("Received packet from "+addr.String()+": "+string(packet), message.Log)
+	if message.IsSpectate {
+		g.addSpectator(node.Ip)
+		return
+	}
+	netLog.Debug("Received", "peer", node.Id, "type", messageType(message), "ip", node.Ip,
+		"x", node.CurrLoc.X, "y", node.CurrLoc.Y, "dir", node.Direction)
+	g.mutex.Lock()
+	g.lastCheckin[node.Id] = g.clock.Now()
+	g.mutex.Unlock()
 
 	if message.IsLeader {
 		// FailedNodes communication.
 		if message.FailedNodes != nil {
-			localLog("failedNodes are: ", message.FailedNodes)
+			netLog.Info("Leader reported failed nodes", "failed", message.FailedNodes)
+			g.mutex.Lock()
 			for _, n := range message.FailedNodes {
-				removeNodeFromList(n)
+				g.removeNodeFromList(n)
 			}
+			g.mutex.Unlock()
 		}
 
 		// Check if message.History exist
 		if message.GameHistory != nil {
 			// Cache history info from the leader
-			gameHistory = message.GameHistory
-			UpdateBoard()
+			g.mutex.Lock()
+			g.gameHistory = message.GameHistory
+			g.mutex.Unlock()
+			g.UpdateBoard()
+		}
+
+		if message.Shrink != nil {
+			g.receiveShrinkSchedule(message.Shrink)
+		}
+
+		if message.IsDraw {
+			g.mutex.Lock()
+			g.endInDraw()
+			g.mutex.Unlock()
+		}
+
+		if message.Summary != nil {
+			g.receiveSummary(message.Summary)
 		}
 	}
 
 	if message.IsDeathReport {
-		localLog("Received death report ", node.Id)
-		mutex.Lock()
+		g.mutex.Lock()
+		gameLog.Info("Received death report", "peer", g.playerName(node.Id))
 		// update local copy
-		for _, n := range nodes {
+		for _, n := range g.nodes {
 			if n.Id == node.Id && n.IsAlive {
 				n.IsAlive = false
-				localLog("LEADER SENT: ", n.Id, " IS DEAD")
-				aliveNodes = aliveNodes - 1
-				localLog("**** DEATH REPORT *** size is now ", strconv.Itoa(aliveNodes))
-				board[n.CurrLoc.Y][n.CurrLoc.X] = getPlayerState(n.Id)
+				gameLog.Info("LEADER SENT: IS DEAD", "peer", g.playerName(n.Id))
+				g.recordDeath(n)
+				g.statsDeath(n)
+				g.aliveNodes = g.aliveNodes - 1
+				gameLog.Info("Death report applied", "alive", g.aliveNodes)
+				g.board[n.CurrLoc.Y][n.CurrLoc.X] = g.getPlayerState(n.Id)
 
 				// Check if its me.
-				if node.Id == nodeId {
-					localLog("OH SHOOT ITS ME")
-					notifyPlayerDeathToJS()
+				if node.Id == g.nodeId {
+					gameLog.Info("OH SHOOT ITS ME")
+					frontend.PlayerDead()
 				}
 			}
 		}
 
-		if haveIWon() {
-			mutex.Unlock()
-			renderGame()
+		if g.haveIWon() {
+			g.mutex.Unlock()
+			g.renderGame()
 			return
 		}
-		mutex.Unlock()
+		g.mutex.Unlock()
 	}
 
 	// Received a direction change from a peer.
 	// Match the state of peer by predicting its path.
-	if message.IsDirectionChange {
-		mutex.Lock()
-		for _, n := range nodes {
-			if n.Id == message.Node.Id {
-				n.Direction = message.Node.Direction
-			}
-		}
-		mutex.Unlock()
+	if message.IsDirectionChange && message.Turn != nil {
+		g.mutex.Lock()
+		g.queuePeerTurn(message.Node.Id, message.Turn)
+		g.mutex.Unlock()
 	}
-	mutex.Lock()
-	mNode := getNode(message.Node.Id)
-	updateLocationOfNode(mNode, &message.Node)
-	mutex.Unlock()
+	g.mutex.Lock()
+	mNode := g.getNode(message.Node.Id)
+	if g.acceptReport(mNode, &message.Node) {
+		g.updateLocationOfNode(mNode, &message.Node)
+	} else {
+		packetsDropped.inc(messageType(message))
+	}
+	g.mutex.Unlock()
 }
 
-func listenUDPPacket() {
-	localAddr, err := net.ResolveUDPAddr("udp", nodeAddr)
-	checkErr(err, 642)
-	udpConn, err := net.ListenUDP("udp", localAddr)
-	checkErr(err, 644)
-	err = udpConn.SetReadBuffer(9000)
-	checkErr(err, 646)
-	defer udpConn.Close()
+func (g *Game) listenUDPPacket(conn net.PacketConn) {
+	defer conn.Close()
 
-	buf := make([]byte, 1024)
+	buf := make([]byte, 8192) // Large enough for the game summary, even encrypted.
 
 	for {
-		n, addr, err := udpConn.ReadFromUDP(buf)
+		n, addr, err := conn.ReadFrom(buf)
+		select {
+		case <-g.done:
+			return
+		default:
+		}
 		checkErr(err, 653)
-		go processPacket(buf, addr, n)
-		time.Sleep(100 * time.Millisecond)
+		// Copied, since the next packet is read into buf.
+		go g.processPacket(append([]byte(nil), buf[0:n]...), addr.(*net.UDPAddr))
 	}
 }
 
-// LEADER: Tell nodes someone has died.
-func reportASorrowfulDeathToPeers(node *Node) {
+// LEADER: Tell nodes someone has died. Called with mutex held.
+func (g *Game) reportASorrowfulDeathToPeers(node *Node) {
 	msg := &Message{IsDeathReport: true, Node: *node}
 	logMsg := "Node " + node.Id + "is dead, reporting sorrowful death"
-	sendPacketsToPeers(logMsg, msg)
+	g.sendPacketsToPeers(logMsg, msg)
 }
 
-func haveIWon() bool {
-	// stop playing when someone has won
-	if myNode.IsAlive && aliveNodes == 1 {
-		localLog("I WIN")
-		notifyPlayerVictoryToJS()
-		isPlaying = false
+func (g *Game) haveIWon() bool {
+	// stop playing when only one team has survivors. In a team game, everyone
+	// on that team wins, including those who have died.
+	survivors := g.survivingTeams()
+	if len(survivors) > 1 {
+		return false
+	}
+
+	g.isPlaying = false
+	if len(survivors) == 0 {
+		gameLog.Info("Nobody won")
+		return false
+	}
+	if survivors[g.getTeam(g.myNode)] {
+		gameLog.Info("I WIN")
+		frontend.PlayerVictory()
 		return true
-	} else if aliveNodes == 1 {
-		localLog("Someone else won")
-		isPlaying = false
 	}
+	gameLog.Info("Someone else won")
 	return false
 }
 
-func notifyPeersDirChanged(direction string) {
-	mutex.Lock()
-	prevDirection := myNode.Direction
+// Return the set of teams that still have a live node.
+func (g *Game) survivingTeams() map[string]bool {
+	teams := make(map[string]bool)
+	for _, n := range g.nodes {
+		if n.IsAlive {
+			teams[g.getTeam(n)] = true
+		}
+	}
+	return teams
+}
+
+// Given a node, return the team it plays for. When playing free for all,
+// every node is its own team.
+func (g *Game) getTeam(n *Node) string {
+	if g.gameOptions.Teams == 0 {
+		return n.Id
+	}
+	return "team" + strconv.Itoa(n.Team)
+}
+
+func (g *Game) notifyPeersDirChanged(direction string) {
+	g.mutex.Lock()
+	prevDirection := g.lastQueuedDirection(g.myNode)
 
-	// check if the direction change for node with the id
-	if prevDirection != direction {
-		logMsg := "Direction for " + nodeId + " has changed from " +
-			prevDirection + " to " + direction
-		myNode.Direction = direction
+	// queue the turn, and tell peers how many ticks from now it is made
+	turn := g.queueMyTurn(direction)
+	if turn != nil {
+		logMsg := "Direction for " + g.nodeId + " will change from " +
+			prevDirection + " to " + direction + " at tick " + strconv.Itoa(turn.Tick)
 
-		msg := &Message{IsDirectionChange: true, Node: *myNode}
-		localLog(logMsg, msg)
-		sendPacketsToPeers(logMsg, msg)
+		msg := &Message{IsDirectionChange: true, Turn: g.turnForPeers(turn), Node: *g.myNode}
+		gameLog.Info("Turning", "from", prevDirection, "to", direction, "at", turn.Tick)
+		g.sendPacketsToPeers(logMsg, msg)
 	}
-	mutex.Unlock()
+	g.mutex.Unlock()
 }
 
-func isLeader() bool {
-	return nodes[0].Id == nodeId
+func (g *Game) isLeader() bool {
+	return len(g.nodes) > 0 && g.nodes[0].Id == g.nodeId
 }
 
-func hasExceededThreshold(nodeLastCheckin int64) bool {
+func (g *Game) hasExceededThreshold(nodeLastCheckin int64) bool {
 	// TODO gotta check the math : fix incoming.
 	threshold := nodeLastCheckin + (7000 * int64(time.Millisecond/time.Nanosecond))
-	now := time.Now().UnixNano()
+	now := g.clock.Now().UnixNano()
 	return threshold < now
 }
 
-func handleNodeFailure() {
+func (g *Game) handleNodeFailure() {
 	// check if the time it last checked in exceed CHECKIN_INTERVAL
 	for {
-		if isPlaying == false {
+		g.mutex.Lock()
+		if g.isPlaying == false {
+			g.mutex.Unlock()
 			return
 		}
-		if isLeader() {
-			localLog("Im a leader: ", nodeId)
-			for _, node := range nodes {
-				if node.Id != nodeId {
-					if hasExceededThreshold(lastCheckin[node.Id].UnixNano()) {
-						localLog(node.Id, " HAS FAILED")
+		if g.isLeader() {
+			netLog.Debug("Im a leader")
+			for _, node := range g.nodes {
+				if node.Id != g.nodeId {
+					if g.hasExceededThreshold(g.lastCheckin[node.Id].UnixNano()) {
+						netLog.Warn("Peer HAS FAILED", "peer", g.playerName(node.Id))
+						failures.inc("")
 						// --> leader should periodically send out active nodes in the system
 						// --> so here we just have to remove it from the nodes list.
-						failedNodes = append(failedNodes, node.Id)
-						localLog(len(failedNodes))
-						removeNodeFromList(node.Id)
+						g.failedNodes = append(g.failedNodes, node.Id)
+						netLog.Info("Failed nodes", "failed", g.failedNodes)
+						g.removeNodeFromList(node.Id)
 					}
 				}
 			}
 		} else {
-			localLog("Im a node: ", nodeId)
+			netLog.Debug("Im a node")
 			// Continually check if leader is alive.
-			leaderId := nodes[0].Id
-			if hasExceededThreshold(lastCheckin[leaderId].UnixNano()) {
-				localLog("LEADER ", leaderId, " HAS FAILED.")
-				removeNodeFromList(leaderId)
+			leaderId := g.nodes[0].Id
+			if g.hasExceededThreshold(g.lastCheckin[leaderId].UnixNano()) {
+				netLog.Warn("LEADER HAS FAILED", "peer", leaderId)
+				failures.inc("")
+				g.removeNodeFromList(leaderId)
 			}
 		}
-		time.Sleep(intervalUpdateRate)
+		g.mutex.Unlock()
+		if !g.sleep(intervalUpdateRate) {
+			return
+		}
 	}
 }
 
-// LEADER: removes a dead node from the node list.
-func removeNodeFromList(id string) {
+// LEADER: removes a dead node from the node list. Called with mutex held.
+func (g *Game) removeNodeFromList(id string) {
 	i := 0
-	for i < len(nodes) {
-		currentNode := nodes[i]
+	for i < len(g.nodes) {
+		currentNode := g.nodes[i]
 		if currentNode.Id == id {
-			nodes = append(nodes[:i], nodes[i+1:]...)
+			if i == 0 {
+				leaderChanges.inc("")
+			}
+			g.nodes = append(g.nodes[:i], g.nodes[i+1:]...)
+			g.recordEvent(&ReplayEvent{Type: REPLAY_FAIL, Id: id})
 		} else {
 			i++
 		}
@@ -729,8 +1015,8 @@ func removeNodeFromList(id string) {
 }
 
 // Given a node id string, return "p_" or "d_" depending on whether the player is alive.
-func getPlayerState(id string) string {
-	for _, n := range nodes {
+func (g *Game) getPlayerState(id string) string {
+	for _, n := range g.nodes {
 		if n.Id == id {
 			buf := []byte(id)
 			playerIndex := string(buf[1])
@@ -745,8 +1031,8 @@ func getPlayerState(id string) string {
 }
 
 // Given a node id string, return the node's location X, Y on the board.
-func getPlayerLocation(id string) (int, int) {
-	for _, n := range nodes {
+func (g *Game) getPlayerLocation(id string) (int, int) {
+	for _, n := range g.nodes {
 		if n.Id == id {
 			return n.CurrLoc.X, n.CurrLoc.Y
 		}
@@ -755,8 +1041,8 @@ func getPlayerLocation(id string) (int, int) {
 }
 
 // Given a node id string, return the node.
-func getNode(id string) *Node {
-	for _, n := range nodes {
+func (g *Game) getNode(id string) *Node {
+	for _, n := range g.nodes {
 		if n.Id == id {
 			return n
 		}
@@ -767,32 +1053,45 @@ func getNode(id string) *Node {
 // Error checking. Exit program when error occurs.
 func checkErr(err error, lineNum int) {
 	if err != nil {
-		localLog("line ", lineNum, " error:", err)
+		gameLog.Error("Fatal error", "line", lineNum, "err", err)
+		closeTerminal()
 		os.Exit(1)
 	}
 }
 
 // For debugging
-func printBoard() {
+func (g *Game) printBoard() {
+	if !gameLog.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
 	// TODO: Continous string concat is terrible, but this is OK for just
 	//       debugging for now. Get rid of it at some point in the future.
-	topLine := "  "
-	for i, _ := range board[0] {
+	topLine := ""
+	for i, _ := range g.board[0] {
 		topLine += fmt.Sprintf("%3d", i)
 	}
-	localLog(topLine, "")
-	for r, _ := range board {
-		// Ideally, we would introduce a localLog() variant that does Print()
-		// instead of Println(). However, Print() on log files seems to always
-		// introduce a new line, which is useless for what we're doing here.
+	gameLog.Debug("Board", "row", "  ", "cells", topLine)
+	for r, _ := range g.board {
 		line := ""
-		for _, item := range board[r] {
+		for _, item := range g.board[r] {
 			if item == "" {
 				line += "__ "
 			} else {
 				line += (item + " ")
 			}
 		}
-		localLog(fmt.Sprintf("%2d", r), line)
+		gameLog.Debug("Board", "row", fmt.Sprintf("%2d", r), "cells", line)
+	}
+}
+
+// Format moves for the logs, as "x,y x,y ...".
+func formatMoves(moves []*Pos) string {
+	result := ""
+	for i, p := range moves {
+		if i > 0 {
+			result += " "
+		}
+		result += fmt.Sprintf("%d,%d", p.X, p.Y)
 	}
+	return result
 }
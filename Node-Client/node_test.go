@@ -0,0 +1,476 @@
+package main
+
+// These tests play games between real nodes on a simulated network, with a
+// clock that only moves when the test says so (see simnet_test.go). Every
+// node is a Game of its own in this process, started through
+// NodeService.StartGame with the node list the ms server would send it. The
+// ms server is a main package of its own, so it is tested on its own, against
+// nodes in memory, in MatchMaking/MS_test.go.
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const FAILURE_TIMEOUT time.Duration = 7 * time.Second // See hasExceededThreshold.
+
+func TestMain(m *testing.M) {
+	discard := slog.New(slog.NewTextHandler(ioutil.Discard, nil))
+	gameLog, netLog, authLog, msLog, uiLog = discard, discard, discard, discard, discard
+	replayLog, cheatLog, botLog, opsLog = discard, discard, discard, discard
+	tracer = noopTracer{}
+	frontend = noFrontend{}
+	adminToken = []byte("test") // Keeps the packets for /debug/messages.
+	// Every player goes right, so that nobody runs into anybody early on.
+	for id := range initialDirections {
+		initialDirections[id] = DIRECTION_RIGHT
+	}
+
+	// Games write their replay to the working directory.
+	dir, err := ioutil.TempDir("", "gotron-test")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// A game between real nodes.
+type testGame struct {
+	t     *testing.T
+	clock *fakeClock
+	net   *simNetwork
+	nodes map[string]*Game // Id of each player to the node playing it.
+}
+
+func playerAddr(id string) string {
+	return "127.0.0.1:900" + id[1:]
+}
+
+// Start a game of the given number of players, each played by a node. The
+// game is stopped once the test is over.
+func startTestGame(t *testing.T, players int, seed int64) *testGame {
+	return startTestGameWith(t, players, seed, GameOptions{WrapAround: true, TrailLength: 1})
+}
+
+// Start a game with the given options.
+func startTestGameWith(t *testing.T, players int, seed int64, options GameOptions) *testGame {
+	tg := &testGame{t: t, clock: newFakeClock(), nodes: make(map[string]*Game)}
+	tg.net = newSimNetwork(tg.clock, seed)
+	ids := make([]string, 0, players)
+	for i := 1; i <= players; i++ {
+		id := "p" + string('0'+byte(i))
+		g := newGame(playerAddr(id))
+		g.network = tg.net.host(playerAddr(id))
+		g.clock = tg.clock
+		tg.nodes[id] = g
+		ids = append(ids, id)
+	}
+	t.Cleanup(tg.stop)
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	for _, id := range ids {
+		// Every node gets a node list of its own, as it would over rpc.
+		args := &GameArgs{Options: options, SessionKey: key, RoomId: 1}
+		for _, other := range ids {
+			args.NodeList = append(args.NodeList, &Node{Id: other, Ip: playerAddr(other),
+				Profile: Profile{Name: other}})
+		}
+		service := &NodeService{game: tg.nodes[id]}
+		if err := service.StartGame(args, &ValReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	settle()
+	return tg
+}
+
+// Play for d.
+func (tg *testGame) play(d time.Duration) {
+	tg.clock.Advance(d)
+}
+
+// Stop the node playing the player, as if its process was killed.
+func (tg *testGame) kill(id string) {
+	tg.nodes[id].stop()
+}
+
+// Stop every node.
+func (tg *testGame) stop() {
+	for _, g := range tg.nodes {
+		g.stop()
+	}
+	settle()
+}
+
+// The ids of the nodes a node has in the game, the leader first.
+func (tg *testGame) nodeIds(id string) string {
+	g := tg.nodes[id]
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	ids := make([]string, len(g.nodes))
+	for i, node := range g.nodes {
+		ids[i] = node.Id
+	}
+	return strings.Join(ids, ",")
+}
+
+// The packets a node accepted from a player, and those it dropped, by the
+// first word of the reason.
+func (tg *testGame) packetsFrom(to string, from string) (int, map[string]int) {
+	g := tg.nodes[to]
+	g.recentLock.Lock()
+	defer g.recentLock.Unlock()
+	accepted, dropped := 0, make(map[string]int)
+	for _, record := range g.recentPackets {
+		if record.Direction != "in" {
+			continue
+		}
+		if record.Dropped == "" && record.Peer == from {
+			accepted++
+		} else if record.Dropped != "" && record.Peer == playerAddr(from) {
+			dropped[strings.SplitN(record.Dropped, " ", 2)[0]]++
+		}
+	}
+	return accepted, dropped
+}
+
+// The number of packets a node sent a player.
+func (tg *testGame) packetsTo(from string, to string) int {
+	g := tg.nodes[from]
+	g.recentLock.Lock()
+	defer g.recentLock.Unlock()
+	sent := 0
+	for _, record := range g.recentPackets {
+		if record.Direction == "out" && record.Peer == to {
+			sent++
+		}
+	}
+	return sent
+}
+
+// Check every given node has the same nodes in the game.
+func (tg *testGame) expectNodes(want string, ids ...string) {
+	tg.t.Helper()
+	for _, id := range ids {
+		if got := tg.nodeIds(id); got != want {
+			tg.t.Errorf("%s has nodes %s, want %s", id, got, want)
+		}
+	}
+}
+
+// Every node moves every player the same way.
+func TestNodesAgree(t *testing.T) {
+	tg := startTestGame(t, 3, 1)
+	tg.play(5 * time.Second)
+	tg.expectNodes("p1,p2,p3", "p1", "p2", "p3")
+
+	positions := make(map[string]string)
+	for id, g := range tg.nodes {
+		g.mutex.Lock()
+		var where []string
+		for _, node := range g.nodes {
+			where = append(where, node.Id+"@"+formatMoves([]*Pos{node.CurrLoc}))
+		}
+		if played := g.clock.Now().Sub(g.startTime); played != 5*time.Second {
+			t.Errorf("%s has played for %v, want 5s", id, played)
+		}
+		g.mutex.Unlock()
+		positions[id] = strings.Join(where, " ")
+	}
+	for _, id := range []string{"p2", "p3"} {
+		if positions[id] != positions["p1"] {
+			t.Errorf("%s sees %s, p1 sees %s", id, positions[id], positions["p1"])
+		}
+	}
+}
+
+// The leader fails, then the next in line: the node after them takes over,
+// and the last node follows it. The same scenario as
+// test/nodefailures/test_leaderthenclientfailure.py.
+func TestLeaderThenClientFailure(t *testing.T) {
+	tg := startTestGame(t, 4, 1)
+	tg.play(3 * time.Second)
+	tg.expectNodes("p1,p2,p3,p4", "p1", "p2", "p3", "p4")
+
+	tg.kill("p1")
+	tg.kill("p2")
+	tg.play(FAILURE_TIMEOUT + 3*time.Second)
+	tg.expectNodes("p3,p4", "p3", "p4")
+	tg.nodes["p3"].mutex.Lock()
+	if !tg.nodes["p3"].isLeader() {
+		t.Errorf("p3 didn't take over as the leader")
+	}
+	tg.nodes["p3"].mutex.Unlock()
+
+	tg.play(FAILURE_TIMEOUT)
+	tg.expectNodes("p3,p4", "p3", "p4")
+}
+
+// The leader finds a follower failed, and tells the others.
+func TestClientFailure(t *testing.T) {
+	tg := startTestGame(t, 4, 1)
+	tg.play(2 * time.Second)
+
+	tg.kill("p2")
+	tg.play(FAILURE_TIMEOUT + 2*time.Second)
+	tg.expectNodes("p1,p3,p4", "p1", "p3", "p4")
+	leader := tg.nodes["p1"]
+	leader.mutex.Lock()
+	if failed := strings.Join(leader.failedNodes, ","); failed != "p2" {
+		t.Errorf("the leader found %q failed, want p2", failed)
+	}
+	leader.mutex.Unlock()
+}
+
+// A leader cut off by the network is as good as dead, and stays out of the
+// game once the network heals.
+func TestPartitionedLeader(t *testing.T) {
+	tg := startTestGame(t, 3, 1)
+	tg.play(2 * time.Second)
+
+	tg.net.partition(playerAddr("p1"))
+	tg.play(FAILURE_TIMEOUT + 2*time.Second)
+	tg.expectNodes("p2,p3", "p2", "p3")
+
+	tg.net.heal()
+	tg.play(3 * time.Second)
+	tg.expectNodes("p2,p3", "p2", "p3")
+}
+
+// Packets that arrive twice are only applied once.
+func TestDuplicatedPackets(t *testing.T) {
+	tg := startTestGame(t, 2, 1)
+	acceptedBefore, _ := tg.packetsFrom("p2", "p1")
+	tg.net.setFaults(0, 1, 0, 0)
+	tg.play(5 * time.Second)
+
+	accepted, dropped := tg.packetsFrom("p2", "p1")
+	accepted -= acceptedBefore
+	if accepted == 0 || dropped["replayed"] != accepted {
+		t.Errorf("p2 accepted %d packets from p1 and dropped %v, want as many replayed", accepted, dropped)
+	}
+}
+
+// Packets arriving out of order are all applied, as long as they are not too
+// late.
+func TestReorderedPackets(t *testing.T) {
+	tg := startTestGame(t, 2, 1)
+	// Packets sent before p2 listened never arrived.
+	sentBefore := tg.packetsTo("p1", "p2")
+	acceptedBefore, _ := tg.packetsFrom("p2", "p1")
+
+	tg.net.setFaults(0, 0, 0, 3*time.Second)
+	tg.play(10 * time.Second)
+	tg.net.setFaults(0, 0, 0, 0)
+	tg.play(3 * time.Second)
+
+	sent := tg.packetsTo("p1", "p2") - sentBefore
+	accepted, dropped := tg.packetsFrom("p2", "p1")
+	if accepted-acceptedBefore != sent || len(dropped) != 0 {
+		t.Errorf("p2 accepted %d of the %d packets from p1, and dropped %v", accepted-acceptedBefore,
+			sent, dropped)
+	}
+}
+
+// A lossy network doesn't make nodes look failed: it takes seven seconds of
+// lost updates in a row.
+func TestLossyNetwork(t *testing.T) {
+	tg := startTestGame(t, 4, 1)
+	tg.net.setFaults(0.3, 0.1, 0, 500*time.Millisecond)
+	tg.play(30 * time.Second)
+	tg.expectNodes("p1,p2,p3,p4", "p1", "p2", "p3", "p4")
+	if _, dropped, duplicated, _ := tg.net.counts(); dropped == 0 || duplicated == 0 {
+		t.Errorf("the network dropped %d packets and duplicated %d", dropped, duplicated)
+	}
+}
+
+// Spectators are only streamed to at the IP they subscribe from, and only so
+// many at once.
+func TestSpectators(t *testing.T) {
+	tg := startTestGame(t, 2, 1)
+	spectate := func(from string, claimed string) {
+		data, err := json.Marshal(&Message{IsSpectate: true, Node: Node{Ip: claimed}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tg.net.host(from).Send(playerAddr("p1"), data)
+		settle()
+	}
+	spectators := func() int {
+		leader := tg.nodes["p1"]
+		leader.mutex.Lock()
+		defer leader.mutex.Unlock()
+		return len(leader.spectators)
+	}
+
+	spectate("10.0.0.1:9100", "10.0.0.2:9100")
+	if n := spectators(); n != 0 {
+		t.Errorf("%d spectators once one subscribed someone else", n)
+	}
+	spectate("10.0.0.1:9100", "10.0.0.1:9100")
+	if n := spectators(); n != 1 {
+		t.Errorf("%d spectators once one subscribed, want 1", n)
+	}
+	for i := 0; i < MAX_SPECTATORS; i++ {
+		addr := fmt.Sprintf("10.0.1.%d:9100", i)
+		spectate(addr, addr)
+	}
+	if n := spectators(); n != MAX_SPECTATORS {
+		t.Errorf("%d spectators, want at most %d", n, MAX_SPECTATORS)
+	}
+}
+
+// Spectators only show updates from the players of the room they watch.
+func TestSpectatorUpdatesFromPlayers(t *testing.T) {
+	room := &Room{Id: 1, Players: []*Node{{Id: "p1", Ip: "10.0.0.1:9001"}, {Id: "p2", Ip: "10.0.0.2:9002"}}}
+	for addr, want := range map[string]bool{
+		"10.0.0.1:9001":  true,
+		"10.0.0.2:41234": true,
+		"10.0.0.3:9001":  false,
+	} {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := isRoomPlayerAddr(room, udpAddr); got != want {
+			t.Errorf("update from %s shown: %v, want %v", addr, got, want)
+		}
+	}
+}
+
+// Nodes don't tick in step, yet a turn is made at the same tick on every node.
+func TestTurnsAgree(t *testing.T) {
+	tg := startTestGame(t, 3, 1)
+	tg.play(time.Second)
+	tg.nodes["p2"].notifyPeersDirChanged(DIRECTION_DOWN)
+	tg.play(2 * time.Second)
+
+	var want string
+	for _, id := range []string{"p1", "p2", "p3"} {
+		g := tg.nodes[id]
+		g.mutex.Lock()
+		p2 := g.getNode("p2")
+		got := p2.Direction + "@" + formatMoves([]*Pos{p2.CurrLoc})
+		g.mutex.Unlock()
+		if p2.Direction != DIRECTION_DOWN {
+			t.Errorf("%s has p2 heading %s, want %s", id, p2.Direction, DIRECTION_DOWN)
+		}
+		if want == "" {
+			want = got
+		} else if got != want {
+			t.Errorf("%s has p2 at %s, p1 has it at %s", id, got, want)
+		}
+	}
+}
+
+// Turns a node couldn't have queued are dropped.
+func TestPeerTurnsValidated(t *testing.T) {
+	tg := startTestGame(t, 2, 1)
+	g := tg.nodes["p1"]
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, turn := range []*Turn{
+		{Direction: DIRECTION_RIGHT, Tick: 0},             // Already heading that way.
+		{Direction: DIRECTION_LEFT, Tick: 0},              // A reversal.
+		{Direction: DIRECTION_UP, Tick: MAX_QUEUED_TURNS}, // Too far ahead.
+		{Direction: DIRECTION_UP, Tick: -1},               // In the past.
+		{Direction: "X", Tick: 0},                         // Not a direction.
+	} {
+		g.queuePeerTurn("p2", turn)
+		if queue := g.turnQueues["p2"]; len(queue) != 0 {
+			t.Errorf("queued %+v as %+v", turn, queue[0])
+			g.turnQueues["p2"] = nil
+		}
+	}
+
+	g.queuePeerTurn("p2", &Turn{Direction: DIRECTION_UP, Tick: 1})
+	g.queuePeerTurn("p2", &Turn{Direction: DIRECTION_UP, Tick: 1})
+	g.queuePeerTurn("p2", &Turn{Direction: DIRECTION_LEFT, Tick: 0})
+	queue := g.turnQueues["p2"]
+	if len(queue) != 2 || queue[0].Tick != g.tick+1 || queue[1].Tick != g.tick+2 {
+		t.Errorf("queued %d turns, want two at ticks %d and %d", len(queue), g.tick+1, g.tick+2)
+	}
+}
+
+// A follower whose turn never reached the leader isn't taken for a cheater
+// once its next turn looks like a reversal to the leader.
+func TestLostTurnIsNotCheating(t *testing.T) {
+	tg := startTestGame(t, 2, 1)
+	tg.play(time.Second)
+	tg.net.partition(playerAddr("p2"))
+	tg.nodes["p2"].notifyPeersDirChanged(DIRECTION_UP)
+	tg.play(tickRate)
+	tg.nodes["p2"].notifyPeersDirChanged(DIRECTION_LEFT)
+	tg.play(tickRate)
+	tg.net.heal()
+	tg.play(5 * time.Second)
+
+	leader := tg.nodes["p1"]
+	leader.mutex.Lock()
+	defer leader.mutex.Unlock()
+	if n := leader.violations["p2"]; n > 1 {
+		t.Errorf("the leader counted %d violations from p2, want the lost turn counted once at most", n)
+	}
+	if p2 := leader.getNode("p2"); p2.Direction != DIRECTION_LEFT {
+		t.Errorf("the leader has p2 heading %s, want %s", p2.Direction, DIRECTION_LEFT)
+	}
+}
+
+// Rings close at the same ticks on every node, even one that hears of sudden
+// death late.
+func TestShrinkScheduleAgrees(t *testing.T) {
+	options := GameOptions{WrapAround: true, TrailLength: 1, SuddenDeathTick: 4, ShrinkInterval: 2}
+	tg := startTestGameWith(t, 3, 1, options)
+	tg.net.partition(playerAddr("p3"))
+	tg.play(3 * time.Second)
+	tg.net.heal()
+	tg.play(2 * time.Second)
+
+	want := fmt.Sprint([]int{4, 6, 8, 10})
+	for _, id := range []string{"p1", "p2", "p3"} {
+		g := tg.nodes[id]
+		g.mutex.Lock()
+		if g.shrinkSchedule == nil {
+			t.Errorf("%s has no shrink schedule", id)
+		} else if got := fmt.Sprint(g.shrinkSchedule.Rings); got != want {
+			t.Errorf("%s closes rings at ticks %s, want %s", id, got, want)
+		}
+		g.mutex.Unlock()
+	}
+}
+
+// Replays that can't be simulated are rejected, and a node that dies and
+// fails on the same tick is simply gone from the replay.
+func TestMalformedReplay(t *testing.T) {
+	nodes := []*Node{{Id: "p1", CurrLoc: &Pos{X: 1, Y: 1}, Direction: DIRECTION_RIGHT},
+		{Id: "p2", CurrLoc: &Pos{X: 1, Y: 3}, Direction: DIRECTION_RIGHT},
+		{Id: "p3", CurrLoc: &Pos{X: 1, Y: 5}, Direction: DIRECTION_RIGHT}}
+	for _, event := range []*ReplayEvent{{Tick: 1, Type: REPLAY_DEATH}, {Tick: 1, Type: REPLAY_MOVE, Id: "p1"}} {
+		if err := checkReplay(&Replay{Nodes: nodes, Events: []*ReplayEvent{event}}); err == nil {
+			t.Errorf("a %s event with id %q and position %v was accepted", event.Type, event.Id, event.Pos)
+		}
+	}
+
+	r := &Replay{Nodes: nodes, Ticks: 5, Events: []*ReplayEvent{
+		{Tick: 2, Type: REPLAY_DEATH, Id: "p2"}, {Tick: 2, Type: REPLAY_FAIL, Id: "p2"}}}
+	if err := checkReplay(r); err != nil {
+		t.Fatalf("the replay was rejected: %v", err)
+	}
+	frames := newGame("").simulateReplay(r)
+	if len(frames) != r.Ticks {
+		t.Fatalf("simulated %d ticks, want %d", len(frames), r.Ticks)
+	}
+	if players := frames[len(frames)-1].Players; len(players) != 2 {
+		t.Errorf("the replay ends with %d players, want 2", len(players))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+// This file manages the player's profile: a stable player id, a display name
+// and a preferred colour. The profile is sent to the matchmaking server when
+// joining, which checks it is unique in the room and passes it to every peer
+// in Node. With -profile, the profile is kept in a file so the player keeps
+// the same id across games.
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"unicode/utf8"
+)
+
+const MAX_NAME_LENGTH int = 16
+
+// The player's chosen identity.
+type Profile struct {
+	PlayerId string // Stable id of the player, the same across games.
+	Name     string // Display name, the slot id when empty.
+	Colour   string // Preferred colour, "#rrggbb", or empty for the slot colour.
+}
+
+var profile Profile      // Our profile, sent when joining.
+var profilePath string   // File the profile is kept in, empty to not keep it.
+var profileName string   // Name given on the command line.
+var profileColour string // Colour given on the command line.
+
+var colourPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Load our profile from profilePath, if any, apply the name and colour given
+// on the command line, and save it back. Players without a profile file get a
+// new player id every time.
+func loadProfile() error {
+	if profilePath != "" {
+		data, err := ioutil.ReadFile(profilePath)
+		if err == nil {
+			err = json.Unmarshal(data, &profile)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if profile.PlayerId == "" {
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		profile.PlayerId = hex.EncodeToString(id)
+	}
+	if profileName != "" {
+		profile.Name = profileName
+	}
+	if profileColour != "" {
+		profile.Colour = profileColour
+	}
+	if err := validateProfile(&profile); err != nil {
+		return err
+	}
+
+	if profilePath == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(&profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(profilePath, data, 0644)
+}
+
+// Check a profile is well formed, the same way the ms server does. Names are
+// limited in characters, not bytes.
+func validateProfile(p *Profile) error {
+	if p.PlayerId == "" {
+		return errors.New("profile has no player id")
+	}
+	if utf8.RuneCountInString(p.Name) > MAX_NAME_LENGTH {
+		return errors.New("name is longer than 16 characters")
+	}
+	for _, r := range p.Name {
+		if r < ' ' || r == 0x7f {
+			return errors.New("name has control characters")
+		}
+	}
+	if p.Colour != "" && !colourPattern.MatchString(p.Colour) {
+		return errors.New("colour is not #rrggbb")
+	}
+	return nil
+}
+
+// Name a player by their display name and slot id, for the logs.
+func (g *Game) playerName(id string) string {
+	for _, node := range g.nodes {
+		if node.Id == id && node.Profile.Name != "" && node.Profile.Name != id {
+			return node.Profile.Name + " (" + id + ")"
+		}
+	}
+	return id
+}
@@ -0,0 +1,240 @@
+// Package protocol defines the messages a node and its browser clients
+// exchange over WebSocket. Every message is a JSON envelope holding the
+// protocol version, the message type and its data. SCHEMA.md documents the
+// protocol for other clients.
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Version of the protocol. Bumped on changes that break existing clients.
+const VERSION int = 1
+
+// Path of the WebSocket endpoint on the node's http server.
+const PATH string = "/ws"
+
+// Messages sent by the node.
+const (
+	HELLO            string = "hello"           // Hello: first message on every connection.
+	LOBBY            string = "lobby"           // Lobby: the queue we wait in changed.
+	START_GAME       string = "startGame"       // StartGame: the game started, or is resumed.
+	STATE            string = "state"           // State: the whole board.
+	STATE_DIFF       string = "stateDiff"       // StateDiff: the cells that changed since the last board.
+	PLAYER_DEAD      string = "playerDead"      // No data: our player died.
+	PLAYER_VICTORY   string = "playerVictory"   // No data: our player, or its team, won.
+	SUDDEN_DEATH     string = "suddenDeath"     // No data: the arena started shrinking.
+	GAME_DRAW        string = "gameDraw"        // No data: the game ended in a draw.
+	GAME_SUMMARY     string = "gameSummary"     // GameSummary: every player's statistics, once the game is over.
+	TAKE_CONTROL     string = "takeControl"     // TakeControl: this client now steers the player.
+	ROOM_LIST        string = "roomList"        // RoomList: the rooms a spectator can watch.
+	START_SPECTATING string = "startSpectating" // StartSpectating: a room is being watched.
+	PLAYERS          string = "players"         // Players: every player's status, for spectators and replays.
+	START_REPLAY     string = "startReplay"     // StartReplay: a replay is loaded.
+	REPLAY_FRAME     string = "replayFrame"     // ReplayFrame: the replay frame being shown.
+	ERROR            string = "error"           // Error: the last message was rejected.
+)
+
+// Messages sent by clients.
+const (
+	PLAYER_MOVE    string = "playerMove"    // PlayerMove: turn the player.
+	SET_READY      string = "setReady"      // SetReady: say whether we are ready to start.
+	LEAVE_QUEUE    string = "leaveQueue"    // No data: stop waiting for a game.
+	JOIN_QUEUE     string = "joinQueue"     // No data: wait for a game again after leaving.
+	LIST_ROOMS     string = "listRooms"     // No data: ask for the room list again.
+	SPECTATE_ROOM  string = "spectateRoom"  // SpectateRoom: watch a room.
+	REPLAY_CONTROL string = "replayControl" // ReplayControl: play, pause, seek or change speed.
+)
+
+// Modes a node can run in, sent in Hello.
+const (
+	MODE_PLAYER    string = "player"
+	MODE_SPECTATOR string = "spectator"
+	MODE_REPLAY    string = "replay"
+)
+
+type Envelope struct {
+	Version int             `json:"version"`
+	Type    string          `json:"type"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type Hello struct {
+	Mode string `json:"mode"`
+}
+
+type Lobby struct {
+	InQueue      bool    `json:"inQueue"`
+	RoomId       int     `json:"roomId,omitempty"`
+	Waiting      int     `json:"waiting"`    // Players waiting, bots included.
+	Ready        int     `json:"ready"`      // Players ready to start, bots included.
+	Capacity     int     `json:"capacity"`   // Players at which the room starts straight away.
+	MinPlayers   int     `json:"minPlayers"` // Players needed for the room to start when its timer fires.
+	StartsIn     float64 `json:"startsIn"`   // Seconds until the room's timer fires.
+	IsReady      bool    `json:"isReady"`
+	IsController bool    `json:"isController"`
+}
+
+type SetReady struct {
+	Ready bool `json:"ready"`
+}
+
+type StartGame struct {
+	Id           string         `json:"id"`
+	Addr         string         `json:"addr"`
+	Name         string         `json:"name"`
+	Direction    string         `json:"direction"`
+	WrapAround   bool           `json:"wrapAround"`
+	Teams        map[string]int `json:"teams,omitempty"` // Player id to team, absent in free for all.
+	Players      []Player       `json:"players"`
+	IsController bool           `json:"isController"`
+}
+
+type State struct {
+	Tick  int        `json:"tick"`
+	Board [][]string `json:"board"` // Rows of cell codes, top first.
+}
+
+type Cell struct {
+	X    int    `json:"x"`
+	Y    int    `json:"y"`
+	Code string `json:"code"`
+}
+
+type StateDiff struct {
+	Tick  int    `json:"tick"`
+	Cells []Cell `json:"cells"`
+}
+
+type TakeControl struct {
+	Direction string `json:"direction"`
+}
+
+type Player struct {
+	Id     string `json:"id"`
+	Addr   string `json:"addr"`
+	Team   int    `json:"team,omitempty"`
+	Name   string `json:"name"`
+	Colour string `json:"colour,omitempty"` // Preferred colour, "#rrggbb".
+}
+
+type Room struct {
+	Id      int      `json:"id"`
+	Players []Player `json:"players"`
+}
+
+type RoomList struct {
+	Rooms []Room `json:"rooms"`
+}
+
+type StartSpectating struct {
+	RoomId int `json:"roomId"`
+}
+
+type PlayerStatus struct {
+	Player
+	IsAlive bool `json:"isAlive"`
+	Score   int  `json:"score"`
+}
+
+type Players struct {
+	Tick      int            `json:"tick"`
+	IsPlaying bool           `json:"isPlaying"`
+	Players   []PlayerStatus `json:"players"`
+}
+
+type StartReplay struct {
+	Frames     int            `json:"frames"`
+	WrapAround bool           `json:"wrapAround"`
+	Teams      map[string]int `json:"teams,omitempty"`
+	Players    []Player       `json:"players"`
+}
+
+type PlayerSummary struct {
+	Player
+	Survived  int `json:"survived"` // Ticks survived.
+	Cells     int `json:"cells"`    // Distinct cells covered.
+	Kills     int `json:"kills"`
+	Turns     int `json:"turns"`
+	Placement int `json:"placement"` // 1 for the winners.
+}
+
+type GameSummary struct {
+	Tick       int             `json:"tick"`
+	IsDraw     bool            `json:"isDraw"`
+	FromLeader bool            `json:"fromLeader"` // False until the leader's summary arrives.
+	Players    []PlayerSummary `json:"players"`    // Best placement first.
+}
+
+type ReplayFrame struct {
+	Index int `json:"index"`
+}
+
+type Error struct {
+	Message string `json:"message"`
+}
+
+type PlayerMove struct {
+	Direction string `json:"direction"`
+}
+
+type SpectateRoom struct {
+	RoomId int `json:"roomId"`
+}
+
+type ReplayControl struct {
+	Action string  `json:"action"` // One of "play", "pause", "seek" and "speed".
+	Value  float64 `json:"value"`  // The frame to seek to, or the playback speed.
+}
+
+// Wrap a message in an envelope and encode it. data may be nil for messages
+// without data.
+func Encode(msgType string, data interface{}) ([]byte, error) {
+	env := Envelope{Version: VERSION, Type: msgType}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		env.Data = raw
+	}
+	return json.Marshal(&env)
+}
+
+// Decode an envelope, rejecting other versions of the protocol.
+func Decode(buf []byte) (*Envelope, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(buf, env); err != nil {
+		return nil, err
+	}
+	if env.Version != VERSION {
+		return nil, fmt.Errorf("unsupported protocol version %d", env.Version)
+	}
+	if env.Type == "" {
+		return nil, fmt.Errorf("message without a type")
+	}
+	return env, nil
+}
+
+// Decode the data of an envelope into v.
+func (env *Envelope) Unpack(v interface{}) error {
+	if len(env.Data) == 0 {
+		return fmt.Errorf("%s message without data", env.Type)
+	}
+	return json.Unmarshal(env.Data, v)
+}
+
+// Return the cells of board that differ from old. old may be nil, in which
+// case every cell is returned.
+func Diff(old [][]string, board [][]string) []Cell {
+	cells := make([]Cell, 0)
+	for y, row := range board {
+		for x, code := range row {
+			if old == nil || y >= len(old) || x >= len(old[y]) || old[y][x] != code {
+				cells = append(cells, Cell{X: x, Y: y, Code: code})
+			}
+		}
+	}
+	return cells
+}
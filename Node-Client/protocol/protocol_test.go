@@ -0,0 +1,119 @@
+package protocol
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	sent := &StateDiff{Tick: 12, Cells: []Cell{{X: 1, Y: 2, Code: "p1"}, {X: 3, Y: 4, Code: ""}}}
+	buf, err := Encode(STATE_DIFF, sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Version != VERSION || env.Type != STATE_DIFF {
+		t.Errorf("decoded version %d and type %q, want %d and %q", env.Version, env.Type, VERSION, STATE_DIFF)
+	}
+	received := &StateDiff{}
+	if err := env.Unpack(received); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(received, sent) {
+		t.Errorf("received %+v, sent %+v", received, sent)
+	}
+}
+
+// Messages without data round-trip too, but have nothing to unpack.
+func TestEncodeDecodeWithoutData(t *testing.T) {
+	buf, err := Encode(PLAYER_DEAD, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(buf), "data") {
+		t.Errorf("encoded %s, want no data", buf)
+	}
+	env, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env.Type != PLAYER_DEAD {
+		t.Errorf("decoded type %q, want %q", env.Type, PLAYER_DEAD)
+	}
+	if err := env.Unpack(&Error{}); err == nil {
+		t.Errorf("unpacked a message without data")
+	}
+}
+
+func TestDecodeRejects(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		buf  string
+		want string // In the error.
+	}{
+		{"unknown version", `{"version":2,"type":"playerMove","data":{"direction":"U"}}`, "version 2"},
+		{"no version", `{"type":"playerMove","data":{"direction":"U"}}`, "version 0"},
+		{"empty type", `{"version":1,"type":"","data":{"direction":"U"}}`, "without a type"},
+		{"no type", `{"version":1}`, "without a type"},
+		{"not json", `playerMove U`, "invalid character"},
+	} {
+		env, err := Decode([]byte(test.buf))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: decoded %+v with error %v, want an error about %q", test.name, env, err, test.want)
+		}
+	}
+}
+
+// Data that doesn't fit the type it is unpacked into is rejected.
+func TestUnpackWrongType(t *testing.T) {
+	buf, err := Encode(LOBBY, &Lobby{InQueue: true, Waiting: 3, Ready: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env, err := Decode(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lobby's ready is a number, SetReady's a boolean.
+	if err := env.Unpack(&SetReady{}); err == nil {
+		t.Errorf("unpacked a lobby into a SetReady")
+	}
+
+	buf, err = Encode(STATE_DIFF, []Cell{{X: 1, Y: 2, Code: "p1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env, err = Decode(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := env.Unpack(&StateDiff{}); err == nil {
+		t.Errorf("unpacked a list of cells into a StateDiff")
+	}
+}
+
+func TestDiff(t *testing.T) {
+	old := [][]string{{"p1", ""}, {"", "t2"}}
+	board := [][]string{{"t1", ""}, {"p1", "t2"}}
+
+	want := []Cell{{X: 0, Y: 0, Code: "t1"}, {X: 0, Y: 1, Code: "p1"}}
+	if got := Diff(old, board); !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff = %+v, want %+v", got, want)
+	}
+	if got := Diff(board, board); len(got) != 0 {
+		t.Errorf("Diff of a board with itself = %+v, want no cells", got)
+	}
+
+	// Without an old board, or with a smaller one, every new cell is sent.
+	all := []Cell{{X: 0, Y: 0, Code: "t1"}, {X: 1, Y: 0, Code: ""}, {X: 0, Y: 1, Code: "p1"},
+		{X: 1, Y: 1, Code: "t2"}}
+	if got := Diff(nil, board); !reflect.DeepEqual(got, all) {
+		t.Errorf("Diff from nil = %+v, want %+v", got, all)
+	}
+	if got := Diff([][]string{{"t1"}}, board); !reflect.DeepEqual(got, all[1:]) {
+		t.Errorf("Diff from a smaller board = %+v, want %+v", got, all[1:])
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+// This file records games into replay files, and re-simulates them with the
+// game engine so they can be watched again in the browser.
+//
+// Every node records its game as it sees it, and the node leading the game
+// when it ends writes the replay. A replay holds the game options, the
+// players and where they started, and every event that changed the game:
+// turns, position corrections from peers, deaths, failures, sudden death and
+// draws. The engine has no randomness, so that is all it takes to re-simulate
+// a game; deaths that don't match the simulation are logged, which helps with
+// disputed deaths and desync bugs.
+
+import (
+	"encoding/json"
+	"fmt"
+	"gotron/Node-Client/protocol"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+)
+
+const REPLAY_VERSION int = 1
+
+// Types of replay events.
+const (
+	REPLAY_TURN   string = "turn"   // A node's direction changed.
+	REPLAY_MOVE   string = "move"   // A peer corrected a node's position and direction.
+	REPLAY_DEATH  string = "death"  // A node died.
+	REPLAY_FAIL   string = "fail"   // A node failed and was removed from the game.
+	REPLAY_SHRINK string = "shrink" // Sudden death started.
+	REPLAY_DRAW   string = "draw"   // The game ended in a draw.
+)
+
+type Replay struct {
+	Version int
+	Options GameOptions
+	Nodes   []*Node // Every player, where it started and heading which way.
+	Events  []*ReplayEvent
+	Ticks   int // Length of the game.
+}
+
+// Something that changed the game at a tick.
+type ReplayEvent struct {
+	Tick      int
+	Type      string
+	Id        string `json:",omitempty"`
+	Direction string `json:",omitempty"`
+	Pos       *Pos   `json:",omitempty"`
+	Rings     []int  `json:",omitempty"`
+}
+
+var replayPath string // Replay file to watch instead of playing.
+
+// What a game records of itself.
+type recordingState struct {
+	replay      *Replay // The game being recorded.
+	replaySaved bool    // Has the replay of this game been written.
+}
+
+// The replay being watched, simulated once for every tab.
+var replayOnce sync.Once
+var replayFrames []*SpectatorUpdate
+var replayTeams map[string]int
+var replayPlayers []protocol.Player
+var replayWrapAround bool
+
+// Start recording the game, from the nodes' initial state.
+func (g *Game) startRecording() {
+	g.replay = &Replay{Version: REPLAY_VERSION, Options: g.gameOptions}
+	for _, node := range g.nodes {
+		loc := *node.CurrLoc
+		g.replay.Nodes = append(g.replay.Nodes, &Node{Id: node.Id, Ip: node.Ip, Team: node.Team,
+			CurrLoc: &loc, Direction: node.Direction, IsAlive: true, Profile: node.Profile})
+	}
+}
+
+// Record an event at the current tick.
+func (g *Game) recordEvent(event *ReplayEvent) {
+	if g.replay == nil {
+		return
+	}
+	event.Tick = g.tick
+	g.replay.Events = append(g.replay.Events, event)
+}
+
+// Record a node's position and direction after a peer corrected it.
+func (g *Game) recordMove(node *Node) {
+	g.recordEvent(&ReplayEvent{Type: REPLAY_MOVE, Id: node.Id, Direction: node.Direction,
+		Pos: &Pos{X: node.CurrLoc.X, Y: node.CurrLoc.Y}})
+}
+
+// Record that a node died.
+func (g *Game) recordDeath(node *Node) {
+	g.recordEvent(&ReplayEvent{Type: REPLAY_DEATH, Id: node.Id})
+}
+
+// LEADER: Write the replay once the game is over.
+func (g *Game) saveReplay() {
+	g.mutex.Lock()
+	if g.replay == nil || g.replaySaved {
+		g.mutex.Unlock()
+		return
+	}
+	g.replaySaved = true
+	g.replay.Ticks = g.tick
+	data, err := json.Marshal(g.replay)
+	g.mutex.Unlock()
+
+	if err != nil {
+		replayLog.Error("Failed to encode replay", "err", err)
+		return
+	}
+	// Windows doesn't accept colons in paths, so we filter them out here.
+	path := strings.Replace(g.nodeAddr, ":", "", -1) + "-replay.json"
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		replayLog.Error("Failed to write replay", "err", err)
+		return
+	}
+	replayLog.Info("Saved replay", "path", path)
+}
+
+// Read a replay file.
+func loadReplay(path string) (*Replay, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &Replay{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	if err := checkReplay(r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Check that a replay has everything simulateReplay needs, so a corrupted or
+// hand-edited file is rejected instead of crashing the node.
+func checkReplay(r *Replay) error {
+	for i, node := range r.Nodes {
+		if node == nil || node.Id == "" || !isOnBoard(node.CurrLoc) {
+			return fmt.Errorf("player %d has no id or no start on the board", i+1)
+		}
+	}
+	for i, event := range r.Events {
+		if event == nil {
+			return fmt.Errorf("event %d is empty", i+1)
+		}
+		switch event.Type {
+		case REPLAY_TURN, REPLAY_MOVE, REPLAY_DEATH, REPLAY_FAIL:
+			if event.Id == "" {
+				return fmt.Errorf("%s event at tick %d has no player", event.Type, event.Tick)
+			}
+		}
+		if event.Type == REPLAY_MOVE && !isOnBoard(event.Pos) {
+			return fmt.Errorf("move event at tick %d has no position on the board", event.Tick)
+		}
+	}
+	return nil
+}
+
+func isOnBoard(pos *Pos) bool {
+	return pos != nil && pos.X >= 0 && pos.X < BOARD_SIZE && pos.Y >= 0 && pos.Y < BOARD_SIZE
+}
+
+// Re-simulate a replay with the game engine, returning what the game looked
+// like after every tick.
+func (g *Game) simulateReplay(r *Replay) []*SpectatorUpdate {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	// Set up the engine like startGame, as a node that isn't playing.
+	g.gameOptions = r.Options
+	g.nodeId = ""
+	g.nodes = make([]*Node, 0, len(r.Nodes))
+	for _, n := range r.Nodes {
+		loc := *n.CurrLoc
+		node := &Node{Id: n.Id, Ip: n.Ip, Team: n.Team, CurrLoc: &loc,
+			Direction: n.Direction, IsAlive: true, Profile: n.Profile}
+		g.nodes = append(g.nodes, node)
+	}
+	g.board = [BOARD_SIZE][BOARD_SIZE]string{}
+	for _, node := range g.nodes {
+		g.board[node.CurrLoc.Y][node.CurrLoc.X] = g.getPlayerState(node.Id)
+	}
+	g.trails = make(map[string][]*TrailCell)
+	g.scores = make(map[string]int)
+	g.shrinkSchedule = nil
+	g.closedRings = 0
+	g.isPlaying = true
+
+	events := r.Events
+	frames := make([]*SpectatorUpdate, 0, r.Ticks)
+	for g.tick = 0; g.tick < r.Ticks; g.tick++ {
+		// Events that happened before the nodes moved.
+		deaths := make(map[string]bool)
+		var after []*ReplayEvent
+		for len(events) > 0 && events[0].Tick == g.tick {
+			event := events[0]
+			events = events[1:]
+			node := g.getNode(event.Id)
+			if node == nil && event.Id != "" {
+				continue // The node already failed.
+			}
+			switch event.Type {
+			case REPLAY_TURN:
+				node.Direction = event.Direction
+			case REPLAY_MOVE:
+				g.board[node.CurrLoc.Y][node.CurrLoc.X] = ""
+				node.CurrLoc.X, node.CurrLoc.Y = event.Pos.X, event.Pos.Y
+				node.Direction = event.Direction
+				g.board[node.CurrLoc.Y][node.CurrLoc.X] = g.getPlayerState(node.Id)
+			case REPLAY_FAIL:
+				g.removeNodeFromList(event.Id)
+			case REPLAY_DEATH:
+				deaths[event.Id] = true
+				after = append(after, event)
+			default:
+				after = append(after, event)
+			}
+		}
+
+		// Move the nodes like tickGame does on a node that isn't leading.
+		crashed := make(map[string]bool)
+		for _, node := range g.nodes {
+			if !node.IsAlive {
+				continue
+			}
+			g.scores[node.Id]++
+			x, y := node.CurrLoc.X, node.CurrLoc.Y
+			g.layTrail(node.Id, x, y)
+			newX, newY := g.nextPosition(x, y, node.Direction)
+			if g.nodeHasCollided(node.Id, x, y, newX, newY) {
+				if !deaths[node.Id] {
+					replayLog.Warn("Replay desync: crashed but didn't die", "peer", node.Id, "at", g.tick)
+				}
+				crashed[node.Id] = true
+				g.removeTrailCell(node.Id, x, y)
+				g.board[y][x] = g.getPlayerState(node.Id)
+			} else {
+				g.board[newY][newX] = g.getPlayerState(node.Id)
+				node.CurrLoc.X, node.CurrLoc.Y = newX, newY
+			}
+		}
+		g.fadeTrails()
+
+		// Events that happened after the nodes moved, sudden death closing
+		// rings before the deaths it caused.
+		for _, event := range after {
+			switch event.Type {
+			case REPLAY_SHRINK:
+				g.shrinkSchedule = &ShrinkSchedule{Tick: g.tick, Rings: event.Rings}
+			case REPLAY_DRAW:
+				g.isPlaying = false
+			}
+		}
+		g.closeRings()
+		for _, event := range after {
+			if event.Type != REPLAY_DEATH {
+				continue
+			}
+			node := g.getNode(event.Id)
+			if node == nil {
+				continue // The node failed on this tick too.
+			}
+			if !crashed[node.Id] && ringOf(node.CurrLoc.X, node.CurrLoc.Y) >= g.closedRings {
+				replayLog.Warn("Replay desync: died without crashing", "peer", node.Id, "at", g.tick)
+			}
+			node.IsAlive = false
+			g.board[node.CurrLoc.Y][node.CurrLoc.X] = g.getPlayerState(node.Id)
+		}
+		if len(g.survivingTeams()) <= 1 {
+			g.isPlaying = false
+		}
+
+		frame := &SpectatorUpdate{Tick: g.tick, IsPlaying: g.isPlaying, Board: g.board}
+		for _, node := range g.nodes {
+			frame.Players = append(frame.Players, &PlayerStatus{Id: node.Id, Ip: node.Ip,
+				Team: node.Team, Profile: node.Profile, IsAlive: node.IsAlive, Score: g.scores[node.Id]})
+		}
+		frames = append(frames, frame)
+		if !g.isPlaying {
+			break
+		}
+	}
+	g.isPlaying = false
+	return frames
+}
+
+// Replay player actions, sent in protocol.ReplayControl.
+const (
+	REPLAY_PLAY  string = "play"
+	REPLAY_PAUSE string = "pause"
+	REPLAY_SEEK  string = "seek"
+	REPLAY_SPEED string = "speed"
+	REPLAY_STOP  string = "stop" // The tab went away.
+)
+
+// Show a tab the frames one tick at a time, following its controls.
+// Playback starts paused on the first frame. done is closed once we stop
+// reading controls, so nobody waits on us to read them.
+func playReplay(s *session, frames []*SpectatorUpdate, controls chan protocol.ReplayControl, done chan struct{}) {
+	defer close(done)
+	if len(frames) == 0 {
+		return
+	}
+
+	index := 0
+	playing := false
+	speed := 1.0
+	pushReplayFrameToJS(s, index, frames[index])
+	for {
+		var next <-chan time.Time
+		if playing {
+			next = time.After(time.Duration(float64(tickRate) / speed))
+		}
+
+		select {
+		case control := <-controls:
+			switch control.Action {
+			case REPLAY_PLAY:
+				playing = true
+				if index == len(frames)-1 {
+					index = 0 // Play again from the start.
+					pushReplayFrameToJS(s, index, frames[index])
+				}
+			case REPLAY_PAUSE:
+				playing = false
+			case REPLAY_SEEK:
+				index = intMin(intMax(int(control.Value), 0), len(frames)-1)
+				pushReplayFrameToJS(s, index, frames[index])
+				if index == len(frames)-1 {
+					playing = false
+				}
+			case REPLAY_SPEED:
+				if control.Value > 0 {
+					speed = control.Value
+				}
+			case REPLAY_STOP:
+				return
+			default:
+				replayLog.Warn("Unknown replay control", "action", control.Action)
+			}
+		case <-next:
+			// Nothing left to play, as in a replay of a single frame.
+			if index >= len(frames)-1 {
+				playing = false
+				continue
+			}
+			index++
+			pushReplayFrameToJS(s, index, frames[index])
+			if index == len(frames)-1 {
+				playing = false
+			}
+		}
+	}
+}
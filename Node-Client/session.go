@@ -0,0 +1,344 @@
+package main
+
+// This file manages the browser sessions connected to the node. Any number of
+// tabs can show the game, but only one of them, the controller, sends turns;
+// the others are read-only viewers. The node joins the matchmaking server once,
+// when the first tab connects, and a tab that connects mid-game (such as a
+// refreshed page) resumes the game instead of showing the intro screen.
+//
+// Sessions talk to the node over WebSocket, using the messages of the
+// protocol package.
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"gotron/Node-Client/protocol"
+	"sync"
+	"time"
+)
+
+const (
+	// How long control is kept for the controller's page to come back after
+	// a refresh, before a viewer is given control.
+	CONTROL_RECLAIM_TIMEOUT time.Duration = 3000 * time.Millisecond
+	// How long a message to a tab may take to send before the tab is
+	// considered gone.
+	SESSION_WRITE_TIMEOUT time.Duration = 1000 * time.Millisecond
+)
+
+// A browser tab connected to the node.
+type session struct {
+	id        string
+	conn      *websocket.Conn
+	writeLock sync.Mutex
+	connected time.Time
+	onClose   []func()                                // Called when the tab goes away.
+	handlers  map[string]func(env *protocol.Envelope) // Message type to its handler.
+	board     [][]string                              // The last board sent, to send only what changed.
+}
+
+var sessionsLock sync.Mutex
+var sessions map[string]*session // Id to each connected session.
+var nextSessionId int
+var controllerId string               // Id of the controlling session, empty when control is free.
+var joinOnce sync.Once                // The node joins the ms server only once.
+var gameStarted bool                  // Have the sessions been told the game started.
+var pastEvents []string               // Game events since the game started, for resuming sessions.
+var pastSummary *protocol.GameSummary // The game's summary once it is over, for resuming sessions.
+
+var upgrader = websocket.Upgrader{}
+
+// Register the handler of a message type. Handlers must be registered before
+// the session starts reading.
+func (s *session) On(msgType string, f func(env *protocol.Envelope)) {
+	s.handlers[msgType] = f
+}
+
+// Send a message to the tab. data may be nil for messages without data.
+func (s *session) Emit(msgType string, data interface{}) {
+	msg, err := protocol.Encode(msgType, data)
+	if err != nil {
+		uiLog.Error("Failed to encode", "type", msgType, "err", err)
+		return
+	}
+
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(SESSION_WRITE_TIMEOUT))
+	if err := s.conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+		uiLog.Warn("Failed to send", "type", msgType, "session", s.id, "err", err)
+		s.conn.Close() // The read loop removes the session.
+	}
+}
+
+// Send the tab the board, or only the cells that changed since the last board
+// it was sent.
+func (s *session) sendBoard(tick int, board [][]string) {
+	s.writeLock.Lock()
+	old := s.board
+	s.board = board
+	s.writeLock.Unlock()
+
+	if old == nil {
+		s.Emit(protocol.STATE, &protocol.State{Tick: tick, Board: board})
+		return
+	}
+	s.Emit(protocol.STATE_DIFF, &protocol.StateDiff{Tick: tick, Cells: protocol.Diff(old, board)})
+}
+
+// Read the tab's messages until it goes away, passing each to its handler.
+func (s *session) readLoop() {
+	defer removeSession(s.id)
+	for {
+		_, msg, err := s.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		env, err := protocol.Decode(msg)
+		if err != nil {
+			s.Emit(protocol.ERROR, &protocol.Error{Message: err.Error()})
+			continue
+		}
+		handler, ok := s.handlers[env.Type]
+		if !ok {
+			s.Emit(protocol.ERROR, &protocol.Error{Message: "unexpected message " + env.Type})
+			continue
+		}
+		handler(env)
+	}
+}
+
+// Add a newly connected tab, giving it control if no other tab has it.
+func addSession(conn *websocket.Conn) *session {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	nextSessionId++
+	s := &session{id: fmt.Sprintf("s%d", nextSessionId), conn: conn, connected: time.Now(),
+		handlers: make(map[string]func(env *protocol.Envelope))}
+	sessions[s.id] = s
+	if controllerId == "" {
+		controllerId = s.id
+	}
+	uiLog.Info("Session connected", "session", s.id, "from", conn.RemoteAddr().String(), "controller", controllerId == s.id)
+	return s
+}
+
+// Call f when the given tab goes away.
+func onSessionClose(s *session, f func()) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	s.onClose = append(s.onClose, f)
+}
+
+// Forget a tab that went away. If it was the controller, control goes to the
+// next tab to connect, or to a viewer if none connects in time.
+func removeSession(id string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+
+	s, ok := sessions[id]
+	if !ok {
+		return
+	}
+	delete(sessions, id)
+	s.conn.Close()
+	uiLog.Info("Session disconnected", "session", id)
+	for _, f := range s.onClose {
+		go f()
+	}
+	if id == controllerId {
+		controllerId = ""
+		time.AfterFunc(CONTROL_RECLAIM_TIMEOUT, promoteViewer)
+	}
+}
+
+// Give control to the longest connected viewer, unless a tab claimed it.
+func promoteViewer() {
+	direction := ""
+	if game != nil {
+		direction = game.myDirection()
+	}
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if controllerId != "" {
+		return
+	}
+
+	var oldest *session
+	for _, s := range sessions {
+		if oldest == nil || s.connected.Before(oldest.connected) {
+			oldest = s
+		}
+	}
+	if oldest == nil {
+		return
+	}
+	controllerId = oldest.id
+	uiLog.Info("Session took control", "session", controllerId)
+	if gameStarted {
+		oldest.Emit(protocol.TAKE_CONTROL, &protocol.TakeControl{Direction: direction})
+	} else if !isSpectator && replayPath == "" {
+		emitLobby(oldest)
+	}
+}
+
+// Check if the given tab is the one sending turns.
+func isController(s *session) bool {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	return s.id == controllerId
+}
+
+// Send a message to every tab.
+func emitToSessions(msgType string, data interface{}) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for _, s := range sessions {
+		s.Emit(msgType, data)
+	}
+}
+
+// Send every tab the board.
+func sendBoardToSessions(tick int, board [][]string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	for _, s := range sessions {
+		s.sendBoard(tick, board)
+	}
+}
+
+// Send a message that changes the game for good, such as a death, to every
+// tab, and remember it for tabs that resume the game later.
+func emitGameEvent(msgType string) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	pastEvents = append(pastEvents, msgType)
+	for _, s := range sessions {
+		s.Emit(msgType, nil)
+	}
+}
+
+// Send every tab the game's summary, and remember it for tabs that resume
+// the game later.
+func emitSummary(summary *protocol.GameSummary) {
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	pastSummary = summary
+	for _, s := range sessions {
+		s.Emit(protocol.GAME_SUMMARY, summary)
+	}
+}
+
+// Tell every tab the game started.
+func startSessions() {
+	start := game.startGameForJS()
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	gameStarted = true
+	for _, s := range sessions {
+		emitStartGame(s, start)
+	}
+}
+
+// What tabs are told of the game when it starts, or when they resume it. Nil
+// until the game starts.
+func (g *Game) startGameForJS() *protocol.StartGame {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.myNode == nil {
+		return nil
+	}
+	return &protocol.StartGame{Id: g.nodeId, Addr: g.nodeAddr,
+		Name: g.myNode.Profile.Name, Direction: g.myNode.Direction,
+		WrapAround: g.gameOptions.WrapAround, Teams: g.getTeamsForJS(),
+		Players: g.getPlayersForJS()}
+}
+
+// Tell a tab the game started, and whether it controls the player.
+// Called with sessionsLock held.
+func emitStartGame(s *session, start *protocol.StartGame) {
+	msg := *start
+	msg.IsController = s.id == controllerId
+	s.Emit(protocol.START_GAME, &msg)
+}
+
+// Tell a tab about the queue we wait in, and whether it can change our place
+// in it. Called with sessionsLock held.
+func emitLobby(s *session) {
+	in, ready, status := queueState()
+	lobby := &protocol.Lobby{InQueue: in, IsReady: ready, IsController: s.id == controllerId}
+	if in && status != nil {
+		lobby.RoomId = status.RoomId
+		lobby.Waiting = status.Waiting
+		lobby.Ready = status.Ready
+		lobby.Capacity = status.Capacity
+		lobby.MinPlayers = status.MinPlayers
+		lobby.StartsIn = status.StartsIn.Seconds()
+	}
+	s.Emit(protocol.LOBBY, lobby)
+}
+
+// Register the handler of a message only the controlling tab may send.
+func onControllerMessage(s *session, msgType string, f func(env *protocol.Envelope)) {
+	s.On(msgType, func(env *protocol.Envelope) {
+		if !isController(s) {
+			uiLog.Warn("Ignoring message from viewer", "type", msgType, "session", s.id)
+			return
+		}
+		f(env)
+	})
+}
+
+// Join the ms server on the first tab, and bring tabs that connect mid-game
+// up to date.
+func startPlayerUI(s *session) {
+	onControllerMessage(s, protocol.PLAYER_MOVE, func(env *protocol.Envelope) {
+		move := &protocol.PlayerMove{}
+		if err := env.Unpack(move); err != nil || !isDirection(move.Direction) {
+			s.Emit(protocol.ERROR, &protocol.Error{Message: "invalid playerMove"})
+			return
+		}
+
+		game.notifyPeersDirChanged(move.Direction)
+	})
+	onControllerMessage(s, protocol.SET_READY, func(env *protocol.Envelope) {
+		ready := &protocol.SetReady{}
+		if err := env.Unpack(ready); err != nil {
+			s.Emit(protocol.ERROR, &protocol.Error{Message: err.Error()})
+			return
+		}
+		if err := setReady(ready.Ready); err != nil {
+			s.Emit(protocol.ERROR, &protocol.Error{Message: err.Error()})
+		}
+	})
+	onControllerMessage(s, protocol.LEAVE_QUEUE, func(env *protocol.Envelope) {
+		if err := leaveQueue(); err != nil {
+			s.Emit(protocol.ERROR, &protocol.Error{Message: err.Error()})
+		}
+	})
+	onControllerMessage(s, protocol.JOIN_QUEUE, func(env *protocol.Envelope) {
+		go rejoinQueue()
+	})
+	joinOnce.Do(func() {
+		go msRpcDial()
+	})
+
+	// Taken before sessionsLock, since the game sends to tabs with its mutex held.
+	start := game.startGameForJS()
+	sessionsLock.Lock()
+	defer sessionsLock.Unlock()
+	if !gameStarted {
+		emitLobby(s)
+		return
+	}
+	uiLog.Info("Resuming the game", "session", s.id)
+	emitStartGame(s, start)
+	for _, msgType := range pastEvents {
+		s.Emit(msgType, nil)
+	}
+	if pastSummary != nil {
+		s.Emit(protocol.GAME_SUMMARY, pastSummary)
+	}
+}
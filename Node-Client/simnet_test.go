@@ -0,0 +1,416 @@
+package main
+
+// This file implements the network and the clock the tests run games on. The
+// clock only moves when a test advances it, and the network delivers packets
+// on that clock, dropping, duplicating, delaying and reordering them as the
+// test asks, or not at all across a partition. Each host draws the faults of
+// the packets it sends from its own seeded source, so the packets a host sends
+// in the same order meet the same faults every time a test runs.
+
+import (
+	"errors"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock the test moves forward. Goroutines sleeping on it wake up in the
+// order their sleep ends, each getting to run before the clock moves on.
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+	seq    int // Timers due at the same time fire in the order they were set.
+}
+
+type fakeTimer struct {
+	at   time.Time
+	seq  int
+	fire func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2017, 4, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	wake := make(chan time.Time, 1) // Nobody reads it once the game is stopped.
+	c.afterFunc(d, func() { wake <- c.Now() })
+	return wake
+}
+
+// Call fire once the clock has moved d forward.
+func (c *fakeClock) afterFunc(d time.Duration, fire func()) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.seq++
+	c.timers = append(c.timers, &fakeTimer{at: c.now.Add(d), seq: c.seq, fire: fire})
+}
+
+// Move the clock d forward, firing the timers that come due on the way.
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	end := c.now.Add(d)
+	c.lock.Unlock()
+	for {
+		c.lock.Lock()
+		next := -1
+		for i, timer := range c.timers {
+			if timer.at.After(end) {
+				continue
+			}
+			if next < 0 || timer.at.Before(c.timers[next].at) ||
+				(timer.at.Equal(c.timers[next].at) && timer.seq < c.timers[next].seq) {
+				next = i
+			}
+		}
+		if next < 0 {
+			c.now = end
+			c.lock.Unlock()
+			return
+		}
+		timer := c.timers[next]
+		c.timers = append(c.timers[:next], c.timers[next+1:]...)
+		if timer.at.After(c.now) {
+			c.now = timer.at
+		}
+		c.lock.Unlock()
+
+		timer.fire()
+		settle()
+	}
+}
+
+// Give the goroutines a timer woke up, and those they started, a moment to
+// run until they sleep or wait for a packet again.
+func settle() {
+	for i := 0; i < 10; i++ {
+		runtime.Gosched()
+	}
+	time.Sleep(time.Millisecond)
+}
+
+// A packet on its way.
+type simPacket struct {
+	from string
+	data []byte
+}
+
+// A network in memory, delivering packets on a fakeClock.
+type simNetwork struct {
+	lock  sync.Mutex
+	clock *fakeClock
+	seed  int64
+	rands map[string]*rand.Rand // Address to the source of the faults of the packets it sends.
+
+	drop      float64       // Chance of a packet being lost.
+	duplicate float64       // Chance of a packet arriving twice.
+	minDelay  time.Duration // Packets take between minDelay and maxDelay to arrive,
+	maxDelay  time.Duration // so that they arrive out of order when the two differ.
+
+	conns map[string]*simConn // Address to the connection listening at it.
+	sides map[string]int      // Address to its side of the partition, 0 when there is none.
+
+	sent, dropped, duplicated, delivered int
+}
+
+func newSimNetwork(clock *fakeClock, seed int64) *simNetwork {
+	return &simNetwork{clock: clock, seed: seed, rands: make(map[string]*rand.Rand),
+		conns: make(map[string]*simConn), sides: make(map[string]int)}
+}
+
+// The network as the host at addr sees it, for it to send from.
+func (n *simNetwork) host(addr string) *simHost {
+	return &simHost{net: n, addr: addr}
+}
+
+// Set the faults packets meet from now on.
+func (n *simNetwork) setFaults(drop float64, duplicate float64, minDelay time.Duration, maxDelay time.Duration) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.drop, n.duplicate, n.minDelay, n.maxDelay = drop, duplicate, minDelay, maxDelay
+}
+
+// Return how many packets were sent, dropped, duplicated and delivered so far.
+func (n *simNetwork) counts() (int, int, int, int) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.sent, n.dropped, n.duplicated, n.delivered
+}
+
+// Cut the hosts at addrs off from every other host. They can still reach one
+// another.
+func (n *simNetwork) partition(addrs ...string) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	side := len(n.sides) + 1
+	for _, addr := range addrs {
+		n.sides[addr] = side
+	}
+}
+
+// Let every host reach every other again.
+func (n *simNetwork) heal() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.sides = make(map[string]int)
+}
+
+func (n *simNetwork) send(from string, to string, data []byte) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	source, ok := n.rands[from]
+	if !ok {
+		hash := fnv.New64a()
+		hash.Write([]byte(from))
+		source = rand.New(rand.NewSource(n.seed ^ int64(hash.Sum64())))
+		n.rands[from] = source
+	}
+
+	n.sent++
+	if n.sides[from] != n.sides[to] || source.Float64() < n.drop {
+		n.dropped++
+		return
+	}
+	copies := 1
+	if source.Float64() < n.duplicate {
+		copies = 2
+		n.duplicated++
+	}
+
+	for i := 0; i < copies; i++ {
+		packet := simPacket{from: from, data: append([]byte(nil), data...)}
+		delay := n.minDelay
+		if n.maxDelay > n.minDelay {
+			delay += time.Duration(source.Int63n(int64(n.maxDelay - n.minDelay)))
+		}
+		if delay == 0 {
+			n.deliver(to, packet)
+			continue
+		}
+		n.clock.afterFunc(delay, func() {
+			n.lock.Lock()
+			defer n.lock.Unlock()
+			n.deliver(to, packet)
+		})
+	}
+}
+
+// Hand a packet to the connection listening at to, if any and if its buffer
+// isn't full. Called with lock held.
+func (n *simNetwork) deliver(to string, packet simPacket) {
+	conn, ok := n.conns[to]
+	if !ok {
+		n.dropped++
+		return
+	}
+	select {
+	case conn.packets <- packet:
+		n.delivered++
+	default:
+		n.dropped++
+	}
+}
+
+func (n *simNetwork) listen(addr string) (*simConn, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.conns[addr]; ok {
+		return nil, errors.New("address already in use: " + addr)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &simConn{net: n, addr: udpAddr, packets: make(chan simPacket, 1024),
+		closed: make(chan struct{})}
+	n.conns[addr] = conn
+	return conn, nil
+}
+
+// A host of a simNetwork, as a Network.
+type simHost struct {
+	net  *simNetwork
+	addr string
+}
+
+func (h *simHost) Send(addr string, data []byte) error {
+	h.net.send(h.addr, addr, data)
+	return nil
+}
+
+func (h *simHost) Listen(addr string) (net.PacketConn, error) {
+	return h.net.listen(addr)
+}
+
+// A connection listening on a simNetwork.
+type simConn struct {
+	net       *simNetwork
+	addr      *net.UDPAddr
+	packets   chan simPacket
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *simConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		from, err := net.ResolveUDPAddr("udp", packet.from)
+		return copy(b, packet.data), from, err
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// Read a packet if one is waiting, without blocking.
+func (c *simConn) poll() ([]byte, bool) {
+	select {
+	case packet := <-c.packets:
+		return packet.data, true
+	default:
+		return nil, false
+	}
+}
+
+func (c *simConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.net.send(c.addr.String(), addr.String(), b)
+	return len(b), nil
+}
+
+func (c *simConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.net.lock.Lock()
+		delete(c.net.conns, c.addr.String())
+		c.net.lock.Unlock()
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *simConn) SetDeadline(t time.Time) error      { return nil }
+func (c *simConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *simConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestFakeClockWakesSleepersInOrder(t *testing.T) {
+	clock := newFakeClock()
+	start := clock.Now()
+	var lock sync.Mutex
+	var woke []time.Duration
+	for _, d := range []time.Duration{3 * time.Second, time.Second, 2 * time.Second} {
+		go func(d time.Duration) {
+			<-clock.After(d)
+			lock.Lock()
+			woke = append(woke, clock.Now().Sub(start))
+			lock.Unlock()
+		}(d)
+	}
+	settle()
+
+	clock.Advance(1500 * time.Millisecond)
+	lock.Lock()
+	if len(woke) != 1 || woke[0] != time.Second {
+		t.Errorf("after 1.5s, woke at %v, want [1s]", woke)
+	}
+	lock.Unlock()
+
+	clock.Advance(5 * time.Second)
+	lock.Lock()
+	defer lock.Unlock()
+	want := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	if len(woke) != len(want) {
+		t.Fatalf("woke at %v, want %v", woke, want)
+	}
+	for i := range want {
+		if woke[i] != want[i] {
+			t.Errorf("woke at %v, want %v", woke, want)
+		}
+	}
+	if got := clock.Now().Sub(start); got != 6500*time.Millisecond {
+		t.Errorf("clock at %v, want 6.5s", got)
+	}
+}
+
+func TestSimNetworkFaults(t *testing.T) {
+	clock := newFakeClock()
+	sim := newSimNetwork(clock, 1)
+	a, b := sim.host("127.0.0.1:9001"), sim.host("127.0.0.1:9002")
+	conn, err := sim.listen("127.0.0.1:9002")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := func() []string {
+		var packets []string
+		for {
+			data, ok := conn.poll()
+			if !ok {
+				return packets
+			}
+			packets = append(packets, string(data))
+		}
+	}
+
+	a.Send(b.addr, []byte("hello"))
+	if got := received(); len(got) != 1 || got[0] != "hello" {
+		t.Errorf("received %q, want [hello]", got)
+	}
+
+	sim.setFaults(0, 1, 0, 0)
+	a.Send(b.addr, []byte("twice"))
+	if got := received(); len(got) != 2 {
+		t.Errorf("received %q, want the packet twice", got)
+	}
+
+	sim.setFaults(0, 0, 100*time.Millisecond, time.Second)
+	for _, data := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		a.Send(b.addr, []byte(data))
+	}
+	if got := received(); len(got) != 0 {
+		t.Errorf("received %q before the delay", got)
+	}
+	clock.Advance(time.Second)
+	got := received()
+	if len(got) != 8 {
+		t.Fatalf("received %q after the delay, want 8 packets", got)
+	}
+	inOrder := true
+	for i := range got {
+		inOrder = inOrder && got[i] == string('1'+byte(i))
+	}
+	if inOrder {
+		t.Errorf("received %q in order, want them reordered", got)
+	}
+	sim.setFaults(0, 0, 0, 0)
+
+	sim.partition(a.addr)
+	a.Send(b.addr, []byte("cut"))
+	if got := received(); len(got) != 0 {
+		t.Errorf("received %q across the partition", got)
+	}
+	sim.heal()
+	a.Send(b.addr, []byte("healed"))
+	if got := received(); len(got) != 1 {
+		t.Errorf("received %q once healed, want [healed]", got)
+	}
+
+	sim.setFaults(0.5, 0, 0, 0)
+	for i := 0; i < 100; i++ {
+		a.Send(b.addr, []byte("lossy"))
+	}
+	if n := len(received()); n < 30 || n > 70 {
+		t.Errorf("received %d of 100 packets dropped half the time", n)
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+// This file implements spectators. A spectator picks a room from the
+// matchmaking server's room list and subscribes to the game state of its
+// players. Only the leader streams the game back, so the stream follows the
+// leader when it changes. Spectators are never part of the node list: they
+// can't send turns and aren't checked for failures.
+
+import (
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// A game being played, as listed by the matchmaking server.
+type Room struct {
+	Id      int
+	Players []*Node
+	Started time.Time
+}
+
+type RoomList struct {
+	Rooms []*Room
+	Log   []byte
+}
+
+// What spectators are shown of a player.
+type PlayerStatus struct {
+	Id      string
+	Ip      string
+	Team    int
+	Profile Profile
+	IsAlive bool
+	Score   int // Number of ticks survived.
+}
+
+// Game state streamed by the leader to spectators every tick.
+type SpectatorUpdate struct {
+	Tick      int
+	IsPlaying bool
+	Board     [BOARD_SIZE][BOARD_SIZE]string
+	Players   []*PlayerStatus
+}
+
+const (
+	SPECTATE_RATE     time.Duration = 2000 * time.Millisecond // How often spectators subscribe again.
+	SPECTATOR_TIMEOUT time.Duration = 6000 * time.Millisecond // When players stop streaming to a spectator.
+	MAX_SPECTATORS    int           = 16                      // Spectators a game streams to at once.
+)
+
+var isSpectator bool    // Is this node watching instead of playing.
+var spectatedRoom *Room // The room being watched, nil until one is picked.
+
+// What a game streams to its spectators.
+type spectatorState struct {
+	spectators map[string]time.Time // Ip of each spectator to when it last subscribed.
+	scores     map[string]int       // Id to the number of ticks each player survived.
+}
+
+// SPECTATOR: Ask the matchmaking server for the rooms being played.
+func msListRooms() ([]*Room, error) {
+	client, err := dialRPC(msServerAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	reply := &RoomList{}
+	log := logSend("Rpc Call Context.ListRooms to " + msServerAddr)
+	err = client.Call("Context.ListRooms", &ValReply{Log: log}, reply)
+	if err != nil {
+		return nil, err
+	}
+	logReceive("Rpc reply Context.ListRooms", reply.Log)
+	return reply.Rooms, nil
+}
+
+// SPECTATOR: Keep subscribing to every player of the room, and show the
+// updates the leader streams back.
+func spectateRoom(room *Room) {
+	gameLog.Info("Spectating room", "room", room.Id)
+	go listenSpectatorUpdates(room)
+
+	me := Node{Ip: nodeAddr}
+	for {
+		for _, player := range room.Players {
+			log := logSend("Spectating [to: " + player.Id + " at ip " + player.Ip + "]")
+			msg, err := json.Marshal(&Message{IsSpectate: true, Node: me, Log: log})
+			checkErr(err, 72)
+			packetsSent.inc("spectate")
+			go func(ip string) { checkErr(network.Send(ip, msg), 559) }(player.Ip)
+		}
+		<-clock.After(SPECTATE_RATE)
+	}
+}
+
+// SPECTATOR: Receive the leader's game state and show it. Updates aren't
+// signed, so only those from the room's players are shown.
+func listenSpectatorUpdates(room *Room) {
+	conn, err := network.Listen(nodeAddr)
+	checkErr(err, 85)
+	defer conn.Close()
+
+	// The board makes updates much bigger than player messages.
+	buf := make([]byte, 16384)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		checkErr(err, 92)
+		if !isRoomPlayerAddr(room, addr) {
+			netLog.Warn("Ignoring packet from outside the room", "peer", addr.String())
+			packetsDropped.inc("unknown")
+			continue
+		}
+
+		var message Message
+		if err := json.Unmarshal(buf[0:n], &message); err != nil || message.Spectator == nil {
+			netLog.Warn("Ignoring packet", "peer", addr.String())
+			packetsDropped.inc("unknown")
+			continue
+		}
+		packetsReceived.inc("spectator_update")
+		logReceive("Received spectator update from "+addr.String(), message.Log)
+
+		update := message.Spectator
+		frontend.GameStateUpdate(update.Board)
+		pushPlayersToJS(update.Tick, update.IsPlaying, update.Players)
+	}
+}
+
+// SPECTATOR: Check a packet came from one of the room's players.
+func isRoomPlayerAddr(room *Room, addr net.Addr) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	for _, player := range room.Players {
+		if isFromIp(player.Ip, udpAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a packet came from the host of ip. A spectator has to subscribe from
+// the IP it wants the game streamed to, so that nobody can have the game
+// streamed at someone else. The port is random, since nodes send from a new
+// socket every time.
+func isFromIp(ip string, addr *net.UDPAddr) bool {
+	host, _, err := net.SplitHostPort(ip)
+	if err != nil {
+		return false
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = net.LookupIP(host); err != nil {
+			return false
+		}
+	}
+	for _, claimed := range ips {
+		if claimed.Equal(addr.IP) || (claimed.IsLoopback() && addr.IP.IsLoopback()) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add or renew a spectator of this game, unless it already streams to
+// MAX_SPECTATORS others.
+func (g *Game) addSpectator(ip string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if _, ok := g.spectators[ip]; !ok {
+		if len(g.spectators) >= MAX_SPECTATORS {
+			g.forgetSpectators()
+		}
+		if len(g.spectators) >= MAX_SPECTATORS {
+			netLog.Warn("Too many spectators", "ip", ip)
+			packetsDropped.inc("spectate")
+			return
+		}
+		netLog.Info("New spectator", "ip", ip)
+	}
+	g.spectators[ip] = g.clock.Now()
+}
+
+// Forget the spectators that stopped subscribing. Called with mutex held.
+func (g *Game) forgetSpectators() {
+	for ip, subscribed := range g.spectators {
+		if g.clock.Now().Sub(subscribed) > SPECTATOR_TIMEOUT {
+			netLog.Info("Spectator left", "ip", ip)
+			delete(g.spectators, ip)
+		}
+	}
+}
+
+// LEADER: Stream the game state to every spectator, forgetting those that
+// stopped subscribing.
+func (g *Game) sendSpectatorUpdates() {
+	if len(g.spectators) == 0 {
+		return
+	}
+
+	update := &SpectatorUpdate{Tick: g.tick, IsPlaying: g.isPlaying, Board: g.board}
+	for _, node := range g.nodes {
+		update.Players = append(update.Players, &PlayerStatus{Id: node.Id, Ip: node.Ip,
+			Team: node.Team, Profile: node.Profile, IsAlive: node.IsAlive, Score: g.scores[node.Id]})
+	}
+
+	g.forgetSpectators()
+	for ip := range g.spectators {
+		log := logSend("Sending spectator update [to: " + ip + "]")
+		msg, err := json.Marshal(&Message{IsLeader: true, Spectator: update, Node: *g.myNode, Log: log})
+		checkErr(err, 133)
+		packetsSent.inc("spectator_update")
+		go g.sendUDPPacket(ip, msg)
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+// This file keeps every player's statistics during the game, and sums them up
+// once it is over. Every node keeps its own, but the leader's summary is the
+// authoritative one: the leader keeps sending it to its peers, which show it
+// in place of their own once it arrives.
+
+import "sort"
+
+// Statistics of a player over a game.
+type PlayerStats struct {
+	Id        string
+	Survived  int // Ticks survived.
+	Cells     int // Distinct cells the bike went through.
+	Kills     int // Opponents who crashed into the player's trail or bike.
+	Turns     int // Turns made.
+	Placement int // 1 for the winners. Players who died on the same tick share their placement.
+}
+
+// Statistics of every player once the game is over.
+type GameSummary struct {
+	Tick       int            // Tick the game ended at.
+	IsDraw     bool           // Did the game end in a draw.
+	FromLeader bool           // Is this the leader's summary.
+	Players    []*PlayerStats // Best placement first.
+}
+
+// The statistics of a Game.
+type statsState struct {
+	stats        map[string]*PlayerStats // Id to the statistics of each player.
+	cellsCovered map[string]map[Pos]bool
+	lastHit      map[string]string // Id to the id of the player whose trail or bike it crashed into.
+	deathTicks   map[string]int    // Id to the tick each dead player died at.
+	gameSummary  *GameSummary      // The summary shown, the leader's once it arrived.
+}
+
+// Start keeping statistics, from the nodes' initial positions.
+func (g *Game) startStats() {
+	g.stats = make(map[string]*PlayerStats)
+	g.cellsCovered = make(map[string]map[Pos]bool)
+	g.lastHit = make(map[string]string)
+	g.deathTicks = make(map[string]int)
+	g.gameSummary = nil
+	for _, node := range g.nodes {
+		g.stats[node.Id] = &PlayerStats{Id: node.Id}
+		g.cellsCovered[node.Id] = make(map[Pos]bool)
+		g.statsMove(node.Id, node.CurrLoc.X, node.CurrLoc.Y)
+	}
+}
+
+// Count the cell a bike moved to.
+func (g *Game) statsMove(id string, x int, y int) {
+	if s, ok := g.stats[id]; ok && !g.cellsCovered[id][Pos{x, y}] {
+		g.cellsCovered[id][Pos{x, y}] = true
+		s.Cells++
+	}
+}
+
+// Count a turn made by a player.
+func (g *Game) statsTurn(id string) {
+	if s, ok := g.stats[id]; ok {
+		s.Turns++
+	}
+}
+
+// Remember whose trail or bike a player crashed into, to credit them with the
+// kill once the player dies. Crashing into a wall, into one's own trail or
+// into a teammate isn't anyone's kill.
+func (g *Game) statsCollision(id string, newX int, newY int) {
+	if g.stats == nil {
+		return
+	}
+	delete(g.lastHit, id)
+	if newX < 0 || newY < 0 || newX >= BOARD_SIZE || newY >= BOARD_SIZE {
+		return
+	}
+	cell := g.board[newY][newX]
+	if cell == "" || cell == WALL {
+		return
+	}
+	victim := g.getNode(id)
+	killer := g.getNode("p" + cell[1:])
+	if victim != nil && killer != nil && g.getTeam(victim) != g.getTeam(killer) {
+		g.lastHit[id] = killer.Id
+	}
+}
+
+// Note a player's death, crediting whoever they crashed into.
+func (g *Game) statsDeath(node *Node) {
+	if g.stats == nil {
+		return
+	}
+	g.deathTicks[node.Id] = g.tick
+	if killer, ok := g.stats[g.lastHit[node.Id]]; ok {
+		killer.Kills++
+		gameLog.Info("Kill", "killer", g.playerName(killer.Id), "peer", g.playerName(node.Id))
+	}
+}
+
+// Sum up the game once it is over, and show it until the leader's summary
+// arrives. Players are placed by how long they survived, the winners first.
+func (g *Game) finishStats() {
+	g.mutex.Lock()
+	if g.stats == nil || g.gameSummary != nil {
+		g.mutex.Unlock()
+		return
+	}
+
+	survivors := g.survivingTeams()
+	summary := &GameSummary{Tick: g.tick, IsDraw: g.isDraw, FromLeader: g.isLeader()}
+	lasted := make(map[string]int) // Ticks each player lasted, the winners lasting longest.
+	for _, node := range g.nodes {
+		s := g.stats[node.Id]
+		s.Survived = g.scores[node.Id]
+		lasted[node.Id] = g.tick
+		if t, ok := g.deathTicks[node.Id]; ok {
+			lasted[node.Id] = t
+		}
+		if survivors[g.getTeam(node)] {
+			lasted[node.Id] = g.tick + 1
+		}
+		summary.Players = append(summary.Players, s)
+	}
+	for _, s := range summary.Players {
+		s.Placement = 1
+		for _, other := range summary.Players {
+			if lasted[other.Id] > lasted[s.Id] {
+				s.Placement++
+			}
+		}
+	}
+	sort.Sort(byPlacement(summary.Players))
+	g.mutex.Unlock()
+	gameDuration.observe(g.clock.Now().Sub(g.startTime).Seconds())
+
+	g.logSummary(summary, "this node")
+	g.showSummary(summary)
+}
+
+// Show the leader's summary, in place of ours.
+func (g *Game) receiveSummary(summary *GameSummary) {
+	g.mutex.Lock()
+	done := g.gameSummary != nil && g.gameSummary.FromLeader
+	g.mutex.Unlock()
+	if done {
+		return
+	}
+
+	summary.FromLeader = true
+	g.logSummary(summary, "the leader")
+	g.showSummary(summary)
+}
+
+// Show a summary, unless we already showed the leader's.
+func (g *Game) showSummary(summary *GameSummary) {
+	g.mutex.Lock()
+	if g.gameSummary != nil && g.gameSummary.FromLeader {
+		g.mutex.Unlock()
+		return
+	}
+	g.gameSummary = summary
+	g.mutex.Unlock()
+
+	frontend.GameSummary(summary)
+}
+
+// LEADER: Message to send peers the summary, nil until the game is over.
+// Called with mutex held.
+func (g *Game) summaryMessage() *Message {
+	if g.gameSummary == nil || !g.gameSummary.FromLeader {
+		return nil
+	}
+	return &Message{IsLeader: true, Summary: g.gameSummary, Node: *g.myNode}
+}
+
+func (g *Game) logSummary(summary *GameSummary, seenBy string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, s := range summary.Players {
+		gameLog.Info("Game summary", "seenBy", seenBy, "placement", s.Placement, "peer", g.playerName(s.Id),
+			"survived", s.Survived, "cells", s.Cells, "kills", s.Kills, "turns", s.Turns)
+	}
+}
+
+// Implementation of sort.Interface to sort players by placement.
+type byPlacement []*PlayerStats
+
+func (p byPlacement) Len() int      { return len(p) }
+func (p byPlacement) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byPlacement) Less(i, j int) bool {
+	if p[i].Placement != p[j].Placement {
+		return p[i].Placement < p[j].Placement
+	}
+	return p[i].Id < p[j].Id
+}
@@ -0,0 +1,150 @@
+package main
+
+// This file implements sudden death, which bounds the length of a game: after
+// a number of ticks the outer rings of the board turn into walls one by one,
+// and a game that reaches the maximum duration ends in a draw.
+//
+// Ring ticks are counted from the SuddenDeathTick of the game options, which
+// every node got from the ms server when the game started, rather than from
+// any node's tick when the schedule was sent or received. A node that only
+// hears of sudden death late, or from a new leader, closes the same rings at
+// the same ticks as the others.
+
+// Sent by the leader when sudden death starts.
+type ShrinkSchedule struct {
+	Tick  int   // The tick sudden death started at, the game's SuddenDeathTick.
+	Rings []int // Tick at which each ring turns into walls, outermost first.
+}
+
+const WALL string = "ww" // Board code of a wall cell.
+
+// The sudden death of a Game.
+type suddenDeathState struct {
+	shrinkSchedule *ShrinkSchedule // Rings to close. nil until sudden death.
+	closedRings    int             // Number of rings that are walls.
+	isDraw         bool            // Did the game end in a draw.
+}
+
+// LEADER: Start sudden death once the game has gone on long enough, and
+// tell peers when each ring will close.
+func (g *Game) startSuddenDeath() {
+	if g.shrinkSchedule != nil || g.gameOptions.SuddenDeathTick == 0 ||
+		g.tick < g.gameOptions.SuddenDeathTick {
+		return
+	}
+
+	// Leave the centre of the board open.
+	start := g.gameOptions.SuddenDeathTick
+	rings := make([]int, BOARD_SIZE/2-1)
+	for i := range rings {
+		rings[i] = start + i*g.gameOptions.ShrinkInterval
+	}
+	g.shrinkSchedule = &ShrinkSchedule{Tick: start, Rings: rings}
+	g.recordEvent(&ReplayEvent{Type: REPLAY_SHRINK, Rings: rings})
+	gameLog.Info("Sudden death", "rings", rings)
+	frontend.SuddenDeath()
+
+	msg := &Message{IsLeader: true, Shrink: g.shrinkSchedule, Node: *g.myNode}
+	g.sendPacketsToPeers("Sudden death started", msg)
+}
+
+// NON-LEADER: Adopt the leader's shrink schedule as is. Rings already due
+// close on the next tick.
+func (g *Game) receiveShrinkSchedule(schedule *ShrinkSchedule) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.shrinkSchedule != nil {
+		return
+	}
+	if schedule.Tick != g.gameOptions.SuddenDeathTick {
+		gameLog.Warn("Dropped shrink schedule, not from this game's sudden death tick",
+			"tick", schedule.Tick, "suddenDeathTick", g.gameOptions.SuddenDeathTick)
+		return
+	}
+
+	rings := append([]int(nil), schedule.Rings...)
+	g.shrinkSchedule = &ShrinkSchedule{Tick: schedule.Tick, Rings: rings}
+	g.recordEvent(&ReplayEvent{Type: REPLAY_SHRINK, Rings: rings})
+	gameLog.Info("Leader started sudden death", "rings", rings)
+	frontend.SuddenDeath()
+}
+
+// Turn every ring that is due into walls. Nodes caught on a closing ring
+// crash; only the leader reports it.
+func (g *Game) closeRings() {
+	if g.shrinkSchedule == nil {
+		return
+	}
+
+	for g.closedRings < len(g.shrinkSchedule.Rings) && g.shrinkSchedule.Rings[g.closedRings] <= g.tick {
+		ring := g.closedRings
+		g.closedRings++
+		gameLog.Info("Closing ring", "ring", ring)
+
+		for y := 0; y < BOARD_SIZE; y++ {
+			for x := 0; x < BOARD_SIZE; x++ {
+				if ringOf(x, y) != ring {
+					continue
+				}
+				cell := g.board[y][x]
+				if cell == "" || cell[0] == 't' {
+					if cell != "" {
+						g.removeTrailCell("p"+cell[1:], x, y)
+					}
+					g.board[y][x] = WALL
+				}
+			}
+		}
+
+		if g.isLeader() {
+			died := false
+			for _, node := range g.nodes {
+				if node.IsAlive && ringOf(node.CurrLoc.X, node.CurrLoc.Y) <= ring {
+					died = true
+					node.IsAlive = false
+					g.aliveNodes = g.aliveNodes - 1
+					g.recordDeath(node)
+					g.statsDeath(node)
+					g.board[node.CurrLoc.Y][node.CurrLoc.X] = g.getPlayerState(node.Id)
+					gameLog.Info("Leader sending death report", "peer", g.playerName(node.Id), "ring", ring)
+					if node.Id == g.nodeId {
+						frontend.PlayerDead()
+					}
+					g.reportASorrowfulDeathToPeers(node)
+				}
+			}
+			if died {
+				g.haveIWon()
+			}
+		}
+	}
+}
+
+// Return which ring of the board x, y is on, 0 being the outermost.
+func ringOf(x int, y int) int {
+	return intMin(intMin(x, y), intMin(BOARD_SIZE-1-x, BOARD_SIZE-1-y))
+}
+
+// LEADER: End the game in a draw once it reaches the maximum duration.
+func (g *Game) checkMaxDuration() {
+	if g.gameOptions.MaxTicks == 0 || g.tick < g.gameOptions.MaxTicks || !g.isPlaying {
+		return
+	}
+
+	gameLog.Info("Game reached max ticks, ending in a draw", "maxTicks", g.gameOptions.MaxTicks)
+	g.endInDraw()
+	msg := &Message{IsLeader: true, IsDraw: true, Node: *g.myNode}
+	g.sendPacketsToPeers("Game ended in a draw", msg)
+}
+
+// Stop playing and tell the UI nobody won.
+func (g *Game) endInDraw() {
+	if g.isDraw {
+		return
+	}
+	g.isDraw = true
+	g.isPlaying = false
+	g.recordEvent(&ReplayEvent{Type: REPLAY_DRAW})
+	gameLog.Info("DRAW")
+	frontend.GameDraw()
+}
@@ -0,0 +1,280 @@
+package main
+
+// This file implements the terminal frontend, so the game can be played over
+// SSH: the node joins the matchmaking server straight away, draws the board
+// in colour next to every player's status, and reads turns from WASD or the
+// arrow keys. While waiting for players, r says we are ready to start. Logs
+// only go to the log file, since they would scroll the board away.
+
+import (
+	"fmt"
+	"github.com/nsf/termbox-go"
+	"os"
+	"sync"
+)
+
+var isTerminal bool   // Is this node played from the terminal.
+var terminalOpen bool // Has termbox taken over the terminal.
+
+// Colour of each player, as close as the terminal gets to the browser's.
+var terminalPlayerColours = map[byte]termbox.Attribute{
+	'1': termbox.ColorRed,
+	'2': termbox.ColorGreen,
+	'3': termbox.ColorBlue,
+	'4': termbox.ColorYellow,
+	'5': termbox.ColorMagenta,
+	'6': termbox.ColorCyan,
+}
+
+// Colour of each team, used instead of the player colours when playing in
+// teams.
+var terminalTeamColours = map[int]termbox.Attribute{
+	1: termbox.ColorRed,
+	2: termbox.ColorBlue,
+	3: termbox.ColorGreen,
+}
+
+// Keys that turn the player.
+var terminalKeys = map[termbox.Key]string{
+	termbox.KeyArrowUp:    DIRECTION_UP,
+	termbox.KeyArrowDown:  DIRECTION_DOWN,
+	termbox.KeyArrowLeft:  DIRECTION_LEFT,
+	termbox.KeyArrowRight: DIRECTION_RIGHT,
+}
+var terminalRunes = map[rune]string{
+	'w': DIRECTION_UP,
+	's': DIRECTION_DOWN,
+	'a': DIRECTION_LEFT,
+	'd': DIRECTION_RIGHT,
+}
+
+// Frontend of nodes played from the terminal.
+type terminalFrontend struct {
+	lock    sync.Mutex
+	tick    int
+	board   [BOARD_SIZE][BOARD_SIZE]string
+	players []*PlayerStatus
+	status  string   // What happened to us, shown under the player list.
+	summary []string // Every player's statistics once the game is over, shown under the status.
+}
+
+func newTerminalFrontend() *terminalFrontend {
+	return &terminalFrontend{status: "Looking for players..."}
+}
+
+func (f *terminalFrontend) LobbyUpdate(status *LobbyStatus) {
+	if status == nil {
+		f.setStatus("Left the queue")
+		return
+	}
+	_, ready, _ := queueState()
+	readyText := "r when ready"
+	if ready {
+		readyText = "ready, r to unready"
+	}
+	f.setStatus(fmt.Sprintf("Room %d: %d/%d players (%d needed), %d ready, next check in %ds. %s",
+		status.RoomId, status.Waiting, status.Capacity, status.MinPlayers, status.Ready,
+		int(status.StartsIn.Seconds()), readyText))
+}
+
+func (f *terminalFrontend) StartGame() {
+	game.mutex.Lock()
+	name := game.playerName(game.nodeId)
+	game.mutex.Unlock()
+	f.setStatus("Playing as " + name + ", WASD or arrows to turn")
+}
+
+// Called with mutex held.
+func (f *terminalFrontend) GameStateUpdate(state [BOARD_SIZE][BOARD_SIZE]string) {
+	players := make([]*PlayerStatus, 0, len(game.nodes))
+	for _, node := range game.nodes {
+		players = append(players, &PlayerStatus{Id: node.Id, Ip: node.Ip, Team: node.Team,
+			Profile: node.Profile, IsAlive: node.IsAlive, Score: game.scores[node.Id]})
+	}
+
+	f.lock.Lock()
+	f.tick = game.tick
+	f.board = state
+	f.players = players
+	f.lock.Unlock()
+	f.draw()
+}
+
+func (f *terminalFrontend) PlayerDead() {
+	f.setStatus("You are dead!")
+}
+
+func (f *terminalFrontend) PlayerVictory() {
+	f.setStatus("YOU WIN!")
+}
+
+func (f *terminalFrontend) SuddenDeath() {
+	f.setStatus("Sudden death! The arena is shrinking.")
+}
+
+func (f *terminalFrontend) GameDraw() {
+	f.setStatus("Time's up, it's a draw!")
+}
+
+func (f *terminalFrontend) GameSummary(summary *GameSummary) {
+	lines := []string{"#  Player            Ticks Cells Kills Turns"}
+	game.mutex.Lock()
+	for _, s := range summary.Players {
+		lines = append(lines, fmt.Sprintf("%-2d %-17s %5d %5d %5d %5d", s.Placement,
+			game.playerName(s.Id), s.Survived, s.Cells, s.Kills, s.Turns))
+	}
+	game.mutex.Unlock()
+	if !summary.FromLeader {
+		lines = append(lines, "(waiting for the leader's summary)")
+	}
+
+	f.lock.Lock()
+	f.summary = lines
+	f.lock.Unlock()
+	f.draw()
+}
+
+func (f *terminalFrontend) QueueError(err error) {
+	f.setStatus("The matchmaking server turned us away: " + err.Error() + ", q to quit")
+}
+
+func (f *terminalFrontend) setStatus(status string) {
+	f.lock.Lock()
+	f.status = status
+	f.lock.Unlock()
+	f.draw()
+}
+
+// Return the colour to draw a board cell with. Called with lock held.
+func (f *terminalFrontend) colour(cell string) termbox.Attribute {
+	if cell == WALL {
+		return termbox.ColorWhite
+	}
+	for _, player := range f.players {
+		if player.Id == "p"+cell[1:] && player.Team > 0 {
+			return terminalTeamColours[player.Team]
+		}
+	}
+	return terminalPlayerColours[cell[1]]
+}
+
+// Write a string at x, y.
+func terminalPrint(x int, y int, fg termbox.Attribute, s string) {
+	for _, r := range s {
+		termbox.SetCell(x, y, r, fg, termbox.ColorDefault)
+		x++
+	}
+}
+
+// Redraw the whole screen: the board, with every player's status and ours on
+// its right.
+func (f *terminalFrontend) draw() {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	termbox.Clear(termbox.ColorDefault, termbox.ColorDefault)
+
+	// Every cell is two characters wide, to look about square.
+	for y := 0; y < BOARD_SIZE; y++ {
+		for x := 0; x < BOARD_SIZE; x++ {
+			cell := f.board[y][x]
+			text, fg := " .", termbox.ColorDefault
+			switch {
+			case cell == WALL:
+				text = "##"
+			case cell == "":
+			case cell[0] == 'p':
+				text = "[]"
+			case cell[0] == 't':
+				text = "::"
+			case cell[0] == 'd':
+				text = "XX"
+			}
+			if cell != "" {
+				fg = f.colour(cell) | termbox.AttrBold
+			}
+			terminalPrint(2*x, y, fg, text)
+		}
+	}
+
+	panel := 2*BOARD_SIZE + 3
+	terminalPrint(panel, 0, termbox.AttrBold, fmt.Sprintf("GoTron  tick %d", f.tick))
+	for i, player := range f.players {
+		state := "alive"
+		if !player.IsAlive {
+			state = "dead"
+		}
+		team := ""
+		if player.Team > 0 {
+			team = fmt.Sprintf(" team %d", player.Team)
+		}
+		line := fmt.Sprintf("%s %-16s%s  %-5s %4d", player.Id, player.Profile.Name, team, state,
+			player.Score)
+		terminalPrint(panel, i+2, f.colour(player.Id), line)
+	}
+	terminalPrint(panel, len(f.players)+3, termbox.AttrBold, f.status)
+	for i, line := range f.summary {
+		terminalPrint(panel, len(f.players)+4+i, termbox.ColorDefault, line)
+	}
+	terminalPrint(panel, len(f.players)+len(f.summary)+4, termbox.ColorDefault, "q to quit")
+	termbox.Flush()
+}
+
+// Give the terminal back, e.g. before exiting.
+func closeTerminal() {
+	if terminalOpen {
+		terminalOpen = false
+		termbox.Close()
+	}
+}
+
+// Join a game played from the terminal.
+func terminalServe() {
+	defer waitGroup.Done()
+	err := termbox.Init()
+	checkErr(err, 169)
+	terminalOpen = true
+	// Logs would be drawn over the board.
+	muteConsole()
+
+	frontend.(*terminalFrontend).draw()
+	go readKeys()
+	if err := joinAndPlay(); err != nil {
+		select {} // The error stays on the screen until the player quits.
+	}
+	frontend.(*terminalFrontend).setStatus("Game over, q to quit")
+	select {} // Wait for the player to quit.
+}
+
+// Turn the player as keys are pressed, until q, Esc or Ctrl-C.
+func readKeys() {
+	for {
+		event := termbox.PollEvent()
+		switch event.Type {
+		case termbox.EventResize:
+			frontend.(*terminalFrontend).draw()
+			continue
+		case termbox.EventKey:
+		default:
+			continue
+		}
+
+		if event.Ch == 'q' || event.Key == termbox.KeyEsc || event.Key == termbox.KeyCtrlC {
+			closeTerminal()
+			uiLog.Info("Quit from the terminal")
+			os.Exit(0)
+		}
+		if event.Ch == 'r' {
+			if in, ready, _ := queueState(); in {
+				go setReady(!ready)
+			}
+			continue
+		}
+		direction, ok := terminalKeys[event.Key]
+		if !ok {
+			direction, ok = terminalRunes[event.Ch]
+		}
+		if ok && game.canTurn() {
+			game.notifyPeersDirChanged(direction)
+		}
+	}
+}
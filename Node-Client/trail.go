@@ -0,0 +1,88 @@
+package main
+
+// This file keeps track of the ordered trail every node leaves behind it, so
+// trails can be limited in length or fade away after a number of ticks.
+
+// A cell of a node's trail and the tick it was laid at.
+type TrailCell struct {
+	Pos  Pos
+	Tick int
+}
+
+// The trails of a Game.
+type trailState struct {
+	tick   int                     // Number of ticks since the game started.
+	trails map[string][]*TrailCell // Id to the trail of each node, oldest cell first.
+}
+
+// Lay a trail cell for the node with the given id at x, y.
+func (g *Game) layTrail(id string, x int, y int) {
+	g.layTrailAtTick(id, x, y, g.tick)
+}
+
+// Lay a trail cell for the node with the given id at x, y, as if it was laid
+// at the given tick. A cell already in the trail is moved to the newest end.
+func (g *Game) layTrailAtTick(id string, x int, y int, at int) {
+	g.removeTrailCell(id, x, y)
+	g.board[y][x] = "t" + id[len(id)-1:]
+	g.trails[id] = append(g.trails[id], &TrailCell{Pos: Pos{X: x, Y: y}, Tick: at})
+}
+
+// Remove the trail cell at x, y of the node with the given id, and clear it
+// from the board.
+func (g *Game) eraseTrail(id string, x int, y int) {
+	g.removeTrailCell(id, x, y)
+	g.board[y][x] = ""
+}
+
+// Remove x, y from the trail of the node with the given id, if present.
+func (g *Game) removeTrailCell(id string, x int, y int) {
+	trail := g.trails[id]
+	for i, cell := range trail {
+		if cell.Pos.X == x && cell.Pos.Y == y {
+			g.trails[id] = append(trail[:i], trail[i+1:]...)
+			return
+		}
+	}
+}
+
+// Remove the oldest cells of every trail that are over the trail length limit
+// or older than the trail lifetime.
+func (g *Game) fadeTrails() {
+	for id, trail := range g.trails {
+		trailCode := "t" + id[len(id)-1:]
+		faded := 0
+		for faded < len(trail) && g.hasFaded(trail[faded], len(trail)-faded) {
+			pos := trail[faded].Pos
+			// Someone else may have since run over this cell.
+			if g.board[pos.Y][pos.X] == trailCode {
+				g.board[pos.Y][pos.X] = ""
+			}
+			faded++
+		}
+		g.trails[id] = trail[faded:]
+	}
+}
+
+// Check if a trail cell should fade, given how long the trail is from this
+// cell to its newest end.
+func (g *Game) hasFaded(cell *TrailCell, length int) bool {
+	if g.gameOptions.TrailLength > 0 && length > g.gameOptions.TrailLength {
+		return true
+	}
+	if g.gameOptions.TrailLifetime > 0 && g.tick-cell.Tick >= g.gameOptions.TrailLifetime {
+		return true
+	}
+	return false
+}
+
+// Return the node's current location followed by at most n-1 of its most
+// recent trail cells, newest first.
+func (g *Game) recentMoves(node *Node, n int) []*Pos {
+	moves := []*Pos{node.CurrLoc}
+	trail := g.trails[node.Id]
+	for i := len(trail) - 1; i >= 0 && len(moves) < n; i-- {
+		moves = append(moves, &Pos{X: trail[i].Pos.X, Y: trail[i].Pos.Y})
+	}
+	return moves
+}
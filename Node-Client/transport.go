@@ -0,0 +1,158 @@
+package main
+
+// This file implements the optional secure transports. RPCs with the
+// matchmaking server go over mutual TLS when the node is given a certificate,
+// its key and the CA of the deployment. Packets to peers are encrypted with
+// AES-256-GCM when the matchmaking server hands out a peer key at the start of
+// the game; signed packets are sealed as a whole, so encryption sits under the
+// authentication in auth.go rather than replacing it.
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// A packet encrypted with the peer key.
+type SealedPacket struct {
+	Nonce []byte // Random, NonceSize bytes.
+	Box   []byte // The signed packet, encrypted and authenticated.
+}
+
+var tlsCert string // Certificate to talk to the ms server with, signed by tlsCA.
+var tlsKey string
+var tlsCA string
+var tlsConfig *tls.Config // Nil when RPCs are plaintext.
+
+// What a game needs to encrypt the packets to its peers.
+type peerState struct {
+	peerLock   sync.Mutex
+	peerCipher cipher.AEAD // Nil when packets to peers aren't encrypted.
+}
+
+// Load the certificate, its key and the CA of the deployment. All three are
+// needed to turn TLS on, none to leave it off.
+func setupTLS() error {
+	if tlsCert == "" && tlsKey == "" && tlsCA == "" {
+		return nil
+	}
+	if tlsCert == "" || tlsKey == "" || tlsCA == "" {
+		return errors.New("TLS needs -tlscert, -tlskey and -tlsca")
+	}
+
+	cert, err := tls.LoadX509KeyPair(tlsCert, tlsKey)
+	if err != nil {
+		return err
+	}
+	caPem, err := ioutil.ReadFile(tlsCA)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return errors.New("no certificate found in " + tlsCA)
+	}
+
+	tlsConfig = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	msLog.Info("RPCs use TLS", "ca", tlsCA)
+	return nil
+}
+
+// Listen for the ms server's RPCs, over TLS when it is on.
+func listenRPC(addr string) (net.Listener, error) {
+	if tlsConfig == nil {
+		return net.Listen("tcp", addr)
+	}
+	return tls.Listen("tcp", addr, tlsConfig)
+}
+
+// Dial the ms server, over TLS when it is on.
+func dialRPC(addr string) (*rpc.Client, error) {
+	if tlsConfig == nil {
+		return rpc.Dial("tcp", addr)
+	}
+	conn, err := tls.Dial("tcp", addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	return rpc.NewClient(conn), nil
+}
+
+// Start encrypting packets to peers with the key of a new game, or stop if
+// the ms server didn't send one.
+func (g *Game) startEncryption(key []byte) error {
+	g.peerLock.Lock()
+	defer g.peerLock.Unlock()
+	g.peerCipher = nil
+	if len(key) == 0 {
+		return nil
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	g.peerCipher, err = cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	authLog.Info("Packets to peers are encrypted")
+	return nil
+}
+
+func (g *Game) isEncrypted() bool {
+	g.peerLock.Lock()
+	defer g.peerLock.Unlock()
+	return g.peerCipher != nil
+}
+
+// Encrypt a signed packet for peers, if packets are encrypted.
+func (g *Game) sealPacket(data []byte) ([]byte, error) {
+	g.peerLock.Lock()
+	defer g.peerLock.Unlock()
+	if g.peerCipher == nil {
+		return data, nil
+	}
+
+	nonce := make([]byte, g.peerCipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return json.Marshal(&SealedPacket{Nonce: nonce, Box: g.peerCipher.Seal(nil, nonce, data, nil)})
+}
+
+// Decrypt a packet received from a peer. Packets that aren't sealed are
+// returned as they are, and the caller decides whether to accept them; the
+// bool tells if the packet was sealed. A packet that can't be decrypted
+// returns nil.
+func (g *Game) openPacket(data []byte) ([]byte, bool) {
+	var packet SealedPacket
+	if err := json.Unmarshal(data, &packet); err != nil || packet.Box == nil {
+		return data, false
+	}
+
+	g.peerLock.Lock()
+	defer g.peerLock.Unlock()
+	if g.peerCipher == nil || len(packet.Nonce) != g.peerCipher.NonceSize() {
+		return nil, true
+	}
+	plain, err := g.peerCipher.Open(nil, packet.Nonce, packet.Box, nil)
+	if err != nil {
+		return nil, true
+	}
+	return plain, true
+}
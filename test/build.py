@@ -31,7 +31,8 @@ def main():
     stages = [
         BuildStage("MS Server",
                    common.MATCHMAKING_DIR,
-                   ["go", "build", "MS.go", "log.go"]),
+                   ["go", "build", "MS.go", "abuse.go", "bots.go", "lobby.go", "log.go",
+                    "metrics.go", "profile.go", "cheats.go", "trace.go", "transport.go"]),
     ]
 
     if args.use_go_build:
@@ -35,13 +35,17 @@ class CommonBinary(object):
     def wait(self):
         self._process.wait()
 
+    def has_exited(self):
+        return self._process.poll() is not None
+
 class MatchMakingServer(CommonBinary):
     # The number of seconds the game start timer expires.
     GAME_START_TIMEOUT = 30
 
-    def __init__(self, port):
+    def __init__(self, port, extra_args=None):
         super(MatchMakingServer, self).__init__()
         self.port = port
+        self._extra_args = extra_args or []
         self.local_log_path = os.path.join(
             MATCHMAKING_DIR, "127.0.0.1{}-local.txt".format(port))
         self.govector_log_path = os.path.join(
@@ -64,57 +68,79 @@ class MatchMakingServer(CommonBinary):
         # We force the working directory to be |MATCHMAKING_DIR| so tests can
         # use a fixed path to log files.
         with use_cwd(MATCHMAKING_DIR), open(os.devnull, "w") as dev_null:
-            self._process = subprocess.Popen([self._bin_path,
-                                              "localhost:{}".format(self.port)],
-                                             stdout=dev_null,
-                                             stderr=dev_null)
+            self._process = subprocess.Popen(
+                [self._bin_path] + self._extra_args +
+                ["localhost:{}".format(self.port)],
+                stdout=dev_null,
+                stderr=dev_null)
 
 class Client(CommonBinary):
-    def __init__(self, node_port, node_rpc_port, ms_port, http_srv_port):
+    def __init__(self, node_port, node_rpc_port, ms_port, http_srv_port,
+                 headless_script_path=None, extra_args=None):
+        """If |headless_script_path| is given, the client runs in headless mode
+        playing the turns in that file, and writes its game events to
+        |events_path|. |extra_args| are passed before the addresses, e.g. to
+        pick a name.
+        """
         super(Client, self).__init__()
         self.node_port = node_port
         self._node_rpc_port = node_rpc_port
         self._ms_port = ms_port
         self._http_srv_port = http_srv_port
+        self._headless_script_path = headless_script_path
+        self._extra_args = extra_args or []
         self.local_log_path = os.path.join(
             NODE_CLIENT_DIR, "localhost{}-local.txt".format(node_port))
         self.govector_log_path = os.path.join(
             NODE_CLIENT_DIR, "localhost{}-Log.txt".format(node_port))
+        self.events_path = os.path.join(
+            NODE_CLIENT_DIR, "localhost{}-events.txt".format(node_port))
 
-        possible_bin_paths = [
-            os.path.join(NODE_CLIENT_DIR, ".vendor", "bin", "Node-Client"),
-            os.path.join(NODE_CLIENT_DIR, "Node-Client.exe"),
-        ]
-
-        env = os.environ
-        if "GOBIN" in env:
-            possible_bin_paths.append(os.path.join(env["GOBIN"], "Node-Client"))
-            possible_bin_paths.append(os.path.join(env["GOBIN"],
-                                                   "Node-Client.exe"))
-
-        for possible_bin_path in possible_bin_paths:
-            if not os.path.isfile(possible_bin_path):
-                continue
-            self._bin_path = possible_bin_path
-            break
-
-        if not self._bin_path:
-            raise Exception("Couldn't find client binary to run")
+        self._bin_path = client_bin_path()
 
     def start(self):
+        # Tests look for the leader and node changes, which are logged at the
+        # debug level.
+        args = [self._bin_path, "-loglevel", "debug"]
+        stdout_path = os.devnull
+        if self._headless_script_path:
+            args += ["-headless", "-script", self._headless_script_path]
+            stdout_path = self.events_path
+        args += self._extra_args
+
         # Our HTML assets are only loaded if we run the binary from the correct
         # cwd.
-        with use_cwd(NODE_CLIENT_DIR), open(os.devnull, "w") as dev_null:
-            self._process = subprocess.Popen([
-                self._bin_path,
+        with use_cwd(NODE_CLIENT_DIR), open(os.devnull, "w") as dev_null, \
+                open(stdout_path, "w") as stdout:
+            self._process = subprocess.Popen(args + [
                 "localhost:{}".format(self.node_port),
                 "localhost:{}".format(self._node_rpc_port),
                 "localhost:{}".format(self._ms_port),
                 "localhost:{}".format(self._http_srv_port)
             ],
-            stdout=dev_null,
+            stdout=stdout,
             stderr=dev_null)
 
+def client_bin_path():
+    """Returns the path to the client binary, raising if it can't be found."""
+    possible_bin_paths = [
+        os.path.join(NODE_CLIENT_DIR, ".vendor", "bin", "Node-Client"),
+        os.path.join(NODE_CLIENT_DIR, "Node-Client"),
+        os.path.join(NODE_CLIENT_DIR, "Node-Client.exe"),
+    ]
+
+    env = os.environ
+    if "GOBIN" in env:
+        possible_bin_paths.append(os.path.join(env["GOBIN"], "Node-Client"))
+        possible_bin_paths.append(os.path.join(env["GOBIN"],
+                                               "Node-Client.exe"))
+
+    for possible_bin_path in possible_bin_paths:
+        if os.path.isfile(possible_bin_path):
+            return possible_bin_path
+
+    raise Exception("Couldn't find client binary to run")
+
 class TestCase(unittest.TestCase):
     """A wrapper to avoid the need to constantly duplicate common test case code.
     """
@@ -124,7 +150,9 @@ class TestCase(unittest.TestCase):
     def tearDown(self):
         kill_remaining_processes()
 
-def start_multiple_clients(ms_srv_port, client_count):
+def start_multiple_clients(ms_srv_port, client_count,
+                           headless_script_path=None, extra_args_list=None):
+    """|extra_args_list|, if given, has the extra arguments of each client."""
     clients = []
     for client_num in range(client_count):
         node_port = 9999 - (client_num * 3)
@@ -133,7 +161,10 @@ def start_multiple_clients(ms_srv_port, client_count):
         clients.append(Client(node_port=node_port,
                               node_rpc_port=node_rpc_port,
                               ms_port=ms_srv_port,
-                              http_srv_port=http_srv_port))
+                              http_srv_port=http_srv_port,
+                              headless_script_path=headless_script_path,
+                              extra_args=(extra_args_list[client_num]
+                                          if extra_args_list else None)))
         print ("Starting client w/ node port {}, RPC port {}, MS port {}, HTTP "
                "port {}".format(node_port, node_rpc_port, ms_srv_port,
                                 http_srv_port))
@@ -0,0 +1,60 @@
+#!/usr/bin/env python2
+
+import json
+import os
+import sys
+import unittest
+
+_HERE = os.path.dirname(os.path.abspath(__file__))
+sys.path.append(os.path.dirname(_HERE))
+
+import common
+
+class HeadlessEventsTest(common.TestCase):
+    def test_events(self):
+        """Two headless clients play a scripted game. Each writes a startGame
+        event followed by game state updates to stdout as JSON lines, and the
+        game ends with exactly one of them winning.
+        """
+        ms_srv = common.MatchMakingServer(2222)
+        ms_srv.start()
+        common.sleep(2)
+
+        clients = common.start_multiple_clients(
+            ms_srv.port, 2,
+            headless_script_path=os.path.join(_HERE, "straight.txt"))
+
+        common.sleep(common.MatchMakingServer.GAME_START_TIMEOUT + 20)
+
+        winners = 0
+        for client in clients:
+            with open(client.events_path) as events_file:
+                events = [json.loads(line) for line in events_file]
+            # Skip the lobby updates sent while waiting for the game.
+            events = [event for event in events if event["event"] != "lobby"]
+
+            self.assertTrue(len(events) > 1, "Client should have written events")
+            self.assertEqual(events[0]["event"], "startGame",
+                             "First event should start the game")
+            self.assertIn("board", events[1], "Game state should have a board")
+            names = [event["event"] for event in events]
+            if "playerVictory" in names:
+                winners += 1
+
+            # The last summary written is the leader's, and puts the winner
+            # first.
+            summaries = [event["summary"] for event in events
+                         if event["event"] == "gameSummary"]
+            self.assertTrue(summaries, "Client should have written a summary")
+            summary = summaries[-1]
+            self.assertTrue(summary["FromLeader"],
+                            "Last summary should be the leader's")
+            self.assertEqual(len(summary["Players"]), 2,
+                             "Summary should have both players")
+            self.assertEqual(summary["Players"][0]["Placement"], 1,
+                             "Summary should put the winner first")
+
+        self.assertEqual(winners, 1, "Exactly one client should have won")
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,59 @@
+#!/usr/bin/env python2
+
+import json
+import os
+import sys
+import unittest
+
+_HERE = os.path.dirname(os.path.abspath(__file__))
+sys.path.append(os.path.dirname(_HERE))
+
+import common
+
+class ProfilesTest(common.TestCase):
+    def test_names(self):
+        """Two headless clients join with their own names, and each is told
+        its name when the game starts.
+        """
+        ms_srv = common.MatchMakingServer(2222)
+        ms_srv.start()
+        common.sleep(2)
+
+        names = ["alice", "bob"]
+        clients = common.start_multiple_clients(
+            ms_srv.port, 2,
+            headless_script_path=os.path.join(_HERE, "straight.txt"),
+            extra_args_list=[["-name", name] for name in names])
+
+        common.sleep(common.MatchMakingServer.GAME_START_TIMEOUT + 5)
+
+        for client, name in zip(clients, names):
+            with open(client.events_path) as events_file:
+                events = [json.loads(line) for line in events_file]
+            starts = [event for event in events if event["event"] == "startGame"]
+            self.assertEqual(len(starts), 1, "Client should have started a game")
+            self.assertEqual(starts[0]["name"], name,
+                             "Client should play under its name")
+
+    def test_duplicate_name(self):
+        """A client joining with a name already waiting in the room is turned
+        away by the matchmaking server and exits.
+        """
+        ms_srv = common.MatchMakingServer(2222)
+        ms_srv.start()
+        common.sleep(2)
+
+        clients = common.start_multiple_clients(
+            ms_srv.port, 2,
+            headless_script_path=os.path.join(_HERE, "straight.txt"),
+            extra_args_list=[["-name", "alice"], ["-name", "Alice"]])
+
+        common.sleep(5)
+
+        self.assertFalse(clients[0].has_exited(),
+                         "First client should still be waiting")
+        self.assertTrue(clients[1].has_exited(),
+                        "Client with a taken name should have exited")
+
+if __name__ == "__main__":
+    unittest.main()
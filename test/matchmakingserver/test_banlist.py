@@ -0,0 +1,60 @@
+#!/usr/bin/env python2
+
+import json
+import os
+import shutil
+import sys
+import tempfile
+import unittest
+
+_HERE = os.path.dirname(os.path.abspath(__file__))
+sys.path.append(os.path.dirname(_HERE))
+
+import common
+
+BANNED_ID = "0badc0ffee"
+
+class BanListTest(common.TestCase):
+    def setUp(self):
+        super(BanListTest, self).setUp()
+        self.tmp_dir = tempfile.mkdtemp()
+        self.ban_list_path = os.path.join(self.tmp_dir, "bans.txt")
+        with open(self.ban_list_path, "w") as ban_list:
+            ban_list.write("# banned for testing\nplayer {}\n".format(BANNED_ID))
+        self.profile_path = os.path.join(self.tmp_dir, "banned.json")
+        with open(self.profile_path, "w") as profile:
+            json.dump({"PlayerId": BANNED_ID, "Name": "banned"}, profile)
+
+    def tearDown(self):
+        super(BanListTest, self).tearDown()
+        shutil.rmtree(self.tmp_dir)
+
+    def test_banned_player(self):
+        """c1 is banned by player id and c2 isn't. c1 should be turned away,
+        and only c2 should wait in the room.
+        """
+        ms_srv = common.MatchMakingServer(
+            2222, extra_args=["-banlist", self.ban_list_path])
+        ms_srv.start()
+        common.sleep(2)
+
+        clients = common.start_multiple_clients(
+            ms_srv.port, 2,
+            headless_script_path=os.path.join(os.path.dirname(_HERE),
+                                              "headless", "straight.txt"),
+            extra_args_list=[["-profile", self.profile_path], []])
+        common.sleep(3)
+
+        with open(ms_srv.local_log_path) as log_file:
+            log = log_file.read()
+        self.assertIn("msg=\"Rejected banned player\"", log,
+                      "MS server should turn the banned player away")
+        self.assertIn("player=" + BANNED_ID, log,
+                      "MS server should turn the banned player away")
+        self.assertIn("msg=Join", log,
+                      "The other player should be let in")
+        self.assertTrue(clients[0].has_exited(),
+                        "The banned client should give up")
+
+if __name__ == "__main__":
+    unittest.main()
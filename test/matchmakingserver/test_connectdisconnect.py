@@ -35,7 +35,7 @@ class ConnectDisconnectTest(common.TestCase):
                 if "Starting Game" in line:
                     starting_game_found = True
                     continue
-                elif "1 players" in line:
+                elif "players=1" in line:
                     player_count_found = True
                     continue
 
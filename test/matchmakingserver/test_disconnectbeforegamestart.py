@@ -45,10 +45,10 @@ class DisconnectBeforeGameStartTest(common.TestCase):
                 if "Starting Game" in line:
                     starting_game_found = True
                     continue
-                elif "1 players" in line:
+                elif "players=1" in line:
                     one_player_found = True
                     continue
-                elif "2 players" in line:
+                elif "players=2" in line:
                     two_players_found = True
                     continue
 
@@ -0,0 +1,47 @@
+#!/usr/bin/env python2
+
+import os
+import sys
+import unittest
+
+_HERE = os.path.dirname(os.path.abspath(__file__))
+sys.path.append(os.path.dirname(_HERE))
+
+import common
+
+# Seconds the MS server gives bots to join before starting the game.
+BOT_JOIN_DELAY = 5
+
+class FillWithBotsTest(common.TestCase):
+    def test_fill_with_bots(self):
+        """c1 connects to a matchmaking server that fills rooms with bots. When
+        the timer fires, bots are launched to fill the room and the game starts.
+        """
+        ms_srv = common.MatchMakingServer(
+            2222, extra_args=["-bots", common.client_bin_path()])
+        ms_srv.start()
+        common.sleep(2)
+
+        _ = common.start_multiple_clients(ms_srv.port, 1)
+
+        common.sleep(common.MatchMakingServer.GAME_START_TIMEOUT +
+                     BOT_JOIN_DELAY + 2)
+
+        bots_launched = False
+        starting_game_found = False
+        full_room_found = False
+        with open(ms_srv.local_log_path) as log_file:
+            for line in log_file:
+                if "count=5 level=medium" in line:
+                    bots_launched = True
+                elif "Starting Game" in line:
+                    starting_game_found = True
+                elif "players=6" in line:
+                    full_room_found = True
+
+        self.assertTrue(bots_launched, "Bots should have filled the room")
+        self.assertTrue(full_room_found, "Bots should have joined")
+        self.assertTrue(starting_game_found, "Game should have started")
+
+if __name__ == "__main__":
+    unittest.main()
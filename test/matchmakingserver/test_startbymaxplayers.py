@@ -37,22 +37,22 @@ class StartByMaxPlayersTest(common.TestCase):
                 if "Starting Game" in line:
                     starting_game_found = True
                     continue
-                elif "1 players" in line:
+                elif "players=1" in line:
                     one_player_found = True
                     continue
-                elif "2 players" in line:
+                elif "players=2" in line:
                     two_players_found = True
                     continue
-                elif "3 players" in line:
+                elif "players=3" in line:
                     three_players_found = True
                     continue
-                elif "4 players" in line:
+                elif "players=4" in line:
                     four_players_found = True
                     continue
-                elif "5 players" in line:
+                elif "players=5" in line:
                     five_players_found = True
                     continue
-                elif "6 players" in line:
+                elif "players=6" in line:
                     six_players_found = True
                     continue
 
@@ -0,0 +1,75 @@
+#!/usr/bin/env python2
+
+import json
+import os
+import shutil
+import sys
+import tempfile
+import unittest
+import urllib2
+
+_HERE = os.path.dirname(os.path.abspath(__file__))
+sys.path.append(os.path.dirname(_HERE))
+
+import common
+
+TOKEN = "debug-token-for-testing"
+METRICS_PORT = 9900
+
+def get(path, token=None):
+    request = urllib2.Request("http://localhost:{}{}".format(METRICS_PORT, path))
+    if token:
+        request.add_header("Authorization", "Bearer " + token)
+    return urllib2.urlopen(request, timeout=5)
+
+class DebugEndpointsTest(common.TestCase):
+    def setUp(self):
+        super(DebugEndpointsTest, self).setUp()
+        self.tmp_dir = tempfile.mkdtemp()
+        self.token_path = os.path.join(self.tmp_dir, "token")
+        with open(self.token_path, "w") as token_file:
+            token_file.write(TOKEN + "\n")
+
+    def tearDown(self):
+        super(DebugEndpointsTest, self).tearDown()
+        shutil.rmtree(self.tmp_dir)
+
+    def test_debug_endpoints(self):
+        """Two clients play, the first serving the debug endpoints. They
+        should only answer requests with the token, and show the game. The
+        clients aren't headless, so they don't exit once the game is over.
+        """
+        ms_srv = common.MatchMakingServer(2222)
+        ms_srv.start()
+        common.sleep(2)
+
+        common.start_multiple_clients(
+            ms_srv.port, 2,
+            extra_args_list=[["-admintoken", self.token_path,
+                              "-metrics", "localhost:{}".format(METRICS_PORT)],
+                             []])
+        common.sleep(common.MatchMakingServer.GAME_START_TIMEOUT + 3)
+
+        for path in ["/debug/state", "/debug/peers", "/debug/messages",
+                     "/debug/pprof/"]:
+            with self.assertRaises(urllib2.HTTPError) as context:
+                get(path)
+            self.assertEquals(context.exception.code, 401,
+                              "{} should need the token".format(path))
+            with self.assertRaises(urllib2.HTTPError):
+                get(path, token="wrong")
+
+        state = json.load(get("/debug/state", token=TOKEN))
+        self.assertEquals(state["Game"], 1, "The first game should have id 1")
+        self.assertEquals(len(state["Board"]), 10, "The board should be dumped")
+        peers = json.load(get("/debug/peers", token=TOKEN))
+        self.assertEquals(peers["Leader"], peers["Nodes"][0]["Id"],
+                          "The leader should be the first node")
+        messages = json.load(get("/debug/messages", token=TOKEN))
+        self.assertTrue(any(m["Direction"] == "in" for m in messages),
+                        "Packets received should be listed")
+        self.assertTrue(any(m["Direction"] == "out" for m in messages),
+                        "Packets sent should be listed")
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,53 @@
+#!/usr/bin/env python2
+
+import base64
+import json
+import os
+import socket
+import sys
+import unittest
+
+_HERE = os.path.dirname(os.path.abspath(__file__))
+sys.path.append(os.path.dirname(_HERE))
+
+import common
+
+def send_udp(port, data):
+    sock = socket.socket(socket.AF_INET, socket.SOCK_DGRAM)
+    sock.sendto(data, ("127.0.0.1", port))
+    sock.close()
+
+class SpoofingTest(common.TestCase):
+    def test_spoofed_packets(self):
+        """Once the game has started, a death report without a signature and
+        one signed with the wrong key are sent to a client. The client should
+        drop both and log why.
+        """
+        ms_srv = common.MatchMakingServer(2222)
+        ms_srv.start()
+        common.sleep(2)
+
+        clients = common.start_multiple_clients(ms_srv.port, 2)
+        # Resume just after the MS has started the game, so the client has
+        # its session key.
+        common.sleep(common.MatchMakingServer.GAME_START_TIMEOUT - 1)
+
+        victim = clients[1]
+        report = {"IsLeader": True, "IsDeathReport": True,
+                  "Node": {"Id": "p2", "Ip": "localhost:{}".format(victim.node_port)}}
+        send_udp(victim.node_port, json.dumps(report))
+        forged = {"Sender": "p1", "Tick": 0, "Seq": 1,
+                  "Payload": report,
+                  "Mac": base64.b64encode("x" * 32)}
+        send_udp(victim.node_port, json.dumps(forged))
+        common.sleep(1)
+
+        with open(victim.local_log_path) as log_file:
+            log = log_file.read()
+        self.assertIn("unsigned packet", log,
+                      "Client should drop unsigned packets")
+        self.assertIn("bad signature from p1", log,
+                      "Client should drop packets signed with the wrong key")
+
+if __name__ == "__main__":
+    unittest.main()
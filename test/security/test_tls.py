@@ -0,0 +1,64 @@
+#!/usr/bin/env python2
+
+import os
+import shutil
+import subprocess
+import sys
+import tempfile
+import unittest
+
+_HERE = os.path.dirname(os.path.abspath(__file__))
+sys.path.append(os.path.dirname(_HERE))
+
+import common
+
+MKCERTS_DIR = os.path.join(os.path.dirname(common.NODE_CLIENT_DIR), "tools",
+                           "mkcerts")
+SCRIPT_PATH = os.path.join(os.path.dirname(_HERE), "headless", "straight.txt")
+
+def tls_args(certs_dir, name):
+    return ["-tlscert", os.path.join(certs_dir, name + ".pem"),
+            "-tlskey", os.path.join(certs_dir, name + "-key.pem"),
+            "-tlsca", os.path.join(certs_dir, "ca.pem")]
+
+class TLSTest(common.TestCase):
+    def setUp(self):
+        super(TLSTest, self).setUp()
+        self.certs_dir = tempfile.mkdtemp()
+        with common.use_cwd(MKCERTS_DIR):
+            subprocess.check_call(["go", "run", "mkcerts.go", "-dir",
+                                   self.certs_dir, "ms", "node"])
+
+    def tearDown(self):
+        super(TLSTest, self).tearDown()
+        shutil.rmtree(self.certs_dir)
+
+    def test_encrypted_game(self):
+        """The MS serves over TLS and hands out a peer key. Two clients with
+        certificates signed by the CA should get into a game and encrypt their
+        packets, and a third without a certificate shouldn't join.
+        """
+        ms_srv = common.MatchMakingServer(
+            2222, extra_args=tls_args(self.certs_dir, "ms") + ["-encryptpeers"])
+        ms_srv.start()
+        common.sleep(2)
+
+        node_args = tls_args(self.certs_dir, "node")
+        clients = common.start_multiple_clients(
+            ms_srv.port, 3, headless_script_path=SCRIPT_PATH,
+            extra_args_list=[node_args, node_args, []])
+        common.sleep(common.MatchMakingServer.GAME_START_TIMEOUT + 2)
+
+        for client in clients[:2]:
+            with open(client.local_log_path) as log_file:
+                log = log_file.read()
+            self.assertIn("Packets to peers are encrypted", log,
+                          "Clients with a certificate should play encrypted")
+            self.assertNotIn("Dropping packet", log,
+                             "Clients should accept each other's packets")
+
+        self.assertTrue(clients[2].has_exited(),
+                        "A client without a certificate can't join the MS")
+
+if __name__ == "__main__":
+    unittest.main()
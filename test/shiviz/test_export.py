@@ -0,0 +1,64 @@
+#!/usr/bin/env python2
+
+import os
+import shutil
+import subprocess
+import sys
+import tempfile
+import unittest
+
+_HERE = os.path.dirname(os.path.abspath(__file__))
+sys.path.append(os.path.dirname(_HERE))
+
+import common
+
+SHIVIZ_DIR = os.path.join(os.path.dirname(common.NODE_CLIENT_DIR), "tools",
+                          "shiviz")
+SHIVIZ_REGEX = r"(?<host>\S*) (?<clock>{.*})\n(?<event>.*)"
+
+class ExportTest(common.TestCase):
+    def setUp(self):
+        super(ExportTest, self).setUp()
+        self.tmp_dir = tempfile.mkdtemp()
+
+    def tearDown(self):
+        super(ExportTest, self).tearDown()
+        shutil.rmtree(self.tmp_dir)
+
+    def test_export_game(self):
+        """Play a game, then merge its logs. The merged file should start
+        with the ShiViz regex, and only have the MS and the players as hosts,
+        named by their ids.
+        """
+        ms_srv = common.MatchMakingServer(2222)
+        ms_srv.start()
+        common.sleep(2)
+
+        common.start_multiple_clients(ms_srv.port, 2)
+        common.sleep(common.MatchMakingServer.GAME_START_TIMEOUT * 1.1)
+
+        out_path = os.path.join(self.tmp_dir, "game1.log")
+        with common.use_cwd(SHIVIZ_DIR):
+            subprocess.check_call(["go", "run", "shiviz.go", "-game", "1",
+                                   "-o", out_path])
+
+        with open(out_path) as out_file:
+            lines = out_file.read().splitlines()
+        self.assertEquals(lines[0], SHIVIZ_REGEX,
+                          "The file should start with the ShiViz regex")
+        self.assertEquals(lines[1], "", "There should be a single execution")
+        hosts = set(line.split(" ", 1)[0] for line in lines[2::2])
+        self.assertEquals(hosts, set(["MS", "p1", "p2"]),
+                          "Hosts should be named after the MS and the players")
+
+        with common.use_cwd(SHIVIZ_DIR):
+            subprocess.check_call(["go", "run", "shiviz.go", "-game", "1",
+                                   "-events", "^Rpc", "-o", out_path])
+        with open(out_path) as out_file:
+            lines = out_file.read().splitlines()
+        for line in lines[3::2]:
+            self.assertTrue(line.startswith("Rpc"),
+                            "Line '{}' should be an RPC".format(line))
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,128 @@
+package main
+
+// mkcerts makes a self-signed CA and certificates signed by it, to try the
+// TLS mode of the matchmaking server and the nodes locally. Every certificate
+// can be used both as a server and as a client, since the ms server and the
+// nodes dial each other.
+//
+// usage: go run mkcerts.go [-dir certs] [-hosts localhost,127.0.0.1,::1] [name ...]
+//
+// The CA is kept in ca.pem and ca-key.pem, and made only if it doesn't exist
+// yet, so more certificates can be signed by the same CA later. Each name gets
+// name.pem and name-key.pem, "ms" and "node" by default.
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const VALIDITY time.Duration = 365 * 24 * time.Hour
+
+func main() {
+	dir := flag.String("dir", "certs", "directory to write the certificates to")
+	hosts := flag.String("hosts", "localhost,127.0.0.1,::1", "comma separated names and IPs the certificates are valid for")
+	flag.Parse()
+	names := flag.Args()
+	if len(names) == 0 {
+		names = []string{"ms", "node"}
+	}
+
+	checkErr(os.MkdirAll(*dir, 0700))
+	caCert, caKey := loadOrMakeCA(*dir)
+	for _, name := range names {
+		makeCert(*dir, name, strings.Split(*hosts, ","), caCert, caKey)
+	}
+}
+
+// Load the CA from dir, or make a new one if there is none.
+func loadOrMakeCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	certPath, keyPath := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "ca-key.pem")
+	if pair, err := tls.LoadX509KeyPair(certPath, keyPath); err == nil {
+		cert, err := x509.ParseCertificate(pair.Certificate[0])
+		checkErr(err)
+		key, ok := pair.PrivateKey.(*ecdsa.PrivateKey)
+		if !ok {
+			log.Fatalln(keyPath, "isn't an ECDSA key")
+		}
+		log.Println("Using the CA in", certPath)
+		return cert, key
+	}
+
+	key := newKey()
+	template := newTemplate("gotron local CA")
+	template.IsCA = true
+	template.BasicConstraintsValid = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	checkErr(err)
+	writePem(certPath, keyPath, der, key)
+
+	cert, err := x509.ParseCertificate(der)
+	checkErr(err)
+	return cert, key
+}
+
+// Make a certificate for name, signed by the CA.
+func makeCert(dir string, name string, hosts []string, caCert *x509.Certificate, caKey *ecdsa.PrivateKey) {
+	key := newKey()
+	template := newTemplate("gotron " + name)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+	checkErr(err)
+	writePem(filepath.Join(dir, name+".pem"), filepath.Join(dir, name+"-key.pem"), der, key)
+}
+
+func newKey() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(err)
+	return key
+}
+
+func newTemplate(commonName string) *x509.Certificate {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	checkErr(err)
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(VALIDITY),
+	}
+}
+
+// Write a certificate and its key, the key readable only by its owner.
+func writePem(certPath string, keyPath string, der []byte, key *ecdsa.PrivateKey) {
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	checkErr(err)
+	checkErr(ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	checkErr(ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	log.Println("Wrote", certPath, "and", keyPath)
+}
+
+func checkErr(err error) {
+	if err != nil {
+		log.Fatalln(err)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+// shiviz merges the GoVector logs of the matchmaking server and the nodes of a
+// game into a single file that ShiViz reads as it is, with the parsing regex
+// on its first line and the hosts named p1, p2, ... and MS instead of their
+// addresses.
+//
+// usage: go run shiviz.go -game id [-o file] [-host addr=name] [-from time] [-to time]
+//                         [-events regexp] [dir ...]
+//
+// The players of the game, and the matchmaking server that started it, are
+// found in the -local.txt logs in the directories, ../../MatchMaking and
+// ../../Node-Client by default; their -Log.txt files are expected next to
+// them. -from and -to, in RFC 3339, keep the events that happened in between,
+// and -events keeps the events whose text matches, e.g. "Rpc" for the RPCs or
+// "Interval update" for the updates between peers. The logs must have been
+// written with -trace govec, and with -loglevel debug for -from and -to: the
+// time of an event is in the "Traced" record the host wrote to its local log
+// with the clock GoVector gave the event, and shiviz stops if it finds no such
+// record for -from or -to.
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const SHIVIZ_REGEX string = `(?<host>\S*) (?<clock>{.*})\n(?<event>.*)`
+const MS_NAME string = "MS"
+const TRACED_MSG string = "Traced" // Message of the local records with the time of an event.
+
+// An event of a GoVector log.
+type Event struct {
+	Host  string
+	Clock map[string]int
+	Text  string
+	Time  time.Time // Zero for the events without a Traced record.
+}
+
+// Where a host's logs are, and what to call it.
+type Host struct {
+	Addr string
+	Name string
+	Dir  string
+}
+
+// hostFlags collects the -host addr=name flags.
+type hostFlags map[string]string
+
+func (h hostFlags) String() string {
+	return fmt.Sprint(map[string]string(h))
+}
+
+func (h hostFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("%q isn't addr=name", value)
+	}
+	h[parts[0]] = parts[1]
+	return nil
+}
+
+func main() {
+	gameId := flag.Int("game", 0, "id of the game, as logged by the matchmaking server and the nodes")
+	outPath := flag.String("o", "", "file to write the merged log to, stdout by default")
+	from := flag.String("from", "", "keep the events from this time on (RFC 3339)")
+	to := flag.String("to", "", "keep the events up to this time (RFC 3339)")
+	events := flag.String("events", "", "keep the events whose text matches this regexp")
+	names := hostFlags{}
+	flag.Var(names, "host", "name the host at addr, as addr=name; may be repeated")
+	flag.Parse()
+	if *gameId <= 0 {
+		log.Fatalln("usage: go run shiviz.go -game id [-o file] [-host addr=name] [-from time] [-to time] [-events regexp] [dir ...]")
+	}
+	dirs := flag.Args()
+	if len(dirs) == 0 {
+		dirs = []string{filepath.Join("..", "..", "MatchMaking"), filepath.Join("..", "..", "Node-Client")}
+	}
+
+	var fromTime, toTime time.Time
+	var err error
+	if *from != "" {
+		fromTime, err = time.Parse(time.RFC3339Nano, *from)
+		checkErr(err)
+	}
+	if *to != "" {
+		toTime, err = time.Parse(time.RFC3339Nano, *to)
+		checkErr(err)
+	}
+	var match *regexp.Regexp
+	if *events != "" {
+		match, err = regexp.Compile(*events)
+		checkErr(err)
+	}
+
+	hosts := findHosts(dirs, *gameId)
+	if len(hosts) == 0 {
+		log.Fatalln("No logs of game", *gameId, "in", strings.Join(dirs, ", "))
+	}
+	// Hosts named with -host may also be outside the game, like spectators,
+	// and only show up in the clocks.
+	rename := make(map[string]string)
+	for _, host := range hosts {
+		if name, ok := names[host.Addr]; ok {
+			host.Name = name
+		}
+		rename[host.Addr] = host.Name
+	}
+	for addr, name := range names {
+		rename[addr] = name
+	}
+
+	// Without Traced records no event has a time, and -from and -to would
+	// silently leave out every event.
+	logs := make([][]*Event, len(hosts))
+	timed := 0
+	for i, host := range hosts {
+		logs[i] = readLog(host)
+		for _, event := range logs[i] {
+			if !event.Time.IsZero() {
+				timed++
+			}
+		}
+	}
+	if timed == 0 && (!fromTime.IsZero() || !toTime.IsZero()) {
+		log.Fatalln("No", TRACED_MSG, "records in the local logs of game", *gameId,
+			"to filter by time: write the logs with -loglevel debug")
+	}
+
+	out := io.Writer(os.Stdout)
+	if *outPath != "" {
+		file, err := os.Create(*outPath)
+		checkErr(err)
+		defer file.Close()
+		out = file
+	}
+	writer := bufio.NewWriter(out)
+	defer writer.Flush()
+	// ShiViz reads the regex from the first line, and the delimiter of
+	// executions from the second, empty since there is only one.
+	fmt.Fprintf(writer, "%s\n\n", SHIVIZ_REGEX)
+
+	for i, host := range hosts {
+		kept := 0
+		for _, event := range logs[i] {
+			if !fromTime.IsZero() && (event.Time.IsZero() || event.Time.Before(fromTime)) {
+				continue
+			}
+			if !toTime.IsZero() && (event.Time.IsZero() || event.Time.After(toTime)) {
+				continue
+			}
+			if match != nil && !match.MatchString(event.Text) {
+				continue
+			}
+			writeEvent(writer, event, rename)
+			kept++
+		}
+		log.Println("Kept", kept, "events of", host.Name, "at", host.Addr)
+	}
+}
+
+// Find the matchmaking server and the players of a game in the local logs of
+// dirs. The server is first, then the players by id. The server logs the
+// addresses of the players, so that the logs other nodes left from older games
+// with the same id are left out.
+func findHosts(dirs []string, gameId int) []*Host {
+	game := strconv.Itoa(gameId)
+	byAddr := make(map[string]*Host)
+	var players map[string]bool // Nil until the server's record is found.
+	for _, dir := range dirs {
+		paths, err := filepath.Glob(filepath.Join(dir, "*-local.txt*"))
+		checkErr(err)
+		for _, path := range paths {
+			file, err := os.Open(path)
+			checkErr(err)
+			scanner := bufio.NewScanner(file)
+			scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+			for scanner.Scan() {
+				record := parseRecord(scanner.Text())
+				if record["game"] != game || record["addr"] == "" {
+					continue
+				}
+				name := record["node"]
+				if record["msg"] == "Starting Game" {
+					name = MS_NAME
+					players = make(map[string]bool)
+					for _, addr := range strings.Split(record["nodes"], ",") {
+						players[addr] = true
+					}
+				}
+				if name != "" && byAddr[record["addr"]] == nil {
+					byAddr[record["addr"]] = &Host{Addr: record["addr"], Name: name, Dir: dir}
+				}
+			}
+			checkErr(scanner.Err())
+			file.Close()
+		}
+	}
+
+	hosts := make([]*Host, 0, len(byAddr))
+	for _, host := range byAddr {
+		if players == nil || host.Name == MS_NAME || players[host.Addr] {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		if (hosts[i].Name == MS_NAME) != (hosts[j].Name == MS_NAME) {
+			return hosts[i].Name == MS_NAME
+		}
+		return hosts[i].Name < hosts[j].Name
+	})
+	return hosts
+}
+
+// Parse a record of a local log, in logfmt or JSON. Values are kept as text.
+func parseRecord(line string) map[string]string {
+	record := make(map[string]string)
+	if strings.HasPrefix(line, "{") {
+		var fields map[string]interface{}
+		if json.Unmarshal([]byte(line), &fields) == nil {
+			for key, value := range fields {
+				record[key] = fmt.Sprint(value)
+			}
+		}
+		return record
+	}
+
+	for line != "" {
+		line = strings.TrimLeft(line, " ")
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			break
+		}
+		key, rest := line[:eq], line[eq+1:]
+		value := rest
+		if strings.HasPrefix(rest, `"`) {
+			quoted, err := strconv.QuotedPrefix(rest)
+			if err != nil {
+				break
+			}
+			value, _ = strconv.Unquote(quoted)
+			rest = rest[len(quoted):]
+		} else if space := strings.IndexByte(rest, ' '); space >= 0 {
+			value, rest = rest[:space], rest[space:]
+		} else {
+			rest = ""
+		}
+		record[key] = value
+		line = rest
+	}
+	return record
+}
+
+// Read the times of a host's events from its local logs, by the host's clock
+// at the event. The clock starts over whenever the host does, and only the
+// last run is kept, since the GoVector log only has that one.
+func readTimes(host *Host) map[int]time.Time {
+	paths, err := filepath.Glob(filepath.Join(host.Dir, strings.Replace(host.Addr, ":", "", -1)+"-local.txt*"))
+	checkErr(err)
+	// Rotated logs are older the higher their number, and the current one is
+	// the newest.
+	sort.Slice(paths, func(i, j int) bool {
+		return rotation(paths[i]) > rotation(paths[j])
+	})
+
+	times := make(map[int]time.Time)
+	last := 0
+	for _, path := range paths {
+		file, err := os.Open(path)
+		checkErr(err)
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			record := parseRecord(scanner.Text())
+			if record["msg"] != TRACED_MSG || record["addr"] != host.Addr {
+				continue
+			}
+			clock, err := strconv.Atoi(record["clock"])
+			if err != nil {
+				continue
+			}
+			t, err := time.Parse(time.RFC3339Nano, record["time"])
+			if err != nil {
+				continue
+			}
+			if clock <= last {
+				times = make(map[int]time.Time)
+			}
+			times[clock] = t
+			last = clock
+		}
+		checkErr(scanner.Err())
+		file.Close()
+	}
+	return times
+}
+
+// Return the number of a rotated log, 0 for the current one.
+func rotation(path string) int {
+	ext := filepath.Ext(path)
+	if n, err := strconv.Atoi(strings.TrimPrefix(ext, ".")); err == nil {
+		return n
+	}
+	return 0
+}
+
+// Read the events of a host's GoVector log: a line with the host and its
+// clock, then a line with the text of the event.
+func readLog(host *Host) []*Event {
+	times := readTimes(host)
+	path := filepath.Join(host.Dir, strings.Replace(host.Addr, ":", "", -1)+"-Log.txt")
+	file, err := os.Open(path)
+	checkErr(err)
+	defer file.Close()
+
+	var events []*Event
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		header := scanner.Text()
+		if header == "" {
+			continue
+		}
+		space := strings.IndexByte(header, ' ')
+		if space < 0 || !scanner.Scan() {
+			log.Fatalln("Malformed event in", path+":", header)
+		}
+		event := &Event{Host: header[:space], Text: scanner.Text()}
+		checkErr(json.Unmarshal([]byte(header[space+1:]), &event.Clock))
+		event.Time = times[event.Clock[event.Host]]
+		events = append(events, event)
+	}
+	checkErr(scanner.Err())
+	return events
+}
+
+// Write an event as GoVector does, with the hosts renamed.
+func writeEvent(w io.Writer, event *Event, rename map[string]string) {
+	clock := make(map[string]int, len(event.Clock))
+	for host, ticks := range event.Clock {
+		clock[renamed(host, rename)] = ticks
+	}
+	clockJson, err := json.Marshal(clock)
+	checkErr(err)
+	fmt.Fprintf(w, "%s %s\n%s\n", renamed(event.Host, rename), clockJson, event.Text)
+}
+
+func renamed(addr string, rename map[string]string) string {
+	if name, ok := rename[addr]; ok {
+		return name
+	}
+	return addr
+}
+
+func checkErr(err error) {
+	if err != nil {
+		log.Fatalln(err)
+	}
+}